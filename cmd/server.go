@@ -17,9 +17,7 @@ package cmd
 
 import (
 	"os"
-	signals "os/signal"
 	"runtime"
-	"syscall"
 	"time"
 
 	"github.com/rabbitt/portunus/portunus"
@@ -33,47 +31,42 @@ var serverCmd = &cobra.Command{
 	Use:   "server",
 	Short: "Starts the Portunus service",
 	Run: func(cmd *cobra.Command, args []string) {
-		sig := make(chan os.Signal, 1)
-		signals.Notify(sig, syscall.SIGUSR1, syscall.SIGHUP)
+		// running without a config file is fine, but not with a broken one
+		if _, ok := configErr.(config.ConfigFileNotFoundError); configErr != nil && !ok {
+			log.FatalWithFields("Unable to load config file", log.Fields{"error": configErr})
+		}
 
 		// Initial load of Server.Config uses LoadFromMap
-		server.Settings.LoadFromMap(config.AllSettings(), func(a, b *server.Config) {})
-
-		go func() {
-
-			for {
-				signal := <-sig
-
-				switch signal {
-				case syscall.SIGHUP:
-					if server.Settings.ConfigFile != "" {
-						log.Infof("Reloading configuration on SIGHUP - yaaay")
-						loadConfig()
-						// Further Server.Config reloads log a diff of changes
-						server.Settings.LoadAndLogDiff(config.AllSettings())
-					} else {
-						log.Warnf("Received config reload request when no config provided")
-					}
-				default:
-					log.Warnf("unhandled signal: %+v", signal)
-				}
-			}
-		}()
+		if err := server.LoadFromMap(config.AllSettings(), func(a, b *server.Config) {}); err != nil {
+			log.FatalWithFields("Invalid configuration", log.Fields{"error": err})
+		}
 
-		server.NewServer().Run()
+		// Further reloads (on SIGHUP) re-read the config file, and only take
+		// effect if the new configuration is valid
+		server.NewServer().WithConfigSource(func() (map[string]interface{}, error) {
+			if err := loadConfig(); err != nil {
+				return nil, err
+			}
+			return config.AllSettings(), nil
+		}).Run()
 	},
 }
 
+// configErr is the error loading the config file at startup, which is only
+// fatal to the server command
+var configErr error
+
 func init() {
 	rootCmd.AddCommand(serverCmd)
-	cobra.OnInitialize(loadConfig)
+	cobra.OnInitialize(func() { configErr = loadConfig() })
 
 	initFlags()
 	initEnvVars()
 }
 
-// loadConfig reads in config file and ENV variables if set.
-func loadConfig() {
+// loadConfig reads in config file and ENV variables if set, returning the
+// error if the config file couldn't be found or read.
+func loadConfig() error {
 	cfgFile := config.GetString("config")
 	if cfgFile != "" {
 		config.SetConfigFile(cfgFile)
@@ -85,12 +78,15 @@ func loadConfig() {
 	}
 
 	// If a config file is found, read it in.
-	if err := config.ReadInConfig(); err == nil {
-		config.Set("config", config.ConfigFileUsed())
-		log.InfoWithFields("Config file loaded", log.Fields{
-			"config.file": config.ConfigFileUsed(),
-		})
+	if err := config.ReadInConfig(); err != nil {
+		return err
 	}
+
+	config.Set("config", config.ConfigFileUsed())
+	log.InfoWithFields("Config file loaded", log.Fields{
+		"config.file": config.ConfigFileUsed(),
+	})
+	return nil
 }
 
 func initFlags() {
@@ -111,6 +107,7 @@ func createFlags() {
 	serverCmd.Flags().StringP("server.tls.key", "K", "", "path to TLS key")
 
 	serverCmd.Flags().StringP("logging.level", "l", "info", "log level (e.g., error, warn, info, debug)")
+	serverCmd.Flags().StringP("logging.format", "", "text", "log format (text, json or logfmt)")
 
 	serverCmd.Flags().IntP("network.max_idle_connections", "", 5000, "maximum total number of idle connections to upstream servers")
 	serverCmd.Flags().IntP("network.max_idle_per_host", "", 100, "maximum number of idle connections *per* upstream servers")
@@ -121,6 +118,8 @@ func createFlags() {
 	serverCmd.Flags().DurationP("network.timeouts.idle_connection", "", 90*time.Second, "how long to keep idle (unused) connections in the pool")
 	serverCmd.Flags().DurationP("network.timeouts.tls_handshake", "", 5*time.Second, "timeout when during tls handshake")
 	serverCmd.Flags().DurationP("network.timeouts.continue", "", 5*time.Second, "timeout while waiting for a CONTINUE request/response")
+	serverCmd.Flags().DurationP("network.timeouts.response_header", "", 0, "timeout while waiting for upstream response headers (0 for none)")
+	serverCmd.Flags().DurationP("network.timeouts.total", "", 0, "timeout for the whole upstream request, including retries and the response body (0 for none)")
 
 	serverCmd.Flags().StringSliceP("dns.resolvers", "r", nil, "comma separated list of dns resolvers to use (default: system resolver)")
 }
@@ -137,6 +136,7 @@ func bindFlags() {
 	config.BindPFlag("server.tls.key", serverCmd.Flags().Lookup("server.tls.key"))
 
 	config.BindPFlag("logging.level", serverCmd.Flags().Lookup("logging.level"))
+	config.BindPFlag("logging.format", serverCmd.Flags().Lookup("logging.format"))
 
 	config.BindPFlag("network.max_idle_connections", serverCmd.Flags().Lookup("network.max_idle_connections"))
 	config.BindPFlag("network.max_idle_per_host", serverCmd.Flags().Lookup("network.max_idle_per_host"))
@@ -147,6 +147,8 @@ func bindFlags() {
 	config.BindPFlag("network.timeouts.idle_connection", serverCmd.Flags().Lookup("network.timeouts.idle_connection"))
 	config.BindPFlag("network.timeouts.tls_handshake", serverCmd.Flags().Lookup("network.timeouts.tls_handshake"))
 	config.BindPFlag("network.timeouts.continue", serverCmd.Flags().Lookup("network.timeouts.continue"))
+	config.BindPFlag("network.timeouts.response_header", serverCmd.Flags().Lookup("network.timeouts.response_header"))
+	config.BindPFlag("network.timeouts.total", serverCmd.Flags().Lookup("network.timeouts.total"))
 
 	config.BindPFlag("dns.resolvers", serverCmd.Flags().Lookup("dns.resolvers"))
 }
@@ -155,12 +157,34 @@ func setDefaults() {
 	config.SetDefault("server.bind_address", "0.0.0.0:8080")
 	config.SetDefault("server.threads", runtime.GOMAXPROCS(0))
 	config.SetDefault("server.http2.enabled", false)
+	config.SetDefault("server.http2.h2c", false)
 	config.SetDefault("server.tls.enabled", false)
 	config.SetDefault("server.shutdown_timeout", 5*time.Second)
 	config.SetDefault("server.tls.cert", "")
 	config.SetDefault("server.tls.key", "")
+	config.SetDefault("server.tls.certificate_dir", "")
+	config.SetDefault("server.tls.watch_interval", 30*time.Second)
+	config.SetDefault("server.tls.profile", "intermediate")
+	config.SetDefault("server.tls.min_version", "")
+	config.SetDefault("server.tls.max_version", "")
+	config.SetDefault("server.tls.cipher_suites", []string{})
+	config.SetDefault("server.tls.curves", []string{})
+	config.SetDefault("server.tls.client_auth.mode", "request")
+	config.SetDefault("server.tls.client_auth.ca", "")
+	config.SetDefault("server.tls.client_auth.forward_headers", false)
+	config.SetDefault("server.tls.acme.enabled", false)
+	config.SetDefault("server.tls.acme.accept_tos", false)
+	config.SetDefault("server.tls.acme.directory", "https://acme-v02.api.letsencrypt.org/directory")
+	config.SetDefault("server.tls.acme.cache_dir", "/var/lib/portunus/acme")
+	config.SetDefault("server.tls.acme.renew_before", 30*24*time.Hour)
+	config.SetDefault("server.tls.acme.challenges", []string{"http-01", "tls-alpn-01"})
+	config.SetDefault("server.tls.acme.http_address", ":80")
 
 	config.SetDefault("logging.level", "info")
+	config.SetDefault("logging.format", "text")
+	config.SetDefault("logging.output", "stderr")
+	config.SetDefault("logging.loggers", map[string]string{})
+	config.SetDefault("logging.admin_endpoint", false)
 
 	config.SetDefault("network.max_idle_connections", 5000)
 	config.SetDefault("network.max_idle_per_host", 100)
@@ -172,9 +196,41 @@ func setDefaults() {
 	config.SetDefault("network.timeouts.idle_connection", 90*time.Second)
 	config.SetDefault("network.timeouts.tls_handshake", 5*time.Second)
 	config.SetDefault("network.timeouts.continue", 5*time.Second)
+	config.SetDefault("network.timeouts.response_header", 0)
+	config.SetDefault("network.timeouts.total", 0)
 
 	config.SetDefault("dns.resolvers", nil)
 
+	config.SetDefault("access_log.enabled", false)
+	config.SetDefault("access_log.format", "combined")
+	config.SetDefault("access_log.path", "-")
+	config.SetDefault("access_log.rotation.max_size", 100)
+	config.SetDefault("access_log.rotation.interval", 24*time.Hour)
+	config.SetDefault("access_log.rotation.max_backups", 7)
+	config.SetDefault("access_log.sample_rate", 1.0)
+
+	config.SetDefault("metrics.prometheus.enabled", true)
+	config.SetDefault("metrics.prometheus.max_upstreams", 100)
+
+	config.SetDefault("tracing.enabled", false)
+	config.SetDefault("tracing.service_name", "portunus")
+	config.SetDefault("tracing.sample_ratio", 1.0)
+	config.SetDefault("tracing.propagation", []string{"w3c"})
+	config.SetDefault("tracing.exporter.type", "otlp")
+	config.SetDefault("tracing.exporter.endpoint", "http://localhost:4318")
+	config.SetDefault("tracing.exporter.timeout", 10*time.Second)
+
+	config.SetDefault("circuit_breaker.enabled", false)
+	config.SetDefault("circuit_breaker.consecutive_failures", 5)
+	config.SetDefault("circuit_breaker.error_rate", 0.5)
+	config.SetDefault("circuit_breaker.min_requests", 20)
+	config.SetDefault("circuit_breaker.window", 10*time.Second)
+	config.SetDefault("circuit_breaker.open_timeout", 30*time.Second)
+	config.SetDefault("circuit_breaker.half_open_requests", 1)
+
+	config.SetDefault("rate_limit.max_keys", 100000)
+	config.SetDefault("rate_limit.limits", []map[string]interface{}{})
+
 	config.SetDefault("routes", map[string]map[string]interface{}{
 		"default": map[string]interface{}{
 			"upstream":                   "{{req.host}}",
@@ -206,6 +262,19 @@ func setDefaults() {
     </html>
   `)
 
+	config.SetDefault("response.client_cert_required.code", 403)
+	config.SetDefault("response.client_cert_required.body", `
+    <html>
+      <head>
+        <title>403 - Forbidden</title>
+      </head>
+      <body>
+        <h1>Forbidden</h1>
+        <p>A valid client certificate is required.<p>
+      </body>
+    </html>
+  `)
+
 	config.SetDefault("response.server_error.code", 500)
 	config.SetDefault("response.server_error.body", `
     <html>
@@ -219,6 +288,45 @@ func setDefaults() {
     </html>
   `)
 
+	config.SetDefault("response.service_unavailable.code", 503)
+	config.SetDefault("response.service_unavailable.body", `
+    <html>
+      <head>
+        <title>503 - Service Unavailable</title>
+      </head>
+      <body>
+        <h1>Service Unavailable</h1>
+        <p>Please try again later.<p>
+      </body>
+    </html>
+  `)
+
+	config.SetDefault("response.rate_limited.code", 429)
+	config.SetDefault("response.rate_limited.body", `
+    <html>
+      <head>
+        <title>429 - Too Many Requests</title>
+      </head>
+      <body>
+        <h1>Too Many Requests</h1>
+        <p>Please try again later.<p>
+      </body>
+    </html>
+  `)
+
+	config.SetDefault("response.gateway_timeout.code", 504)
+	config.SetDefault("response.gateway_timeout.body", `
+    <html>
+      <head>
+        <title>504 - Gateway Timeout</title>
+      </head>
+      <body>
+        <h1>Gateway Timeout</h1>
+        <p>Please try again later.<p>
+      </body>
+    </html>
+  `)
+
 	config.SetDefault("newrelic.enabled", false)
 	config.SetDefault("newrelic.app_name", "")
 	config.SetDefault("newrelic.license_key", "")
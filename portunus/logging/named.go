@@ -0,0 +1,393 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	FormatText   = "text"
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+
+	// RootLogger is the name used for the root logger's level
+	RootLogger = "root"
+)
+
+// Logger is a named sub-logger (e.g., "router"), whose level can be set
+// independently of the root logger. Until it's given a level of its own, it
+// follows the root logger's level. Its entries are tagged with a logger field.
+type Logger struct {
+	name   string
+	logger *logrus.Logger
+	level  string // "" follows the root level
+}
+
+type loggerRegistry struct {
+	sync.RWMutex
+	output  string
+	file    *RotatingFile
+	loggers map[string]*Logger
+}
+
+// logrus writes to stderr until configured otherwise
+var registry = &loggerRegistry{
+	output:  "stderr",
+	loggers: make(map[string]*Logger),
+}
+
+// Named returns the sub-logger with the given name, creating it if needed.
+func Named(name string) *Logger {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if l, ok := registry.loggers[name]; ok {
+		return l
+	}
+
+	root := GetLogger()
+	l := &Logger{name: name, logger: logrus.New()}
+	l.logger.SetFormatter(root.Formatter)
+	l.logger.SetOutput(root.Out)
+	l.logger.SetLevel(root.GetLevel())
+	registry.loggers[name] = l
+
+	return l
+}
+
+// newFormatter returns the formatter for the given format name.
+func newFormatter(format string) (logrus.Formatter, error) {
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		return &logrus.TextFormatter{
+			FullTimestamp:          true,
+			DisableLevelTruncation: true,
+			DisableSorting:         true,
+		}, nil
+	case FormatJSON:
+		return &logrus.JSONFormatter{}, nil
+	case FormatLogfmt:
+		// the text formatter writes key=value pairs when colors are disabled
+		return &logrus.TextFormatter{
+			DisableColors:    true,
+			FullTimestamp:    true,
+			QuoteEmptyFields: true,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// ValidateFormat returns an error if format isn't a known log format.
+func ValidateFormat(format string) error {
+	_, err := newFormatter(format)
+	return err
+}
+
+// Output is a log destination, opened ahead of Configure so that one that
+// can't be opened is caught before anything else is applied.
+type Output struct {
+	name   string
+	writer io.Writer // nil keeps the current output
+	file   *RotatingFile
+}
+
+// OpenOutput opens the given destination: stdout, stderr or a file path. The
+// current output isn't opened again, but kept as is. The returned output must
+// be passed on to Configure, or closed.
+func OpenOutput(output string) (*Output, error) {
+	registry.RLock()
+	current := registry.output
+	registry.RUnlock()
+
+	o := &Output{name: output}
+	switch output {
+	case current:
+	case "", "-", "stdout":
+		o.writer = os.Stdout
+	case "stderr":
+		o.writer = os.Stderr
+	default:
+		file, err := NewRotatingFile(output, 0, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		o.writer, o.file = file, file
+	}
+	return o, nil
+}
+
+// Close closes the output's file, if it has one. It's only needed for an
+// output that ends up not being passed on to Configure.
+func (o *Output) Close() error {
+	if o == nil || o.file == nil {
+		return nil
+	}
+	return o.file.Close()
+}
+
+// Configure sets the format and destination of every logger. A nil output
+// keeps the current one.
+func Configure(format string, output *Output) error {
+	formatter, err := newFormatter(format)
+	if err != nil {
+		output.Close()
+		return err
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	var oldFile *RotatingFile
+	var writer io.Writer
+	if output != nil && output.writer != nil {
+		writer = output.writer
+		oldFile = registry.file
+		registry.file = output.file
+		registry.output = output.name
+	}
+
+	for _, logger := range registry.all() {
+		logger.SetFormatter(formatter)
+		if writer != nil {
+			logger.SetOutput(writer)
+		}
+	}
+
+	if oldFile != nil {
+		oldFile.Close()
+	}
+
+	return nil
+}
+
+// Reopen reopens the log file, if logging to one, so that it can be rotated
+// by an external tool like logrotate.
+func Reopen() error {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	if registry.file == nil {
+		return nil
+	}
+	return registry.file.Reopen()
+}
+
+// all returns the root, standard and named logrus loggers. The registry
+// must be locked by the caller.
+func (r *loggerRegistry) all() []*logrus.Logger {
+	loggers := []*logrus.Logger{GetLogger(), logrus.StandardLogger()}
+	for _, l := range r.loggers {
+		loggers = append(loggers, l.logger)
+	}
+	return loggers
+}
+
+// ValidateLevels returns an error if any of the levels can't be parsed, or
+// names a logger that doesn't exist (other than RootLogger).
+func ValidateLevels(levels map[string]string) error {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	for name, level := range levels {
+		if _, ok := registry.loggers[name]; !ok && name != RootLogger {
+			return fmt.Errorf("unknown logger %q", name)
+		}
+		if _, err := logrus.ParseLevel(level); err != nil {
+			return fmt.Errorf("logger %q: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// ConfigureLevels sets the root level, and the level of each named logger.
+// Sub-loggers missing from levels go back to following the root level. The
+// root level is applied first, so an invalid or unknown entry in levels only
+// affects that entry: the logger it names follows the root level, and the
+// entry is reported in the returned error.
+func ConfigureLevels(root string, levels map[string]string) error {
+	rootLevel, err := logrus.ParseLevel(root)
+	if err != nil {
+		return err
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	GetLogger().SetLevel(rootLevel)
+	logrus.StandardLogger().SetLevel(rootLevel)
+
+	var invalid []string
+	for name, level := range levels {
+		if _, ok := registry.loggers[name]; !ok && name != RootLogger {
+			invalid = append(invalid, fmt.Sprintf("unknown logger %q", name))
+		} else if _, err := logrus.ParseLevel(level); err != nil {
+			invalid = append(invalid, fmt.Sprintf("logger %q: %s", name, err))
+		}
+	}
+
+	for name, l := range registry.loggers {
+		l.level = levels[name]
+		if _, err := logrus.ParseLevel(l.level); err != nil {
+			l.level = ""
+		}
+		l.applyLevel(rootLevel)
+	}
+
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return fmt.Errorf("%s", strings.Join(invalid, "; "))
+	}
+
+	return nil
+}
+
+// SetLevel changes the level of a single logger at runtime. Setting the root
+// logger's level (named RootLogger, or "") also changes the sub-loggers that
+// follow it, and an empty level makes a sub-logger follow the root again.
+func SetLevel(name, level string) error {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if name == "" || name == RootLogger {
+		rootLevel, err := logrus.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+
+		GetLogger().SetLevel(rootLevel)
+		logrus.StandardLogger().SetLevel(rootLevel)
+		for _, l := range registry.loggers {
+			l.applyLevel(rootLevel)
+		}
+		return nil
+	}
+
+	l, ok := registry.loggers[name]
+	if !ok {
+		return fmt.Errorf("unknown logger %q", name)
+	}
+
+	if level != "" {
+		if _, err := logrus.ParseLevel(level); err != nil {
+			return err
+		}
+	}
+
+	l.level = level
+	l.applyLevel(GetLogger().GetLevel())
+
+	return nil
+}
+
+// Levels returns the effective level of the root and every named logger.
+func Levels() map[string]string {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	levels := map[string]string{RootLogger: GetLogger().GetLevel().String()}
+	for name, l := range registry.loggers {
+		levels[name] = l.logger.GetLevel().String()
+	}
+
+	return levels
+}
+
+// applyLevel sets the logger's own level, or the root level if it doesn't
+// have one. The registry must be locked by the caller.
+func (l *Logger) applyLevel(rootLevel logrus.Level) {
+	level := rootLevel
+	if l.level != "" {
+		// already validated
+		level, _ = logrus.ParseLevel(l.level)
+	}
+	l.logger.SetLevel(level)
+}
+
+func (l *Logger) Name() string { return l.name }
+
+func (l *Logger) IsLevelEnabled(level logrus.Level) bool { return l.logger.IsLevelEnabled(level) }
+func (l *Logger) IsTraceEnabled() bool                   { return l.IsLevelEnabled(logrus.TraceLevel) }
+func (l *Logger) IsDebugEnabled() bool                   { return l.IsLevelEnabled(logrus.DebugLevel) }
+
+// withFields returns an entry tagged with the logger's name, and any fields
+// passed as the last argument.
+func (l *Logger) withFields(args []interface{}) (*logrus.Entry, []interface{}) {
+	entry := l.logger.WithField("logger", l.name)
+	if len(args) > 0 {
+		if fields, rest := extractFields(args); fields != nil {
+			return entry.WithFields(fields), rest
+		}
+	}
+	return entry, args
+}
+
+func (l *Logger) log(level logrus.Level, args []interface{}) {
+	if l.logger.IsLevelEnabled(level) {
+		entry, args := l.withFields(args)
+		entry.Log(level, args...)
+	}
+}
+
+func (l *Logger) logf(level logrus.Level, format string, args []interface{}) {
+	if l.logger.IsLevelEnabled(level) {
+		entry, args := l.withFields(args)
+		entry.Logf(level, format, args...)
+	}
+}
+
+func (l *Logger) TraceWithFields(args ...interface{}) { l.log(logrus.TraceLevel, args) }
+func (l *Logger) DebugWithFields(args ...interface{}) { l.log(logrus.DebugLevel, args) }
+func (l *Logger) InfoWithFields(args ...interface{})  { l.log(logrus.InfoLevel, args) }
+func (l *Logger) WarnWithFields(args ...interface{})  { l.log(logrus.WarnLevel, args) }
+func (l *Logger) ErrorWithFields(args ...interface{}) { l.log(logrus.ErrorLevel, args) }
+
+func (l *Logger) TracefWithFields(format string, args ...interface{}) {
+	l.logf(logrus.TraceLevel, format, args)
+}
+func (l *Logger) DebugfWithFields(format string, args ...interface{}) {
+	l.logf(logrus.DebugLevel, format, args)
+}
+func (l *Logger) InfofWithFields(format string, args ...interface{}) {
+	l.logf(logrus.InfoLevel, format, args)
+}
+func (l *Logger) WarnfWithFields(format string, args ...interface{}) {
+	l.logf(logrus.WarnLevel, format, args)
+}
+func (l *Logger) ErrorfWithFields(format string, args ...interface{}) {
+	l.logf(logrus.ErrorLevel, format, args)
+}
+
+func (l *Logger) Trace(args ...interface{}) { l.log(logrus.TraceLevel, args) }
+func (l *Logger) Debug(args ...interface{}) { l.log(logrus.DebugLevel, args) }
+func (l *Logger) Info(args ...interface{})  { l.log(logrus.InfoLevel, args) }
+func (l *Logger) Warn(args ...interface{})  { l.log(logrus.WarnLevel, args) }
+func (l *Logger) Error(args ...interface{}) { l.log(logrus.ErrorLevel, args) }
+
+func (l *Logger) Tracef(format string, args ...interface{}) { l.logf(logrus.TraceLevel, format, args) }
+func (l *Logger) Debugf(format string, args ...interface{}) { l.logf(logrus.DebugLevel, format, args) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.logf(logrus.InfoLevel, format, args) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.logf(logrus.WarnLevel, format, args) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.logf(logrus.ErrorLevel, format, args) }
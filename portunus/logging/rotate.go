@@ -0,0 +1,205 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package logging
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rotatedTimeFormat = "20060102-150405.000"
+
+// RotatingFile is a log file that rotates itself once it reaches a maximum
+// size, or has been open for a given interval. Rotated files are renamed with
+// a timestamp suffix (e.g., access.log.20180102-150405.000), and only the newest
+// MaxBackups are kept. A zero MaxSize or Interval disables that trigger, and
+// a zero MaxBackups keeps every rotated file.
+//
+// If the file can't be reopened after rotating, writes carry on to the old
+// (renamed) file, and reopening is retried on each write until it succeeds.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	Interval   time.Duration
+	MaxBackups int
+
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	// the file at Path needs to be (re)opened
+	reopen bool
+}
+
+// NewRotatingFile opens (or creates) the file at path for appending.
+func NewRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{Path: path, MaxSize: maxSize, Interval: interval, MaxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// open opens the file at Path, only closing the current one once it has, so
+// that there's always somewhere to write to.
+func (rf *RotatingFile) open() error {
+	if dir := filepath.Dir(rf.Path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(rf.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if rf.file != nil {
+		rf.file.Close()
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	rf.opened = time.Now()
+	rf.reopen = false
+
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if rf.reopen {
+		// errors were already reported when the reopen first failed
+		rf.open()
+	} else if (rf.MaxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.MaxSize) ||
+		(rf.Interval > 0 && time.Since(rf.opened) >= rf.Interval) {
+		if err := rf.rotate(); err != nil {
+			// keep writing to the current file rather than losing entries
+			fmt.Fprintf(os.Stderr, "unable to rotate %s: %s\n", rf.Path, err)
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the file now.
+func (rf *RotatingFile) Rotate() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	return rf.rotate()
+}
+
+func (rf *RotatingFile) rotate() error {
+	rotated := rf.Path + "." + time.Now().Format(rotatedTimeFormat)
+	if err := os.Rename(rf.Path, rotated); err != nil {
+		return err
+	}
+
+	rf.reopen = true
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	rf.prune()
+
+	return nil
+}
+
+// prune removes all but the newest MaxBackups rotated files. Only files named
+// exactly as rotate names them are considered, so that unrelated files
+// sharing the prefix (e.g., access.log.old) are left alone.
+func (rf *RotatingFile) prune() {
+	if rf.MaxBackups <= 0 {
+		return
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Dir(rf.Path))
+	if err != nil {
+		return
+	}
+
+	prefix := filepath.Base(rf.Path) + "."
+	var backups []string
+	for _, entry := range entries {
+		if name := entry.Name(); !entry.IsDir() && strings.HasPrefix(name, prefix) && isRotatedSuffix(name[len(prefix):]) {
+			backups = append(backups, filepath.Join(filepath.Dir(rf.Path), name))
+		}
+	}
+
+	if len(backups) <= rf.MaxBackups {
+		return
+	}
+
+	// the timestamp suffix sorts chronologically
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-rf.MaxBackups] {
+		os.Remove(backup)
+	}
+}
+
+// isRotatedSuffix reports whether suffix is a timestamp as rotate formats it.
+func isRotatedSuffix(suffix string) bool {
+	if len(suffix) != len(rotatedTimeFormat) {
+		return false
+	}
+	_, err := time.Parse(rotatedTimeFormat, suffix)
+	return err == nil
+}
+
+// Reopen reopens the file, for use after it has been moved aside by an
+// external tool such as logrotate. If that fails, writes carry on to the old
+// file, and reopening is retried on the next write.
+func (rf *RotatingFile) Reopen() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	rf.reopen = true
+	return rf.open()
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.file == nil {
+		return nil
+	}
+
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
@@ -0,0 +1,244 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/rabbitt/portunus/portunus/logging"
+)
+
+const (
+	AccessLogFormatCombined = "combined"
+	AccessLogFormatJSON     = "json"
+	AccessLogFormatTemplate = "template"
+
+	combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// DefaultAccessLogFields are the fields written by the json format when none
+// are configured.
+var DefaultAccessLogFields = []string{
+	"time", "remote_ip", "method", "host", "uri", "proto", "status", "bytes",
+	"duration_ms", "referer", "user_agent", "route", "upstream", "attempts",
+}
+
+// accessLogEntry is everything known about a request once it's been handled.
+type accessLogEntry struct {
+	start    time.Time
+	request  *http.Request
+	status   int
+	bytes    int
+	duration time.Duration
+	state    *requestState
+}
+
+// accessLogFields are the fields available to the json format, and to access
+// log templates as {{log.<field>}}.
+var accessLogFields = map[string]func(e *accessLogEntry) interface{}{
+	"time":        func(e *accessLogEntry) interface{} { return e.start.Format(time.RFC3339Nano) },
+	"remote_addr": func(e *accessLogEntry) interface{} { return e.request.RemoteAddr },
+	"remote_ip":   func(e *accessLogEntry) interface{} { return clientIP(e.request) },
+	"user": func(e *accessLogEntry) interface{} {
+		user, _, _ := e.request.BasicAuth()
+		return user
+	},
+	"method":      func(e *accessLogEntry) interface{} { return e.request.Method },
+	"host":        func(e *accessLogEntry) interface{} { return e.request.Host },
+	"uri":         func(e *accessLogEntry) interface{} { return e.request.RequestURI },
+	"path":        func(e *accessLogEntry) interface{} { return e.request.URL.Path },
+	"query":       func(e *accessLogEntry) interface{} { return e.request.URL.RawQuery },
+	"proto":       func(e *accessLogEntry) interface{} { return e.request.Proto },
+	"status":      func(e *accessLogEntry) interface{} { return e.status },
+	"bytes":       func(e *accessLogEntry) interface{} { return e.bytes },
+	"duration_ms": func(e *accessLogEntry) interface{} { return float64(e.duration) / float64(time.Millisecond) },
+	"referer":     func(e *accessLogEntry) interface{} { return e.request.Referer() },
+	"user_agent":  func(e *accessLogEntry) interface{} { return e.request.UserAgent() },
+	"route": func(e *accessLogEntry) interface{} {
+		if e.state.Route != nil {
+			return e.state.Route.Name
+		}
+		return ""
+	},
+	"upstream":    func(e *accessLogEntry) interface{} { return e.state.Upstream },
+	"attempts":    func(e *accessLogEntry) interface{} { return e.state.Attempts },
+	"trace_id":    func(e *accessLogEntry) interface{} { return e.state.TraceID },
+	"grpc_status": func(e *accessLogEntry) interface{} { return e.state.GRPCStatus },
+	"client_cert_subject": func(e *accessLogEntry) interface{} {
+		return clientCertField(e.request, "subject")
+	},
+}
+
+// AccessLog writes a line per handled request, separately from the
+// application log. A nil AccessLog (i.e., disabled) discards everything.
+type AccessLog struct {
+	format     string
+	fields     []string
+	template   *Template
+	sampleRate float64
+
+	mutex  sync.Mutex
+	writer io.Writer
+	file   *log.RotatingFile
+}
+
+// NewAccessLog validates the access log config and opens its destination,
+// returning nil if the access log is disabled.
+func NewAccessLog(config ConfigAccessLog) (*AccessLog, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	if config.SampleRate < 0 || config.SampleRate > 1 {
+		return nil, fmt.Errorf("access_log.sample_rate must be between 0 and 1")
+	}
+
+	al := &AccessLog{format: strings.ToLower(config.Format), sampleRate: config.SampleRate}
+
+	switch al.format {
+	case "", AccessLogFormatCombined:
+		al.format = AccessLogFormatCombined
+	case AccessLogFormatJSON:
+		al.fields = config.Fields
+		if len(al.fields) == 0 {
+			al.fields = DefaultAccessLogFields
+		}
+		for _, field := range al.fields {
+			if _, ok := accessLogFields[field]; !ok {
+				return nil, fmt.Errorf("access_log: unknown field %q", field)
+			}
+		}
+	case AccessLogFormatTemplate:
+		tmpl, err := CompileTemplate(config.Template)
+		if err != nil {
+			return nil, fmt.Errorf("access_log: %s", err)
+		} else if config.Template == "" {
+			return nil, fmt.Errorf("access_log.template is required for the template format")
+		}
+		al.template = tmpl
+	default:
+		return nil, fmt.Errorf("access_log: unknown format %q", config.Format)
+	}
+
+	if config.Path == "" || config.Path == "-" {
+		al.writer = os.Stdout
+		return al, nil
+	}
+
+	file, err := log.NewRotatingFile(config.Path, int64(config.Rotation.MaxSize)*1024*1024,
+		config.Rotation.Interval, config.Rotation.MaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("access_log: %s", err)
+	}
+	al.writer = file
+	al.file = file
+
+	return al, nil
+}
+
+// Log writes the entry, unless it's a successful request that was sampled
+// out. Client and server errors (4xx/5xx) are always logged.
+func (al *AccessLog) Log(entry *accessLogEntry) {
+	if al == nil {
+		return
+	}
+
+	if entry.status < 400 && al.sampleRate < 1 && rand.Float64() >= al.sampleRate {
+		return
+	}
+
+	var line bytes.Buffer
+	switch al.format {
+	case AccessLogFormatCombined:
+		al.writeCombined(&line, entry)
+	case AccessLogFormatJSON:
+		record := make(map[string]interface{}, len(al.fields))
+		for _, field := range al.fields {
+			record[field] = accessLogFields[field](entry)
+		}
+		json.NewEncoder(&line).Encode(record)
+	case AccessLogFormatTemplate:
+		route := entry.state.Route
+		if route == nil {
+			route = &Route{}
+		}
+		line.WriteString(al.template.Execute(route, entry))
+		line.WriteByte('\n')
+	}
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	if _, err := al.writer.Write(line.Bytes()); err != nil {
+		log.ErrorWithFields("Unable to write access log", log.Fields{"error": err})
+	}
+}
+
+// writeCombined formats the entry in the Apache/NCSA combined log format.
+func (al *AccessLog) writeCombined(w io.Writer, entry *accessLogEntry) {
+	dash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+		return value
+	}
+
+	size := "-"
+	if entry.bytes > 0 {
+		size = strconv.Itoa(entry.bytes)
+	}
+
+	user, _, _ := entry.request.BasicAuth()
+
+	fmt.Fprintf(w, "%s - %s [%s] \"%s %s %s\" %d %s %q %q\n",
+		clientIP(entry.request),
+		dash(user),
+		entry.start.Format(combinedTimeFormat),
+		entry.request.Method,
+		entry.request.RequestURI,
+		entry.request.Proto,
+		entry.status,
+		size,
+		dash(entry.request.Referer()),
+		dash(entry.request.UserAgent()),
+	)
+}
+
+// Reopen reopens the access log file, e.g., after logrotate has moved it.
+func (al *AccessLog) Reopen() error {
+	if al == nil || al.file == nil {
+		return nil
+	}
+	return al.file.Reopen()
+}
+
+// Close closes the access log file.
+func (al *AccessLog) Close() error {
+	if al == nil || al.file == nil {
+		return nil
+	}
+	return al.file.Close()
+}
@@ -0,0 +1,194 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/rabbitt/portunus/portunus/logging"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	ACMEChallengeHTTP01    = "http-01"
+	ACMEChallengeTLSALPN01 = "tls-alpn-01"
+
+	DefaultACMEHTTPAddress = ":80"
+)
+
+// ACMEManager obtains certificates for the configured hosts from an ACME CA
+// (e.g., Let's Encrypt), caching them on disk and renewing them before they
+// expire. Certificates are obtained on demand, during the first handshake
+// that asks for one.
+type ACMEManager struct {
+	manager *autocert.Manager
+	tlsALPN bool
+
+	// serves http-01 challenges, if enabled
+	httpServer *http.Server
+}
+
+// NewACMEManager validates the ACME config, returning nil if ACME is
+// disabled.
+func NewACMEManager(config ConfigACME) (*ACMEManager, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	if len(config.Hosts) == 0 {
+		return nil, fmt.Errorf("server.tls.acme.hosts is required")
+	} else if config.CacheDir == "" {
+		return nil, fmt.Errorf("server.tls.acme.cache_dir is required")
+	} else if !config.AcceptTOS {
+		return nil, fmt.Errorf("server.tls.acme.accept_tos must be set to accept the CA's terms of service")
+	}
+
+	client := &acme.Client{DirectoryURL: config.Directory}
+	if config.DirectoryCA != "" {
+		// e.g., for a local test CA like Pebble
+		roots, err := loadCertPool(config.DirectoryCA)
+		if err != nil {
+			return nil, fmt.Errorf("server.tls.acme.directory_ca: %s", err)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+	}
+
+	whitelist := autocert.HostWhitelist(config.Hosts...)
+	hostPolicy := func(ctx context.Context, host string) error {
+		// http-01 challenges carry the port in their Host header when the CA
+		// validates on a port other than 80 (e.g., Pebble)
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+		return whitelist(ctx, host)
+	}
+
+	am := &ACMEManager{
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       autocert.DirCache(config.CacheDir),
+			HostPolicy:  hostPolicy,
+			RenewBefore: config.RenewBefore,
+			Email:       config.Email,
+			Client:      client,
+		},
+	}
+
+	challenges := config.Challenges
+	if len(challenges) == 0 {
+		challenges = []string{ACMEChallengeHTTP01, ACMEChallengeTLSALPN01}
+	}
+
+	for _, challenge := range challenges {
+		switch strings.ToLower(challenge) {
+		case ACMEChallengeHTTP01:
+			address := config.HTTPAddress
+			if address == "" {
+				address = DefaultACMEHTTPAddress
+			}
+			am.httpServer = &http.Server{
+				Addr:         address,
+				Handler:      am.manager.HTTPHandler(nil),
+				ReadTimeout:  10 * time.Second,
+				WriteTimeout: 10 * time.Second,
+			}
+		case ACMEChallengeTLSALPN01:
+			am.tlsALPN = true
+		default:
+			return nil, fmt.Errorf("server.tls.acme: unknown challenge type %q", challenge)
+		}
+	}
+
+	return am, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// Start starts the http-01 challenge listener, if enabled. Requests to it
+// that aren't for a challenge are redirected to https.
+func (am *ACMEManager) Start() {
+	if am == nil || am.httpServer == nil {
+		return
+	}
+
+	go func() {
+		tlsLog.InfoWithFields("Listening for ACME http-01 challenges", log.Fields{"bind_address": am.httpServer.Addr})
+		if err := am.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			tlsLog.ErrorWithFields("ACME http-01 listener failed", log.Fields{"error": err})
+		}
+	}()
+}
+
+// Shutdown stops the http-01 challenge listener.
+func (am *ACMEManager) Shutdown(ctx context.Context) error {
+	if am == nil || am.httpServer == nil {
+		return nil
+	}
+	return am.httpServer.Shutdown(ctx)
+}
+
+// Handles reports whether certificates for the server name come from ACME.
+func (am *ACMEManager) Handles(serverName string) bool {
+	if am == nil {
+		return false
+	}
+	return am.manager.HostPolicy(context.Background(), strings.TrimSuffix(serverName, ".")) == nil
+}
+
+// NextProtos returns the ALPN protocols needed to answer tls-alpn-01
+// challenges, if enabled.
+func (am *ACMEManager) NextProtos() []string {
+	if am == nil || !am.tlsALPN {
+		return nil
+	}
+	return []string{acme.ALPNProto}
+}
+
+// GetCertificate returns the certificate for the requested server name,
+// obtaining (or renewing) it first if need be.
+func (am *ACMEManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := am.manager.GetCertificate(hello)
+	if err != nil {
+		tlsLog.WarnWithFields("Unable to get ACME certificate", log.Fields{"server_name": hello.ServerName, "error": err})
+	}
+	return cert, err
+}
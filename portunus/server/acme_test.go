@@ -0,0 +1,193 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The ACME test runs against a local Pebble server
+// (https://github.com/letsencrypt/pebble), and is skipped unless
+// PEBBLE_DIRECTORY is set, e.g.:
+//
+//	cd pebble && pebble -config test/config/pebble-config.json &
+//	PEBBLE_DIRECTORY=https://localhost:14000/dir \
+//	PEBBLE_CA=$PWD/test/certs/pebble.minica.pem \
+//	go test ./portunus/server -run ACME
+//
+// Pebble validates http-01 challenges by connecting to the host on its
+// httpPort (5002 by default, or PEBBLE_HTTP_ADDRESS), so the host
+// (PEBBLE_HOST, portunus.test by default) must resolve to this machine, e.g.
+// through /etc/hosts.
+func pebbleConfig(t *testing.T) ConfigACME {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY not set")
+	}
+
+	ca := os.Getenv("PEBBLE_CA")
+	if ca == "" {
+		t.Fatal("PEBBLE_CA must be set to the path of pebble.minica.pem")
+	}
+
+	host := os.Getenv("PEBBLE_HOST")
+	if host == "" {
+		host = "portunus.test"
+	}
+
+	address := os.Getenv("PEBBLE_HTTP_ADDRESS")
+	if address == "" {
+		address = ":5002"
+	}
+
+	return ConfigACME{
+		Enabled:     true,
+		AcceptTOS:   true,
+		Hosts:       []string{host},
+		Directory:   directory,
+		DirectoryCA: ca,
+		CacheDir:    t.TempDir(),
+		Challenges:  []string{ACMEChallengeHTTP01},
+		HTTPAddress: address,
+	}
+}
+
+// pebbleOrderLocation fills in the Location header that Pebble leaves out of
+// finalize responses, which the ACME client needs to poll the order.
+type pebbleOrderLocation struct {
+	transport http.RoundTripper
+}
+
+func (p pebbleOrderLocation) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := p.transport.RoundTrip(request)
+	if err == nil && strings.HasPrefix(request.URL.Path, "/finalize-order/") && response.Header.Get("Location") == "" {
+		order := url.URL{Scheme: request.URL.Scheme, Host: request.URL.Host,
+			Path: "/my-order/" + strings.TrimPrefix(request.URL.Path, "/finalize-order/")}
+		response.Header.Set("Location", order.String())
+	}
+	return response, err
+}
+
+func TestACMEHTTP01(t *testing.T) {
+	config := pebbleConfig(t)
+	host := config.Hosts[0]
+
+	am, err := NewACMEManager(config)
+	if err != nil {
+		t.Fatalf("NewACMEManager: %v", err)
+	}
+	if am.manager.Client.HTTPClient == nil {
+		t.Fatal("directory_ca wasn't used for the ACME client")
+	}
+	am.manager.Client.HTTPClient.Transport = pebbleOrderLocation{am.manager.Client.HTTPClient.Transport}
+
+	am.Start()
+	defer am.Shutdown(context.Background())
+
+	tlsConfig, err := NewTLSConfig(&Config{}, nil, am)
+	if err != nil {
+		t.Fatalf("NewTLSConfig: %v", err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	// the certificate is obtained during the first handshake for the host
+	dialer := &net.Dialer{Timeout: time.Minute}
+	conn, err := tls.DialWithDialer(dialer, "tcp", listener.Addr().String(), &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true, // issued by Pebble's (random) root
+	})
+	if err != nil {
+		t.Fatalf("handshake for %s: %v", host, err)
+	}
+	cert := conn.ConnectionState().PeerCertificates[0]
+	conn.Close()
+
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != host {
+		t.Errorf("certificate is for %v, want %s", cert.DNSNames, host)
+	}
+	if !strings.Contains(cert.Issuer.CommonName, "Pebble") {
+		t.Errorf("certificate issued by %s, want Pebble", cert.Issuer)
+	}
+
+	files, err := ioutil.ReadDir(config.CacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := false
+	for _, file := range files {
+		cached = cached || strings.HasPrefix(file.Name(), host)
+	}
+	if !cached {
+		t.Errorf("certificate wasn't cached in %s", config.CacheDir)
+	}
+
+	// hosts that aren't managed by ACME fall through to the (empty) store
+	if am.Handles("other.test") {
+		t.Errorf("other.test shouldn't be handled by ACME")
+	}
+	if _, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: "other.test", InsecureSkipVerify: true}); err == nil {
+		t.Errorf("expected the handshake for other.test to fail")
+	}
+}
+
+func TestACMEConfig(t *testing.T) {
+	valid := ConfigACME{Enabled: true, AcceptTOS: true, Hosts: []string{"example.com"}, CacheDir: t.TempDir()}
+
+	tests := []struct {
+		name   string
+		modify func(config *ConfigACME)
+		err    bool
+	}{
+		{"valid", func(*ConfigACME) {}, false},
+		{"no hosts", func(config *ConfigACME) { config.Hosts = nil }, true},
+		{"no cache dir", func(config *ConfigACME) { config.CacheDir = "" }, true},
+		{"tos not accepted", func(config *ConfigACME) { config.AcceptTOS = false }, true},
+		{"unknown challenge", func(config *ConfigACME) { config.Challenges = []string{"dns-01"} }, true},
+		{"missing directory ca", func(config *ConfigACME) { config.DirectoryCA = "/nonexistent/ca.pem" }, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := valid
+			test.modify(&config)
+			if _, err := NewACMEManager(config); (err != nil) != test.err {
+				t.Errorf("expected error: %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	if am, err := NewACMEManager(ConfigACME{}); am != nil || err != nil {
+		t.Errorf("expected no manager when disabled, got %v, %v", am, err)
+	}
+}
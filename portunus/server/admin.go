@@ -0,0 +1,83 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/rabbitt/portunus/portunus/logging"
+)
+
+// loggingHandler reports the effective level of the root and each named
+// logger, and lets them be changed at runtime, e.g.:
+//
+//	curl -X PUT 'localhost:8080/__portunus_logging__?logger=router&level=debug'
+//
+// An empty level makes a named logger follow the root level again. Changes
+// last until the next reload, which reapplies the configured levels. As it's
+// served on the proxy's listener, it's only available when enabled by
+// logging.admin_endpoint.
+func loggingHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !Settings().Logging.AdminEndpoint {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case "GET", "HEAD":
+		case "PUT", "POST":
+			name, level := r.FormValue("logger"), r.FormValue("level")
+			if name == "" {
+				name = log.RootLogger
+			}
+
+			if err := log.SetLevel(name, level); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			log.InfoWithFields("Log level changed", log.Fields{"logger.name": name, "logger.level": level})
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(log.Levels())
+	}
+}
+
+// certificatesHandler describes each of the listener's certificates,
+// including its SANs and expiry.
+func certificatesHandler(server *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !Settings().Server.TLS.Enabled {
+			http.NotFound(w, r)
+			return
+		}
+
+		infos := server.Certificates().Info()
+		if infos == nil {
+			infos = []CertificateInfo{}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(infos)
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	PolicyRoundRobin         = "round_robin"
+	PolicyWeightedRoundRobin = "weighted_round_robin"
+	PolicyLeastOutstanding   = "least_outstanding"
+	PolicyRandomTwoChoices   = "random_two_choices"
+	PolicyConsistentHash     = "consistent_hash"
+
+	// number of points each unit of weight gets on the consistent hash ring
+	hashRingReplicas = 100
+)
+
+// Target is a single upstream that a route can send requests to. Its URL may
+// contain interpolation variables, which are resolved per request.
+type Target struct {
+	URL         string
+	Weight      int
+	template    *Template
+	outstanding int64
+	unhealthy   int32
+	healthMutex sync.Mutex
+	health      TargetHealth
+	breaker     *CircuitBreaker
+}
+
+func (t *Target) String() string {
+	return fmt.Sprintf("%s (weight: %d)", t.URL, t.Weight)
+}
+
+// IsTemplated reports whether the target's URL depends on the request.
+func (t *Target) IsTemplated() bool {
+	return t.template != nil && !t.template.IsStatic()
+}
+
+// Healthy reports whether the target is passing its active health checks.
+// Targets without health checks are always healthy.
+func (t *Target) Healthy() bool {
+	return atomic.LoadInt32(&t.unhealthy) == 0
+}
+
+func (t *Target) setHealthy(healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&t.unhealthy, 0)
+	} else {
+		atomic.StoreInt32(&t.unhealthy, 1)
+	}
+}
+
+// Available reports whether the target should be considered for new requests:
+// it must be healthy, and its circuit breaker (if any) must not be open.
+func (t *Target) Available() bool {
+	return t.Healthy() && (t.breaker == nil || t.breaker.State() != BreakerOpen)
+}
+
+func (t *Target) eligible(exclude []*Target) bool {
+	for _, excluded := range exclude {
+		if t == excluded {
+			return false
+		}
+	}
+	return t.Available()
+}
+
+// Outstanding returns the number of requests currently in flight to the target.
+func (t *Target) Outstanding() int64 {
+	return atomic.LoadInt64(&t.outstanding)
+}
+
+// Acquire marks the start of a request to the target. The returned function
+// must be called once the request (including its response body) is done.
+func (t *Target) Acquire() (release func()) {
+	atomic.AddInt64(&t.outstanding, 1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { atomic.AddInt64(&t.outstanding, -1) })
+	}
+}
+
+// Balancer selects the target a request is sent to, skipping any targets that
+// aren't available or have been excluded (e.g., because they've already been
+// tried). Next returns nil when no target is eligible.
+type Balancer interface {
+	Next(req *http.Request, exclude ...*Target) *Target
+	Targets() []*Target
+}
+
+// NewBalancer builds the balancer for a route's targets using the configured
+// policy. An empty policy defaults to round robin.
+func NewBalancer(config ConfigBalancer, targets []*Target) (Balancer, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no upstream targets defined")
+	}
+
+	for _, target := range targets {
+		if target.URL == "" {
+			return nil, fmt.Errorf("upstream target missing url")
+		} else if target.Weight < 0 {
+			return nil, fmt.Errorf("upstream target %q: weight must be positive", target.URL)
+		} else if target.Weight == 0 {
+			target.Weight = 1
+		}
+	}
+
+	switch strings.ToLower(config.Policy) {
+	case "", PolicyRoundRobin:
+		return &roundRobinBalancer{targets: targets}, nil
+	case PolicyWeightedRoundRobin:
+		return &weightedRoundRobinBalancer{targets: targets, current: make([]int, len(targets))}, nil
+	case PolicyLeastOutstanding:
+		return &leastOutstandingBalancer{targets: targets}, nil
+	case PolicyRandomTwoChoices:
+		return &randomTwoChoicesBalancer{targets: targets}, nil
+	case PolicyConsistentHash:
+		keyFunc, err := newHashKeyFunc(config.HashKey)
+		if err != nil {
+			return nil, err
+		}
+		return newConsistentHashBalancer(targets, keyFunc), nil
+	default:
+		return nil, fmt.Errorf("unknown balancer policy %q", config.Policy)
+	}
+}
+
+type roundRobinBalancer struct {
+	targets []*Target
+	next    uint64
+}
+
+func (b *roundRobinBalancer) Targets() []*Target { return b.targets }
+
+func (b *roundRobinBalancer) Next(req *http.Request, exclude ...*Target) *Target {
+	n := atomic.AddUint64(&b.next, 1) - 1
+	for idx := 0; idx < len(b.targets); idx++ {
+		if target := b.targets[(n+uint64(idx))%uint64(len(b.targets))]; target.eligible(exclude) {
+			return target
+		}
+	}
+	return nil
+}
+
+// weightedRoundRobinBalancer implements nginx's smooth weighted round robin,
+// which interleaves targets rather than sending bursts to the heaviest one.
+type weightedRoundRobinBalancer struct {
+	mutex   sync.Mutex
+	targets []*Target
+	current []int
+}
+
+func (b *weightedRoundRobinBalancer) Targets() []*Target { return b.targets }
+
+func (b *weightedRoundRobinBalancer) Next(req *http.Request, exclude ...*Target) *Target {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	total, best := 0, -1
+	for idx, target := range b.targets {
+		if !target.eligible(exclude) {
+			continue
+		}
+
+		b.current[idx] += target.Weight
+		total += target.Weight
+		if best < 0 || b.current[idx] > b.current[best] {
+			best = idx
+		}
+	}
+
+	if best < 0 {
+		return nil
+	}
+
+	b.current[best] -= total
+	return b.targets[best]
+}
+
+type leastOutstandingBalancer struct {
+	targets []*Target
+	next    uint64
+}
+
+func (b *leastOutstandingBalancer) Targets() []*Target { return b.targets }
+
+func (b *leastOutstandingBalancer) Next(req *http.Request, exclude ...*Target) *Target {
+	// rotate the starting point so ties don't always go to the first target
+	start := int(atomic.AddUint64(&b.next, 1) % uint64(len(b.targets)))
+
+	var best *Target
+	for idx := 0; idx < len(b.targets); idx++ {
+		target := b.targets[(start+idx)%len(b.targets)]
+		if target.eligible(exclude) && (best == nil || target.Outstanding() < best.Outstanding()) {
+			best = target
+		}
+	}
+	return best
+}
+
+type randomTwoChoicesBalancer struct {
+	targets []*Target
+}
+
+func (b *randomTwoChoicesBalancer) Targets() []*Target { return b.targets }
+
+func (b *randomTwoChoicesBalancer) Next(req *http.Request, exclude ...*Target) *Target {
+	targets := eligibleTargets(b.targets, exclude)
+
+	switch len(targets) {
+	case 0:
+		return nil
+	case 1:
+		return targets[0]
+	}
+
+	i := rand.Intn(len(targets))
+	j := rand.Intn(len(targets) - 1)
+	if j >= i {
+		j++
+	}
+
+	if targets[j].Outstanding() < targets[i].Outstanding() {
+		return targets[j]
+	}
+	return targets[i]
+}
+
+func eligibleTargets(targets []*Target, exclude []*Target) []*Target {
+	eligible := make([]*Target, 0, len(targets))
+	for _, target := range targets {
+		if target.eligible(exclude) {
+			eligible = append(eligible, target)
+		}
+	}
+	return eligible
+}
+
+type hashRingEntry struct {
+	hash   uint32
+	target *Target
+}
+
+// consistentHashBalancer places each target on a hash ring (weighted by the
+// number of points it gets) so that a given key consistently maps to the same
+// target, and adding or removing a target only moves a fraction of keys.
+// Requests without a key fall back to round robin.
+type consistentHashBalancer struct {
+	roundRobinBalancer
+	ring    []hashRingEntry
+	keyFunc func(req *http.Request) string
+}
+
+func newConsistentHashBalancer(targets []*Target, keyFunc func(req *http.Request) string) *consistentHashBalancer {
+	b := &consistentHashBalancer{
+		roundRobinBalancer: roundRobinBalancer{targets: targets},
+		keyFunc:            keyFunc,
+	}
+
+	for idx, target := range targets {
+		for replica := 0; replica < target.Weight*hashRingReplicas; replica++ {
+			key := strconv.Itoa(idx) + "-" + target.URL + "-" + strconv.Itoa(replica)
+			b.ring = append(b.ring, hashRingEntry{crc32.ChecksumIEEE([]byte(key)), target})
+		}
+	}
+
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+
+	return b
+}
+
+func (b *consistentHashBalancer) Next(req *http.Request, exclude ...*Target) *Target {
+	key := b.keyFunc(req)
+	if key == "" {
+		return b.roundRobinBalancer.Next(req, exclude...)
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= hash })
+
+	// walk the ring from the key's position to the first available target
+	for idx := 0; idx < len(b.ring); idx++ {
+		if target := b.ring[(start+idx)%len(b.ring)].target; target.eligible(exclude) {
+			return target
+		}
+	}
+
+	return nil
+}
+
+// newHashKeyFunc parses a hash key of the form "header:<name>",
+// "cookie:<name>" or "client_ip" into a function extracting that key from a
+// request.
+func newHashKeyFunc(hashKey string) (func(req *http.Request) string, error) {
+	parts := strings.SplitN(hashKey, ":", 2)
+
+	switch kind := strings.ToLower(strings.TrimSpace(parts[0])); {
+	case kind == "client_ip":
+		return clientIP, nil
+	case kind == "header" && len(parts) == 2 && parts[1] != "":
+		name := strings.TrimSpace(parts[1])
+		return func(req *http.Request) string { return req.Header.Get(name) }, nil
+	case kind == "cookie" && len(parts) == 2 && parts[1] != "":
+		name := strings.TrimSpace(parts[1])
+		return func(req *http.Request) string {
+			if cookie, err := req.Cookie(name); err == nil {
+				return cookie.Value
+			}
+			return ""
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid hash key %q (expected header:<name>, cookie:<name> or client_ip)", hashKey)
+	}
+}
+
+// clientIP returns the IP address of the connecting client.
+func clientIP(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// releaseOnClose wraps a response body so that the target's outstanding
+// request count is only released once the body has been fully consumed.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	defer r.release()
+	return r.ReadCloser.Close()
+}
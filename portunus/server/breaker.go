@@ -0,0 +1,379 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/codahale/metrics"
+	log "github.com/rabbitt/portunus/portunus/logging"
+)
+
+const (
+	DefaultBreakerConsecutiveFailures = 5
+	DefaultBreakerErrorRate           = 0.5
+	DefaultBreakerMinRequests         = 20
+	DefaultBreakerWindow              = 10 * time.Second
+	DefaultBreakerOpenTimeout         = 30 * time.Second
+	DefaultBreakerHalfOpenRequests    = 1
+
+	// upstream hosts that have a breaker of their own, beyond which the least
+	// recently used closed ones are dropped
+	DefaultMaxCircuitBreakers = 10000
+
+	// number of buckets the sliding window is divided into
+	breakerWindowBuckets = 10
+)
+
+var (
+	ErrorCircuitOpen = errors.New("circuit breaker is open")
+
+	breakerOpened   = metrics.Counter("CircuitBreaker.Opened")
+	breakerHalfOpen = metrics.Counter("CircuitBreaker.HalfOpened")
+	breakerClosed   = metrics.Counter("CircuitBreaker.Closed")
+	breakerRejected = metrics.Counter("CircuitBreaker.Rejected")
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+type breakerBucket struct {
+	start    time.Time
+	total    int
+	failures int
+}
+
+// CircuitBreaker tracks the outcome of requests to a single upstream host.
+// While closed, it trips open after too many consecutive failures, or when
+// the error rate over the sliding window gets too high. While open, requests
+// are rejected without dialing the upstream. Once the open timeout passes, it
+// goes half-open and lets a limited number of probe requests through: if they
+// all succeed the circuit closes again, and if any fail it reopens.
+type CircuitBreaker struct {
+	mutex    sync.Mutex
+	host     string
+	config   ConfigCircuitBreaker
+	state    BreakerState
+	openedAt time.Time
+	buckets  [breakerWindowBuckets]breakerBucket
+
+	consecutiveFailures int
+	halfOpenInFlight    int
+	halfOpenSuccesses   int
+}
+
+func newCircuitBreaker(host string, config ConfigCircuitBreaker) *CircuitBreaker {
+	return &CircuitBreaker{host: host, config: config}
+}
+
+// State returns the breaker's current state.
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.advance(time.Now())
+	return cb.state
+}
+
+// Allow reports whether a request may be sent to the upstream. Every allowed
+// request must be followed by a call to Record with its outcome.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.advance(time.Now())
+
+	switch cb.state {
+	case BreakerOpen:
+		breakerRejected.Add()
+		return false
+	case BreakerHalfOpen:
+		if cb.halfOpenInFlight >= cb.config.HalfOpenRequests {
+			breakerRejected.Add()
+			return false
+		}
+		cb.halfOpenInFlight++
+	}
+
+	return true
+}
+
+// Cancel reports that a request previously allowed by Allow was abandoned
+// (e.g., the client went away) and says nothing about the upstream's health.
+func (cb *CircuitBreaker) Cancel() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if cb.state == BreakerHalfOpen && cb.halfOpenInFlight > 0 {
+		cb.halfOpenInFlight--
+	}
+}
+
+// Record reports the outcome of a request previously allowed by Allow.
+func (cb *CircuitBreaker) Record(success bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	now := time.Now()
+	cb.advance(now)
+
+	switch cb.state {
+	case BreakerHalfOpen:
+		if cb.halfOpenInFlight > 0 {
+			cb.halfOpenInFlight--
+		}
+
+		if !success {
+			cb.transition(BreakerOpen, now, "half-open probe failed")
+			return
+		}
+
+		cb.halfOpenSuccesses++
+		if cb.halfOpenSuccesses >= cb.config.HalfOpenRequests {
+			cb.transition(BreakerClosed, now, "half-open probes succeeded")
+		}
+
+	case BreakerClosed:
+		bucket := cb.bucket(now)
+		bucket.total++
+
+		if success {
+			cb.consecutiveFailures = 0
+			return
+		}
+
+		bucket.failures++
+		cb.consecutiveFailures++
+
+		if cb.config.ConsecutiveFailures > 0 && cb.consecutiveFailures >= cb.config.ConsecutiveFailures {
+			cb.transition(BreakerOpen, now, fmt.Sprintf("%d consecutive failures", cb.consecutiveFailures))
+			return
+		}
+
+		if total, failures := cb.totals(now); total >= cb.config.MinRequests && cb.config.ErrorRate > 0 {
+			if rate := float64(failures) / float64(total); rate >= cb.config.ErrorRate {
+				cb.transition(BreakerOpen, now, fmt.Sprintf("error rate %.2f over %d requests", rate, total))
+			}
+		}
+	}
+}
+
+// advance moves an open breaker to half-open once its timeout has passed.
+func (cb *CircuitBreaker) advance(now time.Time) {
+	if cb.state == BreakerOpen && now.Sub(cb.openedAt) >= cb.config.OpenTimeout {
+		cb.transition(BreakerHalfOpen, now, "open timeout elapsed")
+	}
+}
+
+func (cb *CircuitBreaker) transition(state BreakerState, now time.Time, reason string) {
+	log.WarnWithFields("Circuit breaker state changed", log.Fields{
+		"upstream.host": cb.host,
+		"state.old":     cb.state.String(),
+		"state.new":     state.String(),
+		"reason":        reason,
+	})
+
+	cb.state = state
+	cb.consecutiveFailures = 0
+	cb.halfOpenInFlight = 0
+	cb.halfOpenSuccesses = 0
+
+	switch state {
+	case BreakerOpen:
+		cb.openedAt = now
+		breakerOpened.Add()
+	case BreakerHalfOpen:
+		breakerHalfOpen.Add()
+	case BreakerClosed:
+		cb.buckets = [breakerWindowBuckets]breakerBucket{}
+		breakerClosed.Add()
+	}
+}
+
+func (cb *CircuitBreaker) bucketWidth() time.Duration {
+	return cb.config.Window / breakerWindowBuckets
+}
+
+// bucket returns the window bucket for the given time, resetting it if it's
+// left over from a previous pass around the window.
+func (cb *CircuitBreaker) bucket(now time.Time) *breakerBucket {
+	width := cb.bucketWidth()
+	start := now.Truncate(width)
+	bucket := &cb.buckets[(start.UnixNano()/int64(width))%breakerWindowBuckets]
+
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+
+	return bucket
+}
+
+// totals sums the requests and failures of all buckets within the window.
+func (cb *CircuitBreaker) totals(now time.Time) (total, failures int) {
+	for _, bucket := range cb.buckets {
+		if now.Sub(bucket.start) < cb.config.Window {
+			total += bucket.total
+			failures += bucket.failures
+		}
+	}
+	return
+}
+
+// CircuitBreakers holds a breaker per upstream host, created on first use.
+// Since templated upstreams can resolve to any number of hosts, only up to
+// maxBreakers are kept, besides those of static targets: once full, the least
+// recently used closed breaker is dropped, and would start over from scratch
+// if its host came back.
+type CircuitBreakers struct {
+	mutex       sync.Mutex
+	config      ConfigCircuitBreaker
+	maxBreakers int
+	pinned      map[string]*CircuitBreaker
+	breakers    map[string]*list.Element
+	lru         *list.List // of *CircuitBreaker, most recently used first
+}
+
+// NewCircuitBreakers validates the circuit breaker config and returns an
+// empty set of breakers, or nil if circuit breaking is disabled.
+func NewCircuitBreakers(config ConfigCircuitBreaker) (*CircuitBreakers, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	if config.ConsecutiveFailures < 0 {
+		return nil, fmt.Errorf("circuit_breaker.consecutive_failures must be positive")
+	} else if config.ErrorRate < 0 || config.ErrorRate > 1 {
+		return nil, fmt.Errorf("circuit_breaker.error_rate must be between 0 and 1")
+	} else if config.ConsecutiveFailures == 0 && config.ErrorRate == 0 {
+		config.ConsecutiveFailures = DefaultBreakerConsecutiveFailures
+		config.ErrorRate = DefaultBreakerErrorRate
+	}
+
+	if config.MinRequests <= 0 {
+		config.MinRequests = DefaultBreakerMinRequests
+	}
+	if config.Window < breakerWindowBuckets {
+		config.Window = DefaultBreakerWindow
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = DefaultBreakerOpenTimeout
+	}
+	if config.HalfOpenRequests <= 0 {
+		config.HalfOpenRequests = DefaultBreakerHalfOpenRequests
+	}
+
+	return &CircuitBreakers{
+		config:      config,
+		maxBreakers: DefaultMaxCircuitBreakers,
+		pinned:      make(map[string]*CircuitBreaker),
+		breakers:    make(map[string]*list.Element),
+		lru:         list.New(),
+	}, nil
+}
+
+// Get returns the breaker for the given upstream host. A nil set of breakers
+// (circuit breaking disabled) always returns nil.
+func (cbs *CircuitBreakers) Get(host string) *CircuitBreaker {
+	if cbs == nil {
+		return nil
+	}
+
+	cbs.mutex.Lock()
+	defer cbs.mutex.Unlock()
+
+	if breaker, ok := cbs.pinned[host]; ok {
+		return breaker
+	}
+
+	if elem, ok := cbs.breakers[host]; ok {
+		cbs.lru.MoveToFront(elem)
+		return elem.Value.(*CircuitBreaker)
+	}
+
+	breaker := newCircuitBreaker(host, cbs.config)
+	cbs.breakers[host] = cbs.lru.PushFront(breaker)
+	if cbs.lru.Len() > cbs.maxBreakers {
+		cbs.evict()
+	}
+
+	return breaker
+}
+
+// Pin returns the breaker for the given upstream host, which is kept for as
+// long as the set of breakers is. Static targets hold on to their breaker, so
+// it mustn't be replaced by a new one for the same host.
+func (cbs *CircuitBreakers) Pin(host string) *CircuitBreaker {
+	if cbs == nil {
+		return nil
+	}
+
+	breaker := cbs.Get(host)
+
+	cbs.mutex.Lock()
+	defer cbs.mutex.Unlock()
+
+	if elem, ok := cbs.breakers[host]; ok {
+		cbs.lru.Remove(elem)
+		delete(cbs.breakers, host)
+	}
+	cbs.pinned[host] = breaker
+
+	return breaker
+}
+
+// Len returns the number of breakers held.
+func (cbs *CircuitBreakers) Len() int {
+	cbs.mutex.Lock()
+	defer cbs.mutex.Unlock()
+	return len(cbs.pinned) + cbs.lru.Len()
+}
+
+// evict drops the least recently used closed breaker, or, if they're all open
+// or half-open, the least recently used one, so that the set stays bounded.
+func (cbs *CircuitBreakers) evict() {
+	oldest := cbs.lru.Back()
+	for elem := oldest; elem != nil; elem = elem.Prev() {
+		if elem.Value.(*CircuitBreaker).State() == BreakerClosed {
+			oldest = elem
+			break
+		}
+	}
+
+	cbs.lru.Remove(oldest)
+	delete(cbs.breakers, oldest.Value.(*CircuitBreaker).host)
+}
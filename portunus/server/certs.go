@@ -0,0 +1,357 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/rabbitt/portunus/portunus/logging"
+)
+
+// certificate directories hold <name>.crt (or <name>.pem) and <name>.key pairs
+var certificateExtensions = []string{".crt", ".pem"}
+
+// CertStore holds the listener's certificates, and picks one for each
+// handshake by SNI. Its files can be watched for changes, and are reloaded
+// without disturbing established connections.
+type CertStore struct {
+	config ConfigTLS
+	policy *TLSPolicy
+	index  atomic.Value // *certIndex
+
+	// serializes reloads, and remembers files that failed to load, so the
+	// failure is only reported once
+	mutex  sync.Mutex
+	failed string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type storedCert struct {
+	certificate *tls.Certificate
+	certFile    string
+}
+
+type certIndex struct {
+	certs []*storedCert
+	// by lowercased DNS name, including wildcards (e.g., "*.example.com")
+	names       map[string]*storedCert
+	fingerprint string
+}
+
+// CertificateInfo describes a loaded certificate.
+type CertificateInfo struct {
+	Name            string    `json:"name"`
+	File            string    `json:"file"`
+	Subject         string    `json:"subject"`
+	Issuer          string    `json:"issuer"`
+	SANs            []string  `json:"sans"`
+	NotBefore       time.Time `json:"not_before"`
+	NotAfter        time.Time `json:"not_after"`
+	DaysUntilExpiry float64   `json:"days_until_expiry"`
+	Default         bool      `json:"default"`
+}
+
+// NewCertStore loads the certificates described by the TLS config: the
+// cert/key pair, then each of the certificates, then the pairs found in the
+// certificate directory. The first one loaded is the default, served when no
+// other matches the client's SNI (or it didn't send one). Certificates whose
+// key type the TLS policy can't serve are rejected.
+func NewCertStore(config ConfigTLS) (*CertStore, error) {
+	policy, err := NewTLSPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &CertStore{config: config, policy: policy, stop: make(chan struct{})}
+
+	index, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	store.index.Store(index)
+
+	return store, nil
+}
+
+// pairs returns the cert and key files to load, in order of precedence.
+func (store *CertStore) pairs() ([][2]string, error) {
+	var pairs [][2]string
+
+	if store.config.Cert != "" {
+		pairs = append(pairs, [2]string{store.config.Cert, store.config.Key})
+	}
+
+	for _, cert := range store.config.Certificates {
+		pairs = append(pairs, [2]string{cert.Cert, cert.Key})
+	}
+
+	if store.config.CertificateDir != "" {
+		files, err := ioutil.ReadDir(store.config.CertificateDir)
+		if err != nil {
+			return nil, fmt.Errorf("server.tls.certificate_dir: %s", err)
+		}
+
+		// ReadDir sorts by name, so the order is stable
+		for _, file := range files {
+			ext := filepath.Ext(file.Name())
+			if file.IsDir() || !isCertificateExtension(ext) {
+				continue
+			}
+
+			certFile := filepath.Join(store.config.CertificateDir, file.Name())
+			keyFile := strings.TrimSuffix(certFile, ext) + ".key"
+			if _, err := os.Stat(keyFile); err != nil {
+				tlsLog.DebugWithFields("Skipping certificate without a key", log.Fields{"cert": certFile})
+				continue
+			}
+
+			pairs = append(pairs, [2]string{certFile, keyFile})
+		}
+	}
+
+	return pairs, nil
+}
+
+func isCertificateExtension(ext string) bool {
+	for _, certExt := range certificateExtensions {
+		if ext == certExt {
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprint summarizes the size and modification time of each file, so
+// that changes can be noticed without reading them.
+func fingerprint(pairs [][2]string) string {
+	var parts []string
+	for _, pair := range pairs {
+		for _, file := range pair {
+			if info, err := os.Stat(file); err == nil {
+				parts = append(parts, fmt.Sprintf("%s:%d:%d", file, info.Size(), info.ModTime().UnixNano()))
+			} else {
+				parts = append(parts, file+":missing")
+			}
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func (store *CertStore) load() (*certIndex, error) {
+	pairs, err := store.pairs()
+	if err != nil {
+		return nil, err
+	}
+
+	index := &certIndex{names: make(map[string]*storedCert), fingerprint: fingerprint(pairs)}
+
+	for _, pair := range pairs {
+		certificate, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load TLS certificate %s: %s", pair[0], err)
+		}
+
+		// keep the parsed leaf around, rather than parsing it every handshake
+		if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("unable to parse TLS certificate %s: %s", pair[0], err)
+		}
+
+		if err := store.policy.CheckCertificate(certificate.Leaf); err != nil {
+			return nil, fmt.Errorf("TLS certificate %s: %s", pair[0], err)
+		}
+
+		stored := &storedCert{certificate: &certificate, certFile: pair[0]}
+		index.certs = append(index.certs, stored)
+
+		names := certificate.Leaf.DNSNames
+		if len(names) == 0 && certificate.Leaf.Subject.CommonName != "" {
+			names = []string{certificate.Leaf.Subject.CommonName}
+		}
+
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if existing, ok := index.names[name]; ok {
+				tlsLog.WarnWithFields("Certificate name is already served by another certificate", log.Fields{
+					"name": name, "cert": pair[0], "served_by": existing.certFile,
+				})
+				continue
+			}
+			index.names[name] = stored
+		}
+
+		tlsLog.DebugWithFields("Loaded TLS certificate", log.Fields{
+			"cert": pair[0], "names": names, "expires": certificate.Leaf.NotAfter,
+		})
+	}
+
+	return index, nil
+}
+
+func (store *CertStore) currentIndex() *certIndex {
+	return store.index.Load().(*certIndex)
+}
+
+// Len returns the number of loaded certificates.
+func (store *CertStore) Len() int {
+	if store == nil {
+		return 0
+	}
+	return len(store.currentIndex().certs)
+}
+
+// GetCertificate returns the certificate for the client's server name: an
+// exact match, then a wildcard match, then the default certificate.
+func (store *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if store == nil {
+		return nil, nil
+	}
+
+	index := store.currentIndex()
+	if len(index.certs) == 0 {
+		return nil, nil
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if stored, ok := index.names[name]; ok {
+		return stored.certificate, nil
+	}
+
+	if dot := strings.IndexByte(name, '.'); dot > 0 {
+		if stored, ok := index.names["*"+name[dot:]]; ok {
+			return stored.certificate, nil
+		}
+	}
+
+	return index.certs[0].certificate, nil
+}
+
+// Reload reloads the certificates if any of their files have changed. If any
+// fail to load, the current certificates are kept.
+func (store *CertStore) Reload() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	pairs, err := store.pairs()
+	if err != nil {
+		return err
+	}
+
+	current := fingerprint(pairs)
+	if current == store.currentIndex().fingerprint || current == store.failed {
+		return nil
+	}
+
+	index, err := store.load()
+	if err != nil {
+		store.failed = current
+		return err
+	}
+	store.index.Store(index)
+
+	tlsLog.InfoWithFields("Reloaded TLS certificates", log.Fields{"certificates": len(index.certs)})
+
+	return nil
+}
+
+// Watch polls the certificate files for changes at the given interval, until
+// the store is closed.
+func (store *CertStore) Watch(interval time.Duration) {
+	if store == nil || interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-store.stop:
+				return
+			case <-ticker.C:
+				if err := store.Reload(); err != nil {
+					tlsLog.ErrorWithFields("Unable to reload TLS certificates; keeping current ones", log.Fields{"error": err})
+				}
+			}
+		}
+	}()
+}
+
+// Close stops watching the certificate files.
+func (store *CertStore) Close() {
+	if store == nil {
+		return
+	}
+	store.stopOnce.Do(func() { close(store.stop) })
+}
+
+// Info describes each loaded certificate, in order of precedence.
+func (store *CertStore) Info() []CertificateInfo {
+	if store == nil {
+		return nil
+	}
+
+	index := store.currentIndex()
+	infos := make([]CertificateInfo, 0, len(index.certs))
+	for idx, stored := range index.certs {
+		leaf := stored.certificate.Leaf
+
+		sans := append([]string{}, leaf.DNSNames...)
+		for _, ip := range leaf.IPAddresses {
+			sans = append(sans, ip.String())
+		}
+		sans = append(sans, leaf.EmailAddresses...)
+
+		name := leaf.Subject.CommonName
+		if name == "" && len(leaf.DNSNames) > 0 {
+			name = leaf.DNSNames[0]
+		}
+
+		infos = append(infos, CertificateInfo{
+			Name:            name,
+			File:            stored.certFile,
+			Subject:         leaf.Subject.String(),
+			Issuer:          leaf.Issuer.String(),
+			SANs:            sans,
+			NotBefore:       leaf.NotBefore,
+			NotAfter:        leaf.NotAfter,
+			DaysUntilExpiry: float64(time.Until(leaf.NotAfter)) / float64(24*time.Hour),
+			Default:         idx == 0,
+		})
+	}
+
+	return infos
+}
+
+// collectCertificateExpiry refreshes the certificate expiry gauge from the
+// server's current certificates.
+func (server *Server) collectCertificateExpiry() {
+	promCertificateExpiry.Reset()
+	for _, info := range server.Certificates().Info() {
+		promCertificateExpiry.Set(info.DaysUntilExpiry, info.Name, info.File)
+	}
+}
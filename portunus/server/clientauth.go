@@ -0,0 +1,170 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+)
+
+// headers carrying the client certificate's identity upstream
+const (
+	HeaderClientCertSubject     = "X-Client-Cert-Subject"
+	HeaderClientCertIssuer      = "X-Client-Cert-Issuer"
+	HeaderClientCertSANs        = "X-Client-Cert-Sans"
+	HeaderClientCertFingerprint = "X-Client-Cert-Fingerprint"
+)
+
+var clientCertHeaders = []string{
+	HeaderClientCertSubject,
+	HeaderClientCertIssuer,
+	HeaderClientCertSANs,
+	HeaderClientCertFingerprint,
+}
+
+// clientAuthEnabled reports whether client certificates are asked for.
+func clientAuthEnabled(config ConfigClientAuth) bool {
+	return config.CA != "" && strings.ToLower(config.Mode) != ClientAuthNone
+}
+
+// applyClientAuth sets up the listener's TLS config to ask for client
+// certificates, verifying them against the CA bundle. In "request" mode a
+// client without a certificate is let through (routes can still insist on
+// one), while in "require" mode the handshake fails.
+func applyClientAuth(config ConfigClientAuth, tlsConfig *tls.Config) error {
+	mode := strings.ToLower(config.Mode)
+
+	switch mode {
+	case "", ClientAuthRequest, ClientAuthRequire, ClientAuthNone:
+	default:
+		return fmt.Errorf("server.tls.client_auth.mode: unknown mode %q", config.Mode)
+	}
+
+	if mode == ClientAuthRequire && config.CA == "" {
+		return fmt.Errorf("server.tls.client_auth.ca is required in %q mode", ClientAuthRequire)
+	} else if !clientAuthEnabled(config) {
+		return nil
+	}
+
+	pool, err := loadCertPool(config.CA)
+	if err != nil {
+		return fmt.Errorf("server.tls.client_auth.ca: %s", err)
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if mode == ClientAuthRequire {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return nil
+}
+
+// clientCertificate returns the client's verified certificate, if it sent one.
+func clientCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
+
+// clientCertSANs returns the certificate's DNS, email, IP and URI SANs.
+func clientCertSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+// clientCertFingerprint returns the hex encoded SHA-256 of the certificate.
+func clientCertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// clientCertField returns a field of the request's client certificate (see
+// the req.client_cert.* template variables), or "" if there isn't one.
+func clientCertField(req *http.Request, field string) string {
+	cert := clientCertificate(req)
+	if cert == nil {
+		return ""
+	}
+
+	switch field {
+	case "subject":
+		return cert.Subject.String()
+	case "issuer":
+		return cert.Issuer.String()
+	case "common_name":
+		return cert.Subject.CommonName
+	case "serial":
+		return cert.SerialNumber.String()
+	case "sans":
+		return strings.Join(clientCertSANs(cert), ",")
+	case "fingerprint":
+		return clientCertFingerprint(cert)
+	}
+	return ""
+}
+
+var clientCertFields = []string{"subject", "issuer", "common_name", "serial", "sans", "fingerprint"}
+
+func isClientCertField(field string) bool {
+	for _, known := range clientCertFields {
+		if field == known {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardClientCert replaces any client certificate headers sent by the
+// client with the identity of its verified certificate, so that upstreams
+// can trust them.
+func forwardClientCert(outreq *http.Request) {
+	for _, header := range clientCertHeaders {
+		outreq.Header.Del(header)
+	}
+
+	if clientCertificate(outreq) == nil {
+		return
+	}
+
+	outreq.Header.Set(HeaderClientCertSubject, clientCertField(outreq, "subject"))
+	outreq.Header.Set(HeaderClientCertIssuer, clientCertField(outreq, "issuer"))
+	outreq.Header.Set(HeaderClientCertSANs, clientCertField(outreq, "sans"))
+	outreq.Header.Set(HeaderClientCertFingerprint, clientCertField(outreq, "fingerprint"))
+}
+
+func clientCertRequiredResponse(req *http.Request) *http.Response {
+	return errorResponse(req, Settings().Response.ClientCertRequired)
+}
@@ -0,0 +1,321 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/rabbitt/portunus/portunus/logging"
+)
+
+const (
+	ConcurrencyPerRoute    = "route"
+	ConcurrencyPerUpstream = "upstream"
+
+	DefaultConcurrencyMaxWait = time.Second
+
+	// upstream hosts that have a limiter of their own, beyond which the least
+	// recently used idle ones are dropped
+	DefaultMaxConcurrencyLimiters = 10000
+
+	// the adaptive limit shrinks by this factor when latency is too high
+	adaptiveDecrease = 0.9
+)
+
+// reasons a request was turned away, for metrics
+const (
+	concurrencyQueueFull = "queue_full"
+	concurrencyMaxWait   = "max_wait"
+)
+
+var ErrorConcurrencyLimited = errors.New("concurrency limit reached")
+
+// ConcurrencyLimiters hold the concurrency limit of a route, or of each of
+// its upstream hosts.
+type ConcurrencyLimiters struct {
+	mutex       sync.Mutex
+	route       string
+	config      ConfigConcurrency
+	maxLimiters int
+	limiters    map[string]*list.Element
+	lru         *list.List // of *ConcurrencyLimiter, most recently used first
+}
+
+// NewConcurrencyLimiters validates the route's concurrency config, returning
+// nil if there's no limit.
+func NewConcurrencyLimiters(route string, config ConfigConcurrency) (*ConcurrencyLimiters, error) {
+	if config.MaxConcurrent == 0 {
+		return nil, nil
+	}
+
+	switch config.Per = strings.ToLower(config.Per); config.Per {
+	case "":
+		config.Per = ConcurrencyPerRoute
+	case ConcurrencyPerRoute, ConcurrencyPerUpstream:
+	default:
+		return nil, fmt.Errorf("concurrency.per must be %s or %s, not %q", ConcurrencyPerRoute, ConcurrencyPerUpstream, config.Per)
+	}
+
+	if config.MaxConcurrent < 0 || config.MaxQueue < 0 || config.MaxWait < 0 {
+		return nil, fmt.Errorf("concurrency.max_concurrent, max_queue and max_wait can't be negative")
+	}
+	if config.MaxWait == 0 {
+		config.MaxWait = DefaultConcurrencyMaxWait
+	}
+
+	if adaptive := &config.Adaptive; adaptive.Enabled {
+		if adaptive.TargetLatency <= 0 {
+			return nil, fmt.Errorf("concurrency.adaptive.target_latency is required")
+		}
+		if adaptive.MinConcurrent <= 0 {
+			adaptive.MinConcurrent = 1
+		} else if adaptive.MinConcurrent > config.MaxConcurrent {
+			return nil, fmt.Errorf("concurrency.adaptive.min_concurrent can't be more than max_concurrent")
+		}
+	}
+
+	return &ConcurrencyLimiters{
+		route:       route,
+		config:      config,
+		maxLimiters: DefaultMaxConcurrencyLimiters,
+		limiters:    make(map[string]*list.Element),
+		lru:         list.New(),
+	}, nil
+}
+
+// PerUpstream reports whether each upstream host has a limit of its own.
+func (cls *ConcurrencyLimiters) PerUpstream() bool {
+	return cls != nil && cls.config.Per == ConcurrencyPerUpstream
+}
+
+// Get returns the limiter for the given upstream host ("" for the route's).
+// A nil set of limiters (no limit) always returns nil.
+func (cls *ConcurrencyLimiters) Get(host string) *ConcurrencyLimiter {
+	if cls == nil {
+		return nil
+	}
+
+	cls.mutex.Lock()
+	defer cls.mutex.Unlock()
+
+	if elem, ok := cls.limiters[host]; ok {
+		cls.lru.MoveToFront(elem)
+		return elem.Value.(*ConcurrencyLimiter)
+	}
+
+	limiter := newConcurrencyLimiter(cls.route, host, cls.config)
+	cls.limiters[host] = cls.lru.PushFront(limiter)
+	if cls.lru.Len() > cls.maxLimiters {
+		cls.evict()
+	}
+
+	return limiter
+}
+
+// Len returns the number of limiters held.
+func (cls *ConcurrencyLimiters) Len() int {
+	cls.mutex.Lock()
+	defer cls.mutex.Unlock()
+	return cls.lru.Len()
+}
+
+// evict drops the least recently used limiter that has nothing in flight or
+// queued, so that the set stays bounded. Busy limiters are kept, as dropping
+// one would let its host have twice the limit; there can only be so many of
+// them at once anyway.
+func (cls *ConcurrencyLimiters) evict() {
+	for elem := cls.lru.Back(); elem != nil; elem = elem.Prev() {
+		limiter := elem.Value.(*ConcurrencyLimiter)
+		if limiter.idle() {
+			cls.lru.Remove(elem)
+			delete(cls.limiters, limiter.host)
+			return
+		}
+	}
+}
+
+// ConcurrencyLimiter caps the number of requests in flight. Requests over
+// the limit wait in a bounded FIFO queue for up to the max wait, and are
+// rejected straight away once it's full. In adaptive mode, the limit drops
+// (multiplicatively, down to min_concurrent) whenever a request takes longer
+// than the target latency, and creeps back up (by about one per limit's
+// worth of requests, up to max_concurrent) while they don't.
+type ConcurrencyLimiter struct {
+	mutex    sync.Mutex
+	route    string
+	host     string
+	upstream string
+	config   ConfigConcurrency
+
+	limit        float64
+	inFlight     int
+	waiting      *list.List // of chan struct{}, closed once admitted
+	lastDecrease time.Time
+}
+
+func newConcurrencyLimiter(route, host string, config ConfigConcurrency) *ConcurrencyLimiter {
+	limiter := &ConcurrencyLimiter{
+		route:    route,
+		host:     host,
+		upstream: upstreamLabel(host),
+		config:   config,
+		limit:    float64(config.MaxConcurrent),
+		waiting:  list.New(),
+	}
+	promConcurrencyLimit.Set(limiter.limit, route, limiter.upstream)
+	return limiter
+}
+
+// Acquire waits for a slot, returning ErrorConcurrencyLimited if the queue
+// is full or the wait too long. The returned func must be called once the
+// request is done, with the upstream's latency (0 if it was never sent).
+func (cl *ConcurrencyLimiter) Acquire(ctx context.Context) (release func(latency time.Duration), err error) {
+	if cl == nil {
+		return func(time.Duration) {}, nil
+	}
+
+	cl.mutex.Lock()
+	if cl.waiting.Len() == 0 && cl.inFlight < cl.current() {
+		cl.inFlight++
+		cl.mutex.Unlock()
+		return cl.release, nil
+	}
+
+	if cl.waiting.Len() >= cl.config.MaxQueue {
+		cl.mutex.Unlock()
+		promConcurrencyRejected.Add(1, cl.route, cl.upstream, concurrencyQueueFull)
+		return nil, ErrorConcurrencyLimited
+	}
+
+	admitted := make(chan struct{})
+	elem := cl.waiting.PushBack(admitted)
+	promConcurrencyQueued.Set(float64(cl.waiting.Len()), cl.route, cl.upstream)
+	cl.mutex.Unlock()
+
+	timer := time.NewTimer(cl.config.MaxWait)
+	defer timer.Stop()
+
+	select {
+	case <-admitted:
+		return cl.release, nil
+	case <-timer.C:
+		err = ErrorConcurrencyLimited
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	// admitted while giving up: hand the slot on
+	select {
+	case <-admitted:
+		cl.inFlight--
+		cl.admit()
+	default:
+		cl.waiting.Remove(elem)
+		promConcurrencyQueued.Set(float64(cl.waiting.Len()), cl.route, cl.upstream)
+	}
+
+	if err == ErrorConcurrencyLimited {
+		promConcurrencyRejected.Add(1, cl.route, cl.upstream, concurrencyMaxWait)
+	}
+	return nil, err
+}
+
+func (cl *ConcurrencyLimiter) release(latency time.Duration) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	cl.inFlight--
+	if cl.config.Adaptive.Enabled && latency > 0 {
+		cl.adapt(latency)
+	}
+	cl.admit()
+}
+
+// current returns the limit as a number of requests.
+func (cl *ConcurrencyLimiter) current() int {
+	return int(cl.limit)
+}
+
+// adapt moves the limit according to the latency of a finished request. It
+// only drops once per target latency, so that a batch of slow requests that
+// were all in flight together counts once.
+func (cl *ConcurrencyLimiter) adapt(latency time.Duration) {
+	adaptive := cl.config.Adaptive
+	now := time.Now()
+
+	if latency > adaptive.TargetLatency {
+		if now.Sub(cl.lastDecrease) < adaptive.TargetLatency {
+			return
+		}
+		cl.lastDecrease = now
+		cl.limit = math.Max(float64(adaptive.MinConcurrent), math.Floor(cl.limit*adaptiveDecrease))
+	} else {
+		cl.limit = math.Min(float64(cl.config.MaxConcurrent), cl.limit+1/cl.limit)
+	}
+
+	promConcurrencyLimit.Set(float64(cl.current()), cl.route, cl.upstream)
+}
+
+// admit lets waiting requests in, oldest first, while there's room.
+func (cl *ConcurrencyLimiter) admit() {
+	for cl.waiting.Len() > 0 && cl.inFlight < cl.current() {
+		close(cl.waiting.Remove(cl.waiting.Front()).(chan struct{}))
+		cl.inFlight++
+	}
+	promConcurrencyQueued.Set(float64(cl.waiting.Len()), cl.route, cl.upstream)
+}
+
+// idle reports whether no request holds a slot or waits for one.
+func (cl *ConcurrencyLimiter) idle() bool {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.inFlight == 0 && cl.waiting.Len() == 0
+}
+
+// InFlight returns the number of requests holding a slot, and the current
+// limit.
+func (cl *ConcurrencyLimiter) InFlight() (inFlight, limit int) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.inFlight, cl.current()
+}
+
+// concurrencyLimitedResponse is sent to requests that couldn't get a route
+// wide concurrency slot: a fast 503 if the queue was full or the wait too
+// long, or a 504 if the request ran out of time first.
+func concurrencyLimitedResponse(route *Route, req *http.Request, err error) (*http.Response, error) {
+	switch {
+	case errors.Is(err, ErrorConcurrencyLimited):
+		proxyLog.WarnWithFields("Route concurrency limit reached", log.Fields{
+			"route": route.Name, "remote.addr": req.RemoteAddr,
+		})
+		return serviceUnavailableResponse(req), nil
+	case isTimeout(err):
+		return gatewayTimeoutResponse(req), nil
+	}
+	return nil, err
+}
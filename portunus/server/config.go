@@ -1,6 +1,9 @@
 package server
 
 import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
 	"time"
 
 	"github.com/mitchellh/mapstructure"
@@ -9,12 +12,18 @@ import (
 	"github.com/sanity-io/litter"
 )
 
+var configLog = log.Named("config")
+
 type ConfigDNS struct {
 	Resolvers []string `mapstructure:"resolvers" diff:"resolvers"`
 }
 
 type ConfigLogging struct {
-	Level string `mapstructure:"level" diff:"level"`
+	Level         string            `mapstructure:"level" diff:"level"`
+	Format        string            `mapstructure:"format" diff:"format"`
+	Output        string            `mapstructure:"output" diff:"output"`
+	Loggers       map[string]string `mapstructure:"loggers" diff:"loggers"`
+	AdminEndpoint bool              `mapstructure:"admin_endpoint" diff:"admin_endpoint"`
 }
 
 type ConfigNetworkTimeouts struct {
@@ -25,6 +34,15 @@ type ConfigNetworkTimeouts struct {
 	TLSHandshake   time.Duration `mapstructure:"tls_handshake" diff:"tls_handshake"`
 	Read           time.Duration `mapstructure:"read" diff:"read"`
 	Write          time.Duration `mapstructure:"write" diff:"write"`
+	ResponseHeader time.Duration `mapstructure:"response_header" diff:"response_header"`
+	Total          time.Duration `mapstructure:"total" diff:"total"`
+}
+
+type ConfigRouteTimeouts struct {
+	Connect        time.Duration `mapstructure:"connect" diff:"connect"`
+	ResponseHeader time.Duration `mapstructure:"response_header" diff:"response_header"`
+	Total          time.Duration `mapstructure:"total" diff:"total"`
+	IdleConnection time.Duration `mapstructure:"idle_connection" diff:"idle_connection"`
 }
 
 type ConfigNetwork struct {
@@ -33,11 +51,62 @@ type ConfigNetwork struct {
 	Timeouts           ConfigNetworkTimeouts `mapstructure:"timeouts" diff:"timeouts"`
 }
 
+type ConfigCircuitBreaker struct {
+	Enabled             bool          `mapstructure:"enabled" diff:"enabled"`
+	ConsecutiveFailures int           `mapstructure:"consecutive_failures" diff:"consecutive_failures"`
+	ErrorRate           float64       `mapstructure:"error_rate" diff:"error_rate"`
+	MinRequests         int           `mapstructure:"min_requests" diff:"min_requests"`
+	Window              time.Duration `mapstructure:"window" diff:"window"`
+	OpenTimeout         time.Duration `mapstructure:"open_timeout" diff:"open_timeout"`
+	HalfOpenRequests    int           `mapstructure:"half_open_requests" diff:"half_open_requests"`
+}
+
 type ConfigErrorCollections struct {
 	Enabled           bool  `mapstructure:"enabled" diff:"enabled"`
 	IgnoreStatusCodes []int `mapstructure:"ignore_status_codes" diff:"ignore_status_codes"`
 }
 
+type ConfigPrometheus struct {
+	Enabled      bool `mapstructure:"enabled" diff:"enabled"`
+	MaxUpstreams int  `mapstructure:"max_upstreams" diff:"max_upstreams"`
+}
+
+type ConfigMetrics struct {
+	Prometheus ConfigPrometheus `mapstructure:"prometheus" diff:"prometheus"`
+}
+
+type ConfigAccessLogRotation struct {
+	MaxSize    int           `mapstructure:"max_size" diff:"max_size"`
+	Interval   time.Duration `mapstructure:"interval" diff:"interval"`
+	MaxBackups int           `mapstructure:"max_backups" diff:"max_backups"`
+}
+
+type ConfigAccessLog struct {
+	Enabled    bool                    `mapstructure:"enabled" diff:"enabled"`
+	Format     string                  `mapstructure:"format" diff:"format"`
+	Fields     []string                `mapstructure:"fields" diff:"fields"`
+	Template   string                  `mapstructure:"template" diff:"template"`
+	Path       string                  `mapstructure:"path" diff:"path"`
+	Rotation   ConfigAccessLogRotation `mapstructure:"rotation" diff:"rotation"`
+	SampleRate float64                 `mapstructure:"sample_rate" diff:"sample_rate"`
+}
+
+type ConfigTracingExporter struct {
+	Type     string            `mapstructure:"type" diff:"type"`
+	Endpoint string            `mapstructure:"endpoint" diff:"endpoint"`
+	Headers  map[string]string `mapstructure:"headers" diff:"headers"`
+	Timeout  time.Duration     `mapstructure:"timeout" diff:"timeout"`
+	Path     string            `mapstructure:"path" diff:"path"`
+}
+
+type ConfigTracing struct {
+	Enabled     bool                  `mapstructure:"enabled" diff:"enabled"`
+	ServiceName string                `mapstructure:"service_name" diff:"service_name"`
+	SampleRatio float64               `mapstructure:"sample_ratio" diff:"sample_ratio"`
+	Propagation []string              `mapstructure:"propagation" diff:"propagation"`
+	Exporter    ConfigTracingExporter `mapstructure:"exporter" diff:"exporter"`
+}
+
 type ConfigNewRelic struct {
 	AppName         string                 `mapstructure:"app_name" diff:"app_name"`
 	Enabled         bool                   `mapstructure:"enabled" diff:"enabled"`
@@ -55,24 +124,162 @@ type ConfigResponseEntry struct {
 }
 
 type ConfigResponse struct {
-	NotFound    ConfigResponseEntry `mapstructure:"not_found" diff:"not_found"`
-	ServerError ConfigResponseEntry `mapstructure:"server_error" diff:"server_error"`
+	NotFound           ConfigResponseEntry `mapstructure:"not_found" diff:"not_found"`
+	ClientCertRequired ConfigResponseEntry `mapstructure:"client_cert_required" diff:"client_cert_required"`
+	ServerError        ConfigResponseEntry `mapstructure:"server_error" diff:"server_error"`
+	ServiceUnavailable ConfigResponseEntry `mapstructure:"service_unavailable" diff:"service_unavailable"`
+	GatewayTimeout     ConfigResponseEntry `mapstructure:"gateway_timeout" diff:"gateway_timeout"`
+	RateLimited        ConfigResponseEntry `mapstructure:"rate_limited" diff:"rate_limited"`
+}
+
+type ConfigUpstream struct {
+	Target string `mapstructure:"target" diff:"target"`
+	Weight int    `mapstructure:"weight" diff:"weight"`
+}
+
+type ConfigBalancer struct {
+	Policy  string `mapstructure:"policy" diff:"policy"`
+	HashKey string `mapstructure:"hash_key" diff:"hash_key"`
+}
+
+type ConfigHealthCheck struct {
+	Path               string        `mapstructure:"path" diff:"path"`
+	Interval           time.Duration `mapstructure:"interval" diff:"interval"`
+	Timeout            time.Duration `mapstructure:"timeout" diff:"timeout"`
+	ExpectedStatus     string        `mapstructure:"expected_status" diff:"expected_status"`
+	HealthyThreshold   int           `mapstructure:"healthy_threshold" diff:"healthy_threshold"`
+	UnhealthyThreshold int           `mapstructure:"unhealthy_threshold" diff:"unhealthy_threshold"`
+}
+
+type ConfigRetry struct {
+	Attempts      int           `mapstructure:"attempts" diff:"attempts"`
+	PerTryTimeout time.Duration `mapstructure:"per_try_timeout" diff:"per_try_timeout"`
+	Backoff       time.Duration `mapstructure:"backoff" diff:"backoff"`
+	MaxBackoff    time.Duration `mapstructure:"max_backoff" diff:"max_backoff"`
+	RetryOn       []string      `mapstructure:"retry_on" diff:"retry_on"`
+	Methods       []string      `mapstructure:"methods" diff:"methods"`
 }
 
 type ConfigRoute struct {
-	Upstream                 string   `mapstructure:"upstream" diff:"upstream"`
-	Paths                    []string `mapstructure:"paths" diff:"paths"`
-	AggregateChunkedRequests bool     `mapstructure:"aggregate_chunked_requests" diff:"aggregate_chunked_requests"`
+	Upstream                 string               `mapstructure:"upstream" diff:"upstream"`
+	Upstreams                []ConfigUpstream     `mapstructure:"upstreams" diff:"upstreams"`
+	Balancer                 ConfigBalancer       `mapstructure:"balancer" diff:"balancer"`
+	HealthCheck              ConfigHealthCheck    `mapstructure:"health_check" diff:"health_check"`
+	Retry                    ConfigRetry          `mapstructure:"retry" diff:"retry"`
+	Transform                ConfigRouteTransform `mapstructure:"transform" diff:"transform"`
+	Rewrite                  ConfigRewrite        `mapstructure:"rewrite" diff:"rewrite"`
+	Hosts                    []string             `mapstructure:"hosts" diff:"hosts"`
+	Paths                    []string             `mapstructure:"paths" diff:"paths"`
+	AggregateChunkedRequests bool                 `mapstructure:"aggregate_chunked_requests" diff:"aggregate_chunked_requests"`
+	RequireClientCert        bool                 `mapstructure:"require_client_cert" diff:"require_client_cert"`
+	UpstreamTLS              ConfigUpstreamTLS    `mapstructure:"upstream_tls" diff:"upstream_tls"`
+	UpstreamProtocol         string               `mapstructure:"upstream_protocol" diff:"upstream_protocol"`
+	Upgrade                  ConfigUpgrade        `mapstructure:"upgrade" diff:"upgrade"`
+	Timeouts                 ConfigRouteTimeouts  `mapstructure:"timeouts" diff:"timeouts"`
+	RateLimits               []ConfigRateLimit    `mapstructure:"rate_limits" diff:"rate_limits"`
+	Concurrency              ConfigConcurrency    `mapstructure:"concurrency" diff:"concurrency"`
+}
+
+type ConfigConcurrency struct {
+	MaxConcurrent int                       `mapstructure:"max_concurrent" diff:"max_concurrent"`
+	Per           string                    `mapstructure:"per" diff:"per"`
+	MaxQueue      int                       `mapstructure:"max_queue" diff:"max_queue"`
+	MaxWait       time.Duration             `mapstructure:"max_wait" diff:"max_wait"`
+	Adaptive      ConfigAdaptiveConcurrency `mapstructure:"adaptive" diff:"adaptive"`
+}
+
+type ConfigAdaptiveConcurrency struct {
+	Enabled       bool          `mapstructure:"enabled" diff:"enabled"`
+	MinConcurrent int           `mapstructure:"min_concurrent" diff:"min_concurrent"`
+	TargetLatency time.Duration `mapstructure:"target_latency" diff:"target_latency"`
+}
+
+type ConfigRateLimit struct {
+	Name    string            `mapstructure:"name" diff:"name"`
+	Key     string            `mapstructure:"key" diff:"key"`
+	Rate    float64           `mapstructure:"rate" diff:"rate"`
+	Period  time.Duration     `mapstructure:"period" diff:"period"`
+	Burst   int               `mapstructure:"burst" diff:"burst"`
+	Body    string            `mapstructure:"body" diff:"body"`
+	Headers map[string]string `mapstructure:"headers" diff:"headers"`
+}
+
+type ConfigRateLimiting struct {
+	MaxKeys int               `mapstructure:"max_keys" diff:"max_keys"`
+	Limits  []ConfigRateLimit `mapstructure:"limits" diff:"limits"`
+}
+
+type ConfigUpgrade struct {
+	Enabled     bool          `mapstructure:"enabled" diff:"enabled"`
+	Protocols   []string      `mapstructure:"protocols" diff:"protocols"`
+	IdleTimeout time.Duration `mapstructure:"idle_timeout" diff:"idle_timeout"`
+	MaxLifetime time.Duration `mapstructure:"max_lifetime" diff:"max_lifetime"`
+}
+
+type ConfigUpstreamTLS struct {
+	CA                 string `mapstructure:"ca" diff:"ca"`
+	Cert               string `mapstructure:"cert" diff:"cert"`
+	Key                string `mapstructure:"key" diff:"key"`
+	ServerName         string `mapstructure:"server_name" diff:"server_name"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify" diff:"insecure_skip_verify"`
+	MinVersion         string `mapstructure:"min_version" diff:"min_version"`
+}
+
+type ConfigRewrite struct {
+	StripPrefix string               `mapstructure:"strip_prefix" diff:"strip_prefix"`
+	AddPrefix   string               `mapstructure:"add_prefix" diff:"add_prefix"`
+	Regex       []ConfigRewriteRegex `mapstructure:"regex" diff:"regex"`
+	Query       ConfigTransformEntry `mapstructure:"query" diff:"query"`
+}
+
+type ConfigRewriteRegex struct {
+	Pattern     string `mapstructure:"pattern" diff:"pattern"`
+	Replacement string `mapstructure:"replacement" diff:"replacement"`
+}
+
+type ConfigACME struct {
+	Enabled     bool          `mapstructure:"enabled" diff:"enabled"`
+	Hosts       []string      `mapstructure:"hosts" diff:"hosts"`
+	Email       string        `mapstructure:"email" diff:"email"`
+	AcceptTOS   bool          `mapstructure:"accept_tos" diff:"accept_tos"`
+	Directory   string        `mapstructure:"directory" diff:"directory"`
+	DirectoryCA string        `mapstructure:"directory_ca" diff:"directory_ca"`
+	CacheDir    string        `mapstructure:"cache_dir" diff:"cache_dir"`
+	RenewBefore time.Duration `mapstructure:"renew_before" diff:"renew_before"`
+	Challenges  []string      `mapstructure:"challenges" diff:"challenges"`
+	HTTPAddress string        `mapstructure:"http_address" diff:"http_address"`
+}
+
+type ConfigClientAuth struct {
+	Mode           string `mapstructure:"mode" diff:"mode"`
+	CA             string `mapstructure:"ca" diff:"ca"`
+	ForwardHeaders bool   `mapstructure:"forward_headers" diff:"forward_headers"`
+}
+
+type ConfigCertificate struct {
+	Cert string `mapstructure:"cert" diff:"cert"`
+	Key  string `mapstructure:"key" diff:"key"`
 }
 
 type ConfigTLS struct {
-	Enabled bool   `mapstructure:"enabled" diff:"enabled"`
-	Cert    string `mapstructure:"cert" diff:"cert"`
-	Key     string `mapstructure:"key" diff:"key"`
+	Enabled        bool                `mapstructure:"enabled" diff:"enabled"`
+	Cert           string              `mapstructure:"cert" diff:"cert"`
+	Key            string              `mapstructure:"key" diff:"key"`
+	Certificates   []ConfigCertificate `mapstructure:"certificates" diff:"certificates"`
+	CertificateDir string              `mapstructure:"certificate_dir" diff:"certificate_dir"`
+	WatchInterval  time.Duration       `mapstructure:"watch_interval" diff:"watch_interval"`
+	Profile        string              `mapstructure:"profile" diff:"profile"`
+	MinVersion     string              `mapstructure:"min_version" diff:"min_version"`
+	MaxVersion     string              `mapstructure:"max_version" diff:"max_version"`
+	CipherSuites   []string            `mapstructure:"cipher_suites" diff:"cipher_suites"`
+	Curves         []string            `mapstructure:"curves" diff:"curves"`
+	ClientAuth     ConfigClientAuth    `mapstructure:"client_auth" diff:"client_auth"`
+	ACME           ConfigACME          `mapstructure:"acme" diff:"acme"`
 }
 
 type ConfigHTTP2 struct {
 	Enabled bool `mapstructure:"enabled" diff:"enabled"`
+	H2C     bool `mapstructure:"h2c" diff:"h2c"`
 }
 type ConfigServer struct {
 	BindAddress     string        `mapstructure:"bind_address" diff:"bind_address"`
@@ -93,27 +300,41 @@ type ConfigTransform struct {
 	Response ConfigTransformEntry `mapstructure:"response" diff:"response"`
 }
 
+type ConfigRouteTransform struct {
+	Mode     string               `mapstructure:"mode" diff:"mode"`
+	Request  ConfigTransformEntry `mapstructure:"request" diff:"request"`
+	Response ConfigTransformEntry `mapstructure:"response" diff:"response"`
+}
+
 type Config struct {
-	ConfigFile string                 `mapstructure:"config" diff:"config"`
-	DNS        ConfigDNS              `mapstructure:"dns" diff:"dns"`
-	Logging    ConfigLogging          `mapstructure:"logging" diff:"logging"`
-	Network    ConfigNetwork          `mapstructure:"network" diff:"network"`
-	NewRelic   ConfigNewRelic         `mapstructure:"newrelic" diff:"newrelic"`
-	Response   ConfigResponse         `mapstructure:"response" diff:"response"`
-	Routes     map[string]ConfigRoute `mapstructure:"routes" diff:"routes"`
-	Server     ConfigServer           `mapstructure:"server" diff:"server"`
-	Transform  ConfigTransform        `mapstructure:"transform" diff:"transform"`
+	ConfigFile     string                 `mapstructure:"config" diff:"config"`
+	AccessLog      ConfigAccessLog        `mapstructure:"access_log" diff:"access_log"`
+	CircuitBreaker ConfigCircuitBreaker   `mapstructure:"circuit_breaker" diff:"circuit_breaker"`
+	DNS            ConfigDNS              `mapstructure:"dns" diff:"dns"`
+	Logging        ConfigLogging          `mapstructure:"logging" diff:"logging"`
+	Metrics        ConfigMetrics          `mapstructure:"metrics" diff:"metrics"`
+	Network        ConfigNetwork          `mapstructure:"network" diff:"network"`
+	NewRelic       ConfigNewRelic         `mapstructure:"newrelic" diff:"newrelic"`
+	RateLimit      ConfigRateLimiting     `mapstructure:"rate_limit" diff:"rate_limit"`
+	Response       ConfigResponse         `mapstructure:"response" diff:"response"`
+	Routes         map[string]ConfigRoute `mapstructure:"routes" diff:"routes"`
+	Server         ConfigServer           `mapstructure:"server" diff:"server"`
+	Tracing        ConfigTracing          `mapstructure:"tracing" diff:"tracing"`
+	Transform      ConfigTransform        `mapstructure:"transform" diff:"transform"`
 }
 
 func DecodeConfigMap(input map[string]interface{}) (*Config, error) {
 	var newConfig Config
 
-	if log.IsTraceEnabled() {
+	if configLog.IsTraceEnabled() {
 		litter.Dump(input)
 	}
 
 	decodeConfig := &mapstructure.DecoderConfig{
-		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			stringToUpstreamHookFunc(),
+		),
 		WeaklyTypedInput: true,
 		Result:           &newConfig,
 	}
@@ -131,32 +352,112 @@ func DecodeConfigMap(input map[string]interface{}) (*Config, error) {
 	return &newConfig, nil
 }
 
-func (c *Config) LoadFromMap(input map[string]interface{}, onChangeFunc func(old, new *Config)) {
+// stringToUpstreamHookFunc allows upstreams to be listed as plain strings,
+// rather than as a map with a target and weight.
+func stringToUpstreamHookFunc() mapstructure.DecodeHookFuncType {
+	return func(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+		if from.Kind() != reflect.String || to != reflect.TypeOf(ConfigUpstream{}) {
+			return data, nil
+		}
+		return ConfigUpstream{Target: data.(string)}, nil
+	}
+}
+
+// LoadFromMap decodes the given settings and makes them the active config,
+// returning an error (and leaving the active config untouched) if they can't
+// be decoded, or their logging config is invalid.
+func LoadFromMap(input map[string]interface{}, onChangeFunc func(old, new *Config)) error {
 	newConfig, err := DecodeConfigMap(input)
 	if err != nil {
-		log.Error(err)
+		return err
+	}
+
+	if err := ValidateLogging(newConfig.Logging); err != nil {
+		return err
+	}
+	output, err := OpenLogOutput(newConfig.Logging)
+	if err != nil {
+		return err
+	}
+
+	ApplyConfig(newConfig, output, onChangeFunc)
+	return nil
+}
+
+// ApplyConfig makes an already decoded config the active one. It's swapped in
+// as a whole, so it mustn't be modified afterwards. The log output, opened by
+// OpenLogOutput, replaces the current one.
+func ApplyConfig(newConfig *Config, output *log.Output, onChangeFunc func(old, new *Config)) {
+	onChangeFunc(Settings(), newConfig)
+
+	settings.Store(newConfig)
+
+	if err := log.Configure(newConfig.Logging.Format, output); err != nil {
+		configLog.ErrorWithFields("Unable to configure logging", log.Fields{"error": err})
+	}
+	if err := log.ConfigureLevels(newConfig.Logging.Level, newConfig.Logging.Loggers); err != nil {
+		configLog.ErrorWithFields("Unable to set log levels", log.Fields{"error": err})
 	}
+	SetResolvers(newConfig.DNS.Resolvers)
 
-	onChangeFunc(c, newConfig)
+	if configLog.IsTraceEnabled() {
+		litter.Dump(newConfig)
+	}
+}
 
-	*c = *newConfig
+func LoadAndLogDiff(input map[string]interface{}) error {
+	return LoadFromMap(input, logConfigDiff)
+}
 
-	log.SetLogLevel(log.GetLogger(), c.Logging.Level)
-	SetResolvers(c.DNS.Resolvers)
+func ApplyConfigAndLogDiff(newConfig *Config, output *log.Output) {
+	ApplyConfig(newConfig, output, logConfigDiff)
+}
 
-	if log.IsTraceEnabled() {
-		litter.Dump(c)
+func logConfigDiff(old, new *Config) {
+	changelog, err := diff.Diff(*old, *new)
+	if err == nil {
+		configLog.InfoWithFields("Configuration Reloaded", log.Fields{"changelog": changelog})
 	}
 }
 
-func (c *Config) LoadAndLogDiff(input map[string]interface{}) {
-	c.LoadFromMap(input, func(old, new *Config) {
-		changelog, err := diff.Diff(*old, *new)
-		if err == nil {
-			log.InfoWithFields("Configuration Reloaded", log.Fields{"changelog": changelog})
-		}
-	})
+// ValidateLogging checks the logging config, so that a reload with a bad
+// format or level can be rejected before anything is applied.
+func ValidateLogging(config ConfigLogging) error {
+	if err := log.ValidateFormat(config.Format); err != nil {
+		return fmt.Errorf("logging: %s", err)
+	}
+	if err := log.ValidateLevels(map[string]string{log.RootLogger: config.Level}); err != nil {
+		return fmt.Errorf("logging: %s", err)
+	}
+	if err := log.ValidateLevels(config.Loggers); err != nil {
+		return fmt.Errorf("logging: %s", err)
+	}
+	return nil
+}
+
+// OpenLogOutput opens the logging output ahead of it being applied, so that
+// a reload with an output that can't be opened is rejected as well. It must
+// be passed on to ApplyConfig, or closed.
+func OpenLogOutput(config ConfigLogging) (*log.Output, error) {
+	output, err := log.OpenOutput(config.Output)
+	if err != nil {
+		return nil, fmt.Errorf("logging: %s", err)
+	}
+	return output, nil
 }
 
-// Settings contains Viper loaded settings
-var Settings = &Config{}
+// settings holds the active *Config, loaded by viper. A reload swaps in a new
+// config rather than changing the active one in place, so that requests in
+// flight never see a partially applied config.
+var settings atomic.Value
+
+func init() {
+	settings.Store(&Config{})
+}
+
+// Settings returns the active config, which must be treated as read-only.
+// Callers that read several values should hold on to the returned config, so
+// that they all come from the same one even if it's reloaded meanwhile.
+func Settings() *Config {
+	return settings.Load().(*Config)
+}
@@ -0,0 +1,52 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey int
+
+const requestStateKey contextKey = iota
+
+// requestState carries details about how a request was proxied from the
+// transport back out to the handlers wrapping it (e.g., for logging).
+type requestState struct {
+	Route    *Route
+	Params   map[string]string
+	Upstream string
+	Attempts int
+	TraceID  string
+	// gRPC status sent to the client, for gRPC requests
+	GRPCStatus string
+}
+
+// withRequestState attaches a fresh requestState to the request.
+func withRequestState(r *http.Request) (*http.Request, *requestState) {
+	state := &requestState{}
+	return r.WithContext(context.WithValue(r.Context(), requestStateKey, state)), state
+}
+
+// getRequestState returns the request's state, or a throwaway one if it
+// wasn't set, so callers never have to check for nil.
+func getRequestState(r *http.Request) *requestState {
+	if state, ok := r.Context().Value(requestStateKey).(*requestState); ok {
+		return state
+	}
+	return &requestState{}
+}
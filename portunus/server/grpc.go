@@ -0,0 +1,173 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/rabbitt/portunus/portunus/logging"
+)
+
+// gRPC status codes, see https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	GRPCStatusOK                = 0
+	GRPCStatusCanceled          = 1
+	GRPCStatusUnknown           = 2
+	GRPCStatusDeadlineExceeded  = 4
+	GRPCStatusPermissionDenied  = 7
+	GRPCStatusResourceExhausted = 8
+	GRPCStatusUnimplemented     = 12
+	GRPCStatusInternal          = 13
+	GRPCStatusUnavailable       = 14
+	GRPCStatusUnauthenticated   = 16
+)
+
+var grpcStatusNames = map[string]string{
+	"0": "OK", "1": "CANCELLED", "2": "UNKNOWN", "3": "INVALID_ARGUMENT",
+	"4": "DEADLINE_EXCEEDED", "5": "NOT_FOUND", "6": "ALREADY_EXISTS",
+	"7": "PERMISSION_DENIED", "8": "RESOURCE_EXHAUSTED", "9": "FAILED_PRECONDITION",
+	"10": "ABORTED", "11": "OUT_OF_RANGE", "12": "UNIMPLEMENTED", "13": "INTERNAL",
+	"14": "UNAVAILABLE", "15": "DATA_LOSS", "16": "UNAUTHENTICATED",
+}
+
+const (
+	headerGRPCStatus  = "Grpc-Status"
+	headerGRPCMessage = "Grpc-Message"
+)
+
+// isGRPCRequest reports whether the request is a gRPC call (but not gRPC-Web,
+// which carries its status in the body).
+func isGRPCRequest(req *http.Request) bool {
+	if req == nil {
+		return false
+	}
+	contentType := req.Header.Get("Content-Type")
+	return contentType == "application/grpc" ||
+		strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// grpcStatusForHTTP maps an HTTP status to the gRPC status a client would
+// infer from it, so that portunus' own errors mean the same thing to gRPC
+// clients as they do to everyone else.
+func grpcStatusForHTTP(code int) int {
+	switch code {
+	case http.StatusOK:
+		return GRPCStatusOK
+	case http.StatusUnauthorized:
+		return GRPCStatusUnauthenticated
+	case http.StatusForbidden:
+		return GRPCStatusPermissionDenied
+	case http.StatusNotFound:
+		return GRPCStatusUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return GRPCStatusUnavailable
+	case http.StatusGatewayTimeout:
+		return GRPCStatusDeadlineExceeded
+	case http.StatusInternalServerError, http.StatusBadRequest:
+		return GRPCStatusInternal
+	}
+	return GRPCStatusUnknown
+}
+
+// grpcStatusForError maps an error proxying a request to a gRPC status.
+func grpcStatusForError(err error) int {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return GRPCStatusCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return GRPCStatusDeadlineExceeded
+	}
+	return GRPCStatusUnavailable
+}
+
+// encodeGRPCMessage percent-encodes the message as the gRPC spec requires.
+func encodeGRPCMessage(message string) string {
+	var buffer strings.Builder
+	for idx := 0; idx < len(message); idx++ {
+		if char := message[idx]; char < ' ' || char > '~' || char == '%' {
+			fmt.Fprintf(&buffer, "%%%02X", char)
+		} else {
+			buffer.WriteByte(char)
+		}
+	}
+	return buffer.String()
+}
+
+// grpcErrorResponse is a "Trailers-Only" gRPC response: a 200 without a body,
+// whose status is carried in its headers.
+func grpcErrorResponse(req *http.Request, status int, message string) *http.Response {
+	header := make(http.Header)
+	header.Set("Content-Type", "application/grpc")
+	header.Set(headerGRPCStatus, strconv.Itoa(status))
+	header.Set(headerGRPCMessage, encodeGRPCMessage(message))
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Body:          ioutil.NopCloser(bytes.NewReader(nil)),
+		ContentLength: 0,
+		Request:       req,
+		Header:        header,
+	}
+}
+
+// proxyErrorHandler handles requests that couldn't be proxied at all, e.g.,
+// because the upstream couldn't be reached. gRPC clients are sent an
+// UNAVAILABLE (or CANCELLED/DEADLINE_EXCEEDED) status, and everyone else a
+// 502.
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	proxyLog.ErrorWithFields("Unable to proxy request", log.Fields{"error": err, "request.uri": r.RequestURI})
+
+	if !isGRPCRequest(r) {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set(headerGRPCStatus, strconv.Itoa(grpcStatusForError(err)))
+	w.Header().Set(headerGRPCMessage, encodeGRPCMessage(err.Error()))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcStatus returns the gRPC status sent to the client, from the response
+// headers (a Trailers-Only response) or trailers, or "" if there isn't one.
+func grpcStatus(header http.Header) string {
+	if status := header.Get(headerGRPCStatus); status != "" {
+		return status
+	}
+	// trailers that weren't announced before the body was written
+	return header.Get(http.TrailerPrefix + headerGRPCStatus)
+}
+
+// grpcStatusName returns the status' name (e.g., "UNAVAILABLE"), for use as
+// a metric label.
+func grpcStatusName(status string) string {
+	if name, ok := grpcStatusNames[status]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
@@ -0,0 +1,326 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/rabbitt/portunus/portunus/logging"
+)
+
+var healthLog = log.Named("health")
+
+const (
+	DefaultHealthCheckInterval           = 10 * time.Second
+	DefaultHealthCheckTimeout            = 2 * time.Second
+	DefaultHealthCheckExpectedStatus     = "200-399"
+	DefaultHealthCheckHealthyThreshold   = 2
+	DefaultHealthCheckUnhealthyThreshold = 3
+)
+
+// TargetHealth is a snapshot of a target's active health check state.
+type TargetHealth struct {
+	Healthy              bool      `json:"healthy"`
+	Checked              bool      `json:"checked"`
+	LastCheck            time.Time `json:"last_check,omitempty"`
+	LastStatus           int       `json:"last_status,omitempty"`
+	LastError            string    `json:"last_error,omitempty"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+}
+
+// HealthChecker periodically probes each of a route's targets, taking them out
+// of rotation after too many consecutive failures and back in after enough
+// consecutive successes.
+type HealthChecker struct {
+	route     string
+	config    ConfigHealthCheck
+	statusMin int
+	statusMax int
+	targets   []*Target
+	client    *http.Client
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// NewHealthChecker validates the health check config and returns a checker for
+// the given targets, or nil if health checking isn't enabled for the route.
+// Checks are made with the given transport (nil for the default), so that they
+// use the route's upstream TLS settings and protocol.
+func NewHealthChecker(route string, config ConfigHealthCheck, targets []*Target, transport http.RoundTripper) (*HealthChecker, error) {
+	if config.Path == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(config.Path, "/") {
+		return nil, fmt.Errorf("health check path %q must start with /", config.Path)
+	}
+
+	if config.Interval <= 0 {
+		config.Interval = DefaultHealthCheckInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultHealthCheckTimeout
+	}
+	if config.ExpectedStatus == "" {
+		config.ExpectedStatus = DefaultHealthCheckExpectedStatus
+	}
+	if config.HealthyThreshold <= 0 {
+		config.HealthyThreshold = DefaultHealthCheckHealthyThreshold
+	}
+	if config.UnhealthyThreshold <= 0 {
+		config.UnhealthyThreshold = DefaultHealthCheckUnhealthyThreshold
+	}
+
+	statusMin, statusMax, err := parseStatusRange(config.ExpectedStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	hc := &HealthChecker{
+		route:     route,
+		config:    config,
+		statusMin: statusMin,
+		statusMax: statusMax,
+		client: &http.Client{
+			Timeout: config.Timeout,
+			// health checks should report on the target itself, not wherever it
+			// redirects to
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		stop: make(chan struct{}),
+	}
+
+	if transport != nil {
+		hc.client.Transport = transport
+	}
+
+	for _, target := range targets {
+		if target.IsTemplated() {
+			healthLog.WarnWithFields("Skipping health checks for templated upstream", log.Fields{
+				"route.name":      route,
+				"upstream.target": target.URL,
+			})
+			continue
+		}
+		hc.targets = append(hc.targets, target)
+	}
+
+	return hc, nil
+}
+
+// parseStatusRange parses a status range like "200-399", or a single status
+// like "200".
+func parseStatusRange(value string) (min, max int, err error) {
+	parts := strings.SplitN(value, "-", 2)
+
+	if min, err = strconv.Atoi(strings.TrimSpace(parts[0])); err != nil {
+		return 0, 0, fmt.Errorf("invalid expected status %q", value)
+	}
+
+	max = min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return 0, 0, fmt.Errorf("invalid expected status %q", value)
+		}
+	}
+
+	if min < 100 || max > 599 || min > max {
+		return 0, 0, fmt.Errorf("invalid expected status %q", value)
+	}
+
+	return min, max, nil
+}
+
+// Start begins checking each target in the background.
+func (hc *HealthChecker) Start() {
+	for _, target := range hc.targets {
+		go hc.run(target)
+	}
+}
+
+// Stop halts all checks; it's safe to call more than once.
+func (hc *HealthChecker) Stop() {
+	hc.stopOnce.Do(func() {
+		close(hc.stop)
+		hc.client.CloseIdleConnections()
+	})
+}
+
+func (hc *HealthChecker) run(target *Target) {
+	ticker := time.NewTicker(hc.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		hc.check(target)
+
+		select {
+		case <-hc.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (hc *HealthChecker) check(target *Target) {
+	status, err := hc.probe(target)
+
+	if err == nil && (status < hc.statusMin || status > hc.statusMax) {
+		err = fmt.Errorf("unexpected status %d (expected %s)", status, hc.config.ExpectedStatus)
+	}
+
+	wasHealthy, healthy := target.recordHealthCheck(status, err, hc.config.HealthyThreshold, hc.config.UnhealthyThreshold)
+
+	fields := log.Fields{
+		"route.name":      hc.route,
+		"upstream.target": target.URL,
+		"response.status": status,
+		"error":           err,
+	}
+
+	if wasHealthy && !healthy {
+		healthLog.WarnWithFields("Upstream target marked unhealthy", fields)
+	} else if !wasHealthy && healthy {
+		healthLog.InfoWithFields("Upstream target marked healthy", fields)
+	} else {
+		healthLog.TraceWithFields("Upstream health check", fields)
+	}
+}
+
+func (hc *HealthChecker) probe(target *Target) (int, error) {
+	request, err := http.NewRequest("GET", strings.TrimRight(target.URL, "/")+hc.config.Path, nil)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("User-Agent", "portunus-health-check")
+
+	response, err := hc.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	// drain the body so the connection can be reused for the next check
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+
+	return response.StatusCode, nil
+}
+
+// recordHealthCheck updates the target's health with the result of a check,
+// returning whether it was healthy before and after.
+func (t *Target) recordHealthCheck(status int, err error, healthyThreshold, unhealthyThreshold int) (wasHealthy, healthy bool) {
+	t.healthMutex.Lock()
+	defer t.healthMutex.Unlock()
+
+	wasHealthy = t.Healthy()
+
+	t.health.Checked = true
+	t.health.LastCheck = time.Now()
+	t.health.LastStatus = status
+	t.health.LastError = ""
+
+	if err != nil {
+		t.health.LastError = err.Error()
+		t.health.ConsecutiveSuccesses = 0
+		t.health.ConsecutiveFailures++
+		if t.health.ConsecutiveFailures >= unhealthyThreshold {
+			t.setHealthy(false)
+		}
+	} else {
+		t.health.ConsecutiveFailures = 0
+		t.health.ConsecutiveSuccesses++
+		if t.health.ConsecutiveSuccesses >= healthyThreshold {
+			t.setHealthy(true)
+		}
+	}
+
+	return wasHealthy, t.Healthy()
+}
+
+// inheritHealth carries the health of the checker's targets over from the
+// same route's targets (matched by url) in the route tree it replaces, so
+// that a reload doesn't put targets that were marked down back into rotation
+// until they've failed enough checks all over again.
+func (hc *HealthChecker) inheritHealth(previous *RouteTree) {
+	balancer, ok := previous.balancers[hc.route]
+	if !ok {
+		return
+	}
+
+	old := make(map[string]*Target)
+	for _, target := range balancer.Targets() {
+		old[target.URL] = target
+	}
+
+	for _, target := range hc.targets {
+		if from, ok := old[target.URL]; ok {
+			target.setHealth(from.Health())
+		}
+	}
+}
+
+// setHealth replaces the target's health check state.
+func (t *Target) setHealth(health TargetHealth) {
+	t.healthMutex.Lock()
+	defer t.healthMutex.Unlock()
+
+	t.health = health
+	t.setHealthy(health.Healthy)
+}
+
+// Health returns a snapshot of the target's health check state.
+func (t *Target) Health() TargetHealth {
+	t.healthMutex.Lock()
+	defer t.healthMutex.Unlock()
+
+	health := t.health
+	health.Healthy = t.Healthy()
+	return health
+}
+
+func healthHandler(router *Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := make(map[string]map[string]TargetHealth)
+
+		routeTree := router.RouteTree()
+		names := make([]string, 0, len(routeTree.balancers))
+		for name := range routeTree.balancers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			status[name] = make(map[string]TargetHealth)
+			for _, target := range routeTree.balancers[name].Targets() {
+				status[name][target.URL] = target.Health()
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(status)
+	}
+}
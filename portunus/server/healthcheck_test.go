@@ -0,0 +1,280 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// healthTestUpstream responds to health checks with whatever status is
+// currently stored in the returned value.
+func healthTestUpstream(t *testing.T) (*httptest.Server, *int32) {
+	status := int32(http.StatusOK)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, &status
+}
+
+func healthTestTargets(t *testing.T, urls ...string) []*Target {
+	var upstreams []ConfigUpstream
+	for _, url := range urls {
+		upstreams = append(upstreams, ConfigUpstream{Target: url})
+	}
+
+	targets, err := routeTargets(ConfigRoute{Upstreams: upstreams})
+	if err != nil {
+		t.Fatalf("routeTargets: %v", err)
+	}
+	return targets
+}
+
+func healthTestChecker(t *testing.T, targets []*Target) *HealthChecker {
+	hc, err := NewHealthChecker("test", ConfigHealthCheck{
+		Path:               "/health",
+		Interval:           time.Hour,
+		Timeout:            time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}, targets, nil)
+	if err != nil {
+		t.Fatalf("NewHealthChecker: %v", err)
+	}
+	t.Cleanup(hc.Stop)
+	return hc
+}
+
+func TestHealthCheckThresholds(t *testing.T) {
+	upstream, status := healthTestUpstream(t)
+	targets := healthTestTargets(t, upstream.URL)
+	target := targets[0]
+	hc := healthTestChecker(t, targets)
+
+	atomic.StoreInt32(status, http.StatusInternalServerError)
+	for i := 1; i <= 3; i++ {
+		if !target.Healthy() {
+			t.Fatalf("marked unhealthy after %d failures, expected 3", i-1)
+		}
+		hc.check(target)
+	}
+	if target.Healthy() {
+		t.Fatalf("still healthy after 3 failures: %+v", target.Health())
+	}
+
+	health := target.Health()
+	if health.ConsecutiveFailures != 3 || health.LastStatus != http.StatusInternalServerError || health.LastError == "" {
+		t.Errorf("unexpected health after failures: %+v", health)
+	}
+
+	atomic.StoreInt32(status, http.StatusOK)
+	hc.check(target)
+	if target.Healthy() {
+		t.Fatalf("marked healthy after 1 success, expected 2")
+	}
+	hc.check(target)
+	if !target.Healthy() {
+		t.Fatalf("still unhealthy after 2 successes: %+v", target.Health())
+	}
+
+	health = target.Health()
+	if health.ConsecutiveSuccesses != 2 || health.ConsecutiveFailures != 0 || health.LastError != "" {
+		t.Errorf("unexpected health after successes: %+v", health)
+	}
+}
+
+func TestHealthCheckFailureResetsSuccesses(t *testing.T) {
+	upstream, status := healthTestUpstream(t)
+	targets := healthTestTargets(t, upstream.URL)
+	target := targets[0]
+	hc := healthTestChecker(t, targets)
+
+	atomic.StoreInt32(status, http.StatusServiceUnavailable)
+	for i := 0; i < 3; i++ {
+		hc.check(target)
+	}
+
+	// a failure in between successes starts the count over
+	for _, code := range []int32{http.StatusOK, http.StatusServiceUnavailable, http.StatusOK} {
+		atomic.StoreInt32(status, code)
+		hc.check(target)
+	}
+	if target.Healthy() {
+		t.Fatalf("marked healthy without 2 consecutive successes: %+v", target.Health())
+	}
+}
+
+func TestHealthCheckUnreachableTarget(t *testing.T) {
+	upstream, _ := healthTestUpstream(t)
+	upstream.Close()
+
+	targets := healthTestTargets(t, upstream.URL)
+	hc := healthTestChecker(t, targets)
+
+	for i := 0; i < 3; i++ {
+		hc.check(targets[0])
+	}
+	if health := targets[0].Health(); health.Healthy || health.LastStatus != 0 || health.LastError == "" {
+		t.Errorf("expected unreachable target to be unhealthy: %+v", health)
+	}
+}
+
+func TestHealthCheckBalancerSkipsUnhealthy(t *testing.T) {
+	healthy, _ := healthTestUpstream(t)
+	failing, status := healthTestUpstream(t)
+	atomic.StoreInt32(status, http.StatusInternalServerError)
+
+	for _, policy := range []string{PolicyRoundRobin, PolicyWeightedRoundRobin, PolicyLeastOutstanding, PolicyRandomTwoChoices} {
+		t.Run(policy, func(t *testing.T) {
+			targets := healthTestTargets(t, healthy.URL, failing.URL)
+			hc := healthTestChecker(t, targets)
+			for i := 0; i < 3; i++ {
+				for _, target := range targets {
+					hc.check(target)
+				}
+			}
+
+			balancer, err := NewBalancer(ConfigBalancer{Policy: policy}, targets)
+			if err != nil {
+				t.Fatalf("NewBalancer: %v", err)
+			}
+
+			for i := 0; i < 20; i++ {
+				if target := balancer.Next(nil); target != targets[0] {
+					t.Fatalf("request %d sent to %v, expected %v", i, target, targets[0])
+				}
+			}
+
+			// nothing left once the healthy target is excluded
+			if target := balancer.Next(nil, targets[0]); target != nil {
+				t.Fatalf("expected no target, got %v", target)
+			}
+		})
+	}
+}
+
+func TestHealthCheckSkipsTemplatedTargets(t *testing.T) {
+	upstream, _ := healthTestUpstream(t)
+	targets := healthTestTargets(t, upstream.URL, "http://{{req.host}}:8080")
+
+	hc := healthTestChecker(t, targets)
+	if len(hc.targets) != 1 || hc.targets[0] != targets[0] {
+		t.Fatalf("expected only the static target to be checked, got %v", hc.targets)
+	}
+
+	hc.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for !targets[0].Health().Checked {
+		if time.Now().After(deadline) {
+			t.Fatal("static target was never checked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if health := targets[1].Health(); health.Checked || !health.Healthy {
+		t.Errorf("templated target was checked: %+v", health)
+	}
+}
+
+func TestHealthCheckConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ConfigHealthCheck
+		err    bool
+	}{
+		{"disabled", ConfigHealthCheck{}, false},
+		{"relative path", ConfigHealthCheck{Path: "health"}, true},
+		{"single status", ConfigHealthCheck{Path: "/", ExpectedStatus: "204"}, false},
+		{"status range", ConfigHealthCheck{Path: "/", ExpectedStatus: "200-299"}, false},
+		{"inverted range", ConfigHealthCheck{Path: "/", ExpectedStatus: "399-200"}, true},
+		{"out of range", ConfigHealthCheck{Path: "/", ExpectedStatus: "200-600"}, true},
+		{"not a status", ConfigHealthCheck{Path: "/", ExpectedStatus: "ok"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hc, err := NewHealthChecker("test", test.config, nil, nil)
+			if (err != nil) != test.err {
+				t.Fatalf("expected error: %v, got %v", test.err, err)
+			}
+			if test.config.Path == "" && hc != nil {
+				t.Errorf("expected no checker when disabled")
+			}
+		})
+	}
+}
+
+func TestHealthCheckStateSurvivesReload(t *testing.T) {
+	healthy, _ := healthTestUpstream(t)
+	failing, status := healthTestUpstream(t)
+	atomic.StoreInt32(status, http.StatusInternalServerError)
+
+	config := &Config{Routes: map[string]ConfigRoute{
+		"api": {
+			Upstreams:   []ConfigUpstream{{Target: healthy.URL}, {Target: failing.URL}},
+			Paths:       []string{"/"},
+			HealthCheck: ConfigHealthCheck{Path: "/health", Interval: time.Hour},
+		},
+	}}
+
+	router := &Router{}
+	load := func() *RouteTree {
+		routeTree, err := NewRouteTree().Load(config)
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		t.Cleanup(routeTree.StopHealthChecks)
+		return routeTree
+	}
+
+	old := load()
+	for i := 0; i < 3; i++ {
+		for _, target := range old.healthCheckers[0].targets {
+			old.healthCheckers[0].check(target)
+		}
+	}
+
+	reloaded := load()
+	router.SetRouteTree(old)
+	router.SetRouteTree(reloaded)
+
+	for _, target := range reloaded.balancers["api"].Targets() {
+		if want := target.URL == healthy.URL; target.Healthy() != want {
+			t.Errorf("%s: healthy = %v after reload, want %v", target.URL, target.Healthy(), want)
+		}
+	}
+}
+
+func TestHealthCheckDuplicateTargets(t *testing.T) {
+	tests := map[string]ConfigRoute{
+		"upstreams":              {Upstreams: []ConfigUpstream{{Target: "http://a:80"}, {Target: "http://a:80"}}},
+		"upstream and upstreams": {Upstream: "http://a:80", Upstreams: []ConfigUpstream{{Target: "http://a:80"}}},
+	}
+
+	for name, entry := range tests {
+		if _, err := routeTargets(entry); err == nil {
+			t.Errorf("%s: expected duplicate targets to be rejected", name)
+		}
+	}
+}
@@ -28,37 +28,46 @@ import (
 const TracingEnabled = "enabled"
 
 func transformHeaders(route *Route, httpObj interface{}) {
-	var transforms ConfigTransformEntry
+	var layers []*HeaderTransform
 	var headers *http.Header
 
 	if req, ok := httpObj.(*http.Request); ok {
 		headers = &req.Header
-		transforms = Settings.Transform.Request
-		log.TraceWithFields("Rewriting Request headers", log.Fields{"route": route, "request.headers": headers})
+		layers = route.Transforms.Request
+		proxyLog.TraceWithFields("Rewriting Request headers", log.Fields{"route": route.Name, "request.headers": headers})
 	} else {
 		headers = &(httpObj.(*http.Response)).Header
-		transforms = Settings.Transform.Response
-		log.TraceWithFields("Rewriting Response headers", log.Fields{"route": route, "response.headers": headers})
+		layers = route.Transforms.Response
+		proxyLog.TraceWithFields("Rewriting Response headers", log.Fields{"route": route.Name, "response.headers": headers})
 	}
 
-	for header, value := range transforms.Insert {
-		headers.Add(header, interpolate(value, route, httpObj))
-		log.TraceWithFields("Adding Header", log.Fields{"header": header, "value.new": headers.Get(header), "value.old": value})
-	}
+	for _, transforms := range layers {
+		for _, rule := range transforms.Insert {
+			headers.Add(rule.Header, rule.Value.Execute(route, httpObj))
+			proxyLog.TraceWithFields("Adding Header", log.Fields{"header": rule.Header, "value.new": headers.Get(rule.Header), "value.old": rule.Value})
+		}
 
-	for header, value := range transforms.Override {
-		headers.Set(header, interpolate(value, route, httpObj))
-		log.TraceWithFields("Overwriting Header", log.Fields{"header": header, "value.new": headers.Get(header), "value.old": value})
-	}
+		for _, rule := range transforms.Override {
+			headers.Set(rule.Header, rule.Value.Execute(route, httpObj))
+			proxyLog.TraceWithFields("Overwriting Header", log.Fields{"header": rule.Header, "value.new": headers.Get(rule.Header), "value.old": rule.Value})
+		}
 
-	for _, header := range transforms.Delete {
-		log.TraceWithFields("Deleting Header", log.Fields{"header": header, "value.old": headers.Get(header)})
-		headers.Del(header)
+		for _, header := range transforms.Delete {
+			proxyLog.TraceWithFields("Deleting Header", log.Fields{"header": header, "value.old": headers.Get(header)})
+			headers.Del(header)
+		}
 	}
 }
 
-func getUpstream(route *Route, req *http.Request) (upstream *url.URL, err error) {
-	upstream, err = url.Parse(interpolate(route.Upstream, route, req))
+func getUpstream(route *Route, target *Target, req *http.Request) (upstream *url.URL, err error) {
+	rendered := target.template.Execute(route, req)
+
+	// allow upstreams like "{{req.host}}", which have no scheme
+	if !strings.Contains(rendered, "://") {
+		rendered = "http://" + rendered
+	}
+
+	upstream, err = url.Parse(rendered)
 	if err != nil {
 		return nil, err
 	}
@@ -100,7 +109,7 @@ func ResponseBodyTracingEnabled(r *http.Response) bool {
 
 func TraceEventData(r interface{}) {
 	if request, ok := r.(*http.Request); ok {
-		log.DebugWithFields("Request Tracing", log.Fields{
+		proxyLog.DebugWithFields("Request Tracing", log.Fields{
 			"header.tracing": RequestHeaderTracingEnabled(request),
 			"body.tracing":   RequestBodyTracingEnabled(request),
 		})
@@ -109,7 +118,7 @@ func TraceEventData(r interface{}) {
 		}
 	} else {
 		response := r.(*http.Response)
-		log.DebugWithFields("Response Tracing", log.Fields{
+		proxyLog.DebugWithFields("Response Tracing", log.Fields{
 			"header.tracing": ResponseHeaderTracingEnabled(response),
 			"body.tracing":   ResponseBodyTracingEnabled(response),
 		})
@@ -125,39 +134,3 @@ func normalizeScheme(scheme string) string {
 	}
 	return "http"
 }
-
-func interpolate(value string, route *Route, httpObj interface{}) string {
-	var ok bool
-	var req *http.Request
-	var resp *http.Response
-
-	if req, ok = httpObj.(*http.Request); !ok {
-		resp = httpObj.(*http.Response)
-		req = resp.Request
-	}
-
-	if strings.Contains(value, `{{route.`) {
-		value = strings.Replace(value, `{{route.name}}`, route.Name, -1)
-		value = strings.Replace(value, `{{route.match}}`, route.MatchedPath, -1)
-	}
-
-	if req != nil && strings.Contains("{{req.header.", value) {
-		for header, values := range req.Header {
-			needle := fmt.Sprintf("{{req.header.%s}}", strings.ToLower(header))
-			if strings.Contains(value, needle) {
-				value = strings.Replace(value, needle, strings.Join(values, ``), -1)
-			}
-		}
-	}
-
-	if resp != nil && strings.Contains("{{res.header.", value) {
-		for header, values := range resp.Header {
-			needle := fmt.Sprintf("{{res.header.%s}}", strings.ToLower(header))
-			if strings.Contains(value, needle) {
-				value = strings.Replace(value, needle, strings.Join(values, ``), -1)
-			}
-		}
-	}
-
-	return value
-}
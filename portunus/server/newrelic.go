@@ -28,21 +28,22 @@ import (
 var nrApp newrelic.Application
 
 func init() {
-	if Settings.NewRelic.Enabled {
+	settings := Settings()
+	if settings.NewRelic.Enabled {
 		nrConfig := newrelic.NewConfig(
-			Settings.NewRelic.AppName,
-			Settings.NewRelic.LicenseKey,
+			settings.NewRelic.AppName,
+			settings.NewRelic.LicenseKey,
 		)
 
-		nrConfig.HostDisplayName = Settings.NewRelic.HostDisplayName
-		nrConfig.Labels = Settings.NewRelic.Labels
-		nrConfig.HighSecurity = Settings.NewRelic.HighSecurity
+		nrConfig.HostDisplayName = settings.NewRelic.HostDisplayName
+		nrConfig.Labels = settings.NewRelic.Labels
+		nrConfig.HighSecurity = settings.NewRelic.HighSecurity
 
-		nrConfig.ErrorCollector.Enabled = Settings.NewRelic.ErrorCollector.Enabled
-		nrConfig.ErrorCollector.IgnoreStatusCodes = Settings.NewRelic.ErrorCollector.IgnoreStatusCodes
+		nrConfig.ErrorCollector.Enabled = settings.NewRelic.ErrorCollector.Enabled
+		nrConfig.ErrorCollector.IgnoreStatusCodes = settings.NewRelic.ErrorCollector.IgnoreStatusCodes
 
-		if Settings.NewRelic.ProxyURL != "" {
-			if proxyURL, err := url.Parse(Settings.NewRelic.ProxyURL); err != nil {
+		if settings.NewRelic.ProxyURL != "" {
+			if proxyURL, err := url.Parse(settings.NewRelic.ProxyURL); err != nil {
 				log.Error(err)
 				// if a proxy is configured, but not a valid URL, then we just log the error
 				// and attempt a setup without the proxy
@@ -50,15 +51,15 @@ func init() {
 				nrConfig.Transport = &http.Transport{
 					Proxy: http.ProxyURL(proxyURL),
 					DialContext: (&net.Dialer{
-						Timeout:   Settings.Network.Timeouts.Connect * time.Second,
-						KeepAlive: Settings.Network.Timeouts.Keepalive * time.Second,
+						Timeout:   settings.Network.Timeouts.Connect * time.Second,
+						KeepAlive: settings.Network.Timeouts.Keepalive * time.Second,
 						DualStack: true,
 					}).DialContext,
 					MaxIdleConns:          50, // We don't use the values from config here because we should
 					MaxIdleConnsPerHost:   10, // only have a few hosts to connect to for NewRelic
-					IdleConnTimeout:       Settings.Network.Timeouts.IdleConnection * time.Second,
-					TLSHandshakeTimeout:   Settings.Network.Timeouts.TLSHandshake * time.Second,
-					ExpectContinueTimeout: Settings.Network.Timeouts.Continue * time.Second,
+					IdleConnTimeout:       settings.Network.Timeouts.IdleConnection * time.Second,
+					TLSHandshakeTimeout:   settings.Network.Timeouts.TLSHandshake * time.Second,
+					ExpectContinueTimeout: settings.Network.Timeouts.Continue * time.Second,
 				}
 			}
 		}
@@ -0,0 +1,195 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type patternKind int
+
+// Pattern kinds, in order of precedence when all else is equal.
+const (
+	patternExact patternKind = iota
+	patternParams
+	patternGlob
+	patternRegex
+)
+
+// PathPattern is a compiled route path. Paths can be:
+//
+//	/exact/path         matches only that path
+//	/users/:id          ":name" matches a single path segment
+//	/files/*rest        "*name" at the end of a path matches everything after it
+//	/foo*, *php*        "*" matches any run of characters, including "/"
+//	~^/v(?P<ver>\d+)/   "~" followed by a regular expression
+//
+// Named parameters and regex groups are captured by name, while unnamed
+// globs and regex groups are captured by their (1-based) group number.
+type PathPattern struct {
+	Source string
+
+	kind          patternKind
+	regex         *regexp.Regexp
+	literalPrefix int
+	literalChars  int
+	dynamicParts  int
+}
+
+var identifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*`)
+
+// CompilePathPattern parses a route path into a pattern.
+func CompilePathPattern(source string) (*PathPattern, error) {
+	if strings.HasPrefix(source, "~") {
+		return compileRegexPattern(source)
+	}
+
+	pattern := &PathPattern{Source: source, kind: patternExact}
+	path := normalizePath(source)
+
+	var expr strings.Builder
+	expr.WriteString("^")
+
+	inPrefix := true
+	for idx := 0; idx < len(path); {
+		char := path[idx]
+		atSegmentStart := idx > 0 && path[idx-1] == '/'
+
+		switch {
+		case char == ':' && atSegmentStart && identifierRegex.MatchString(path[idx+1:]):
+			name := identifierRegex.FindString(path[idx+1:])
+			fmt.Fprintf(&expr, "(?P<%s>[^/]+)", name)
+			pattern.setKind(patternParams)
+			pattern.dynamicParts++
+			inPrefix = false
+			idx += len(name) + 1
+
+		case char == '*' && atSegmentStart && identifierRegex.FindString(path[idx+1:]) == path[idx+1:] && idx+1 < len(path):
+			// a named splat, which must be the last thing in the path
+			fmt.Fprintf(&expr, "(?P<%s>.*)", path[idx+1:])
+			pattern.setKind(patternGlob)
+			pattern.dynamicParts++
+			inPrefix = false
+			idx = len(path)
+
+		case char == '*':
+			expr.WriteString("(.*)")
+			pattern.setKind(patternGlob)
+			pattern.dynamicParts++
+			inPrefix = false
+			idx++
+
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(char)))
+			pattern.literalChars++
+			if inPrefix {
+				pattern.literalPrefix++
+			}
+			idx++
+		}
+	}
+
+	expr.WriteString("$")
+
+	regex, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid path %q: %s", source, err)
+	}
+	pattern.regex = regex
+
+	return pattern, nil
+}
+
+func compileRegexPattern(source string) (*PathPattern, error) {
+	regex, err := regexp.Compile(source[1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid path regex %q: %s", source, err)
+	}
+
+	// LiteralPrefix doesn't look past a leading ^, and without one the regex
+	// isn't anchored, so its literal text isn't really a prefix
+	var prefix string
+	if strings.HasPrefix(source, "~^") {
+		if unanchored, err := regexp.Compile(source[2:]); err == nil {
+			prefix, _ = unanchored.LiteralPrefix()
+		}
+	}
+
+	return &PathPattern{
+		Source:        source,
+		kind:          patternRegex,
+		regex:         regex,
+		literalPrefix: len(prefix),
+		literalChars:  len(prefix),
+		dynamicParts:  regex.NumSubexp() + 1,
+	}, nil
+}
+
+func (p *PathPattern) setKind(kind patternKind) {
+	if kind > p.kind {
+		p.kind = kind
+	}
+}
+
+// Match reports whether the path matches the pattern, along with any captures.
+func (p *PathPattern) Match(path string) (map[string]string, bool) {
+	matches := p.regex.FindStringSubmatch(path)
+	if matches == nil {
+		return nil, false
+	}
+
+	if len(matches) == 1 {
+		return nil, true
+	}
+
+	params := make(map[string]string, len(matches)-1)
+	for idx, name := range p.regex.SubexpNames() {
+		if idx == 0 {
+			continue
+		} else if name == "" {
+			name = strconv.Itoa(idx)
+		}
+		params[name] = matches[idx]
+	}
+
+	return params, true
+}
+
+// MoreSpecificThan reports whether the pattern should be tried before the other
+// one. Patterns are ranked by:
+//
+//  1. the longest literal prefix (e.g., "/api/v1/*" before "/api/*")
+//  2. the most literal characters overall ("/users/:id/edit" before "/users/*")
+//  3. kind: exact paths, then named parameters, then globs, then regexes
+//  4. the fewest dynamic parts
+//  5. the pattern itself, alphabetically, so the order is always stable
+func (p *PathPattern) MoreSpecificThan(other *PathPattern) bool {
+	switch {
+	case p.literalPrefix != other.literalPrefix:
+		return p.literalPrefix > other.literalPrefix
+	case p.literalChars != other.literalChars:
+		return p.literalChars > other.literalChars
+	case p.kind != other.kind:
+		return p.kind < other.kind
+	case p.dynamicParts != other.dynamicParts:
+		return p.dynamicParts < other.dynamicParts
+	default:
+		return p.Source < other.Source
+	}
+}
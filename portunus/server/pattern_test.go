@@ -0,0 +1,249 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPathPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+		params  map[string]string
+	}{
+		{"/users/me", "/users/me", true, nil},
+		{"users/me", "/users/me", true, nil},
+		{"/users/me", "/users/me/", false, nil},
+		{"/users/:id", "/users/42", true, map[string]string{"id": "42"}},
+		{"/users/:id", "/users/42/edit", false, nil},
+		{"/users/:id", "/users/", false, nil},
+		{"/users/:id/posts/:post", "/users/42/posts/7", true, map[string]string{"id": "42", "post": "7"}},
+		{"/files/*rest", "/files/a/b/c.txt", true, map[string]string{"rest": "a/b/c.txt"}},
+		{"/files/*rest", "/files/", true, map[string]string{"rest": ""}},
+		{"/foo*", "/foobar/baz", true, map[string]string{"1": "bar/baz"}},
+		{"*php*", "/index.php?x", true, map[string]string{"1": "index.", "2": "?x"}},
+		{"/a*b*c", "/a1b2c", true, map[string]string{"1": "1", "2": "2"}},
+		// ":" and "*" mid-segment are literal and a glob respectively
+		{"/a:b", "/a:b", true, nil},
+		{"/a.b", "/axb", false, nil},
+		{"~^/v(?P<ver>[0-9]+)/", "/v2/users", true, map[string]string{"ver": "2"}},
+		{"~^/v([0-9]+)/", "/v2/users", true, map[string]string{"1": "2"}},
+		{"~\\.json$", "/users/42.json", true, nil},
+		{"~^/v[0-9]+/", "/vx/users", false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern+" "+test.path, func(t *testing.T) {
+			pattern, err := CompilePathPattern(test.pattern)
+			if err != nil {
+				t.Fatalf("CompilePathPattern: %v", err)
+			}
+
+			params, ok := pattern.Match(test.path)
+			if ok != test.match {
+				t.Fatalf("match = %v, want %v", ok, test.match)
+			}
+			if !reflect.DeepEqual(params, test.params) {
+				t.Errorf("params = %v, want %v", params, test.params)
+			}
+		})
+	}
+}
+
+func TestPathPatternErrors(t *testing.T) {
+	for _, source := range []string{"~^/v(", "~[z-a]", "~a{2,1}"} {
+		if _, err := CompilePathPattern(source); err == nil {
+			t.Errorf("%s: expected an error", source)
+		}
+	}
+}
+
+func TestPathPatternRanking(t *testing.T) {
+	tests := []struct {
+		rule         string
+		more, less   string
+		overlapsWith string // a path both patterns match
+	}{
+		// 1. the longest literal prefix
+		{"literal prefix", "/api/v1/*", "/api/*", "/api/v1/users"},
+		{"literal prefix", "/api/v1/*", "~^/api/", "/api/v1/users"},
+		{"literal prefix", "~^/api/v[0-9]+/", "/api/*", "/api/v2/users"},
+		{"literal prefix", "/users/me", "/users/:id", "/users/me"},
+		{"literal prefix", "/foobarbaz*", "/foo*", "/foobarbazz"},
+		{"literal prefix", "/foo*", "*php*", "/foo.php"},
+
+		// 2. the most literal characters overall
+		{"literal chars", "/users/:id/edit", "/users/*", "/users/42/edit"},
+		{"literal chars", "/users/:id/edit", "/users/:id/*rest", "/users/42/edit"},
+		{"literal chars", "*php*", "*", "/index.php"},
+
+		// 3. exact, then named parameters, then globs, then regexes
+		{"kind", "/users/", "/users/:id", ""},
+		{"kind", "/users/:id", "/users/*", "/users/42"},
+		{"kind", "/users/:id", "/users/*rest", "/users/42"},
+		{"kind", "/users/*", "~^/users/", "/users/42"},
+
+		// 4. the fewest dynamic parts
+		{"dynamic parts", "/*", "/**", "/anything"},
+
+		// 5. alphabetically
+		{"source", "/*a*", "/*b*", "/ab"},
+		{"source", "/a/*", "/b/*", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.rule+" "+test.more+" "+test.less, func(t *testing.T) {
+			more, err := CompilePathPattern(test.more)
+			if err != nil {
+				t.Fatalf("CompilePathPattern(%q): %v", test.more, err)
+			}
+			less, err := CompilePathPattern(test.less)
+			if err != nil {
+				t.Fatalf("CompilePathPattern(%q): %v", test.less, err)
+			}
+
+			if !more.MoreSpecificThan(less) {
+				t.Errorf("%s should be more specific than %s", test.more, test.less)
+			}
+			if less.MoreSpecificThan(more) {
+				t.Errorf("%s shouldn't be more specific than %s", test.less, test.more)
+			}
+
+			if test.overlapsWith != "" {
+				if _, ok := more.Match(test.overlapsWith); !ok {
+					t.Errorf("%s doesn't match %s", test.more, test.overlapsWith)
+				}
+				if _, ok := less.Match(test.overlapsWith); !ok {
+					t.Errorf("%s doesn't match %s", test.less, test.overlapsWith)
+				}
+			}
+		})
+	}
+}
+
+func TestRouteTreeOverlappingPatterns(t *testing.T) {
+	paths := map[string]string{
+		"catchall": "*",
+		"foo":      "/foo*",
+		"foobar":   "/foobarbaz*",
+		"php":      "*php*",
+		"users":    "/users/:id/*rest",
+		"useredit": "/users/:id/edit",
+		"usersall": "/users/*",
+		"userid":   "/users/:id",
+		"me":       "/users/me/edit",
+		"version":  "~^/v(?P<ver>[0-9]+)/",
+		"v1":       "/v1/*",
+		"json":     "~\\.json$",
+	}
+
+	config := &Config{Routes: map[string]ConfigRoute{}}
+	for name, path := range paths {
+		config.Routes[name] = ConfigRoute{Upstream: "http://upstream", Paths: []string{path}}
+	}
+
+	routeTree, err := NewRouteTree().Load(config)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	tests := []struct {
+		path   string
+		route  string
+		params map[string]string
+	}{
+		{"/", "catchall", map[string]string{"1": ""}},
+		{"/foo", "foo", map[string]string{"1": ""}},
+		{"/foobarbazz", "foobar", map[string]string{"1": "z"}},
+		// "/foo*" has the longer literal prefix
+		{"/foo.php", "foo", map[string]string{"1": ".php"}},
+		{"/index.php", "php", map[string]string{"1": "index.", "2": ""}},
+		{"/users/me/edit", "me", nil},
+		{"/users/42/edit", "useredit", map[string]string{"id": "42"}},
+		{"/users/42/posts/7", "users", map[string]string{"id": "42", "rest": "posts/7"}},
+		// a named parameter beats a glob with as many literal characters
+		{"/users/42", "userid", map[string]string{"id": "42"}},
+		{"/users/", "usersall", map[string]string{"1": ""}},
+		{"/v1/users", "v1", map[string]string{"1": "users"}},
+		{"/v2/users", "version", map[string]string{"ver": "2"}},
+		// the regex has no literal prefix, so even the catch all goes first
+		{"/data/42.json", "catchall", map[string]string{"1": "data/42.json"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			route, params, ok := routeTree.Lookup("example.com", test.path)
+			if !ok {
+				t.Fatalf("no route found, want %s", test.route)
+			}
+			if route.Name != test.route {
+				t.Errorf("route = %s (%s), want %s (%s)", route.Name, paths[route.Name], test.route, paths[test.route])
+			}
+			if !reflect.DeepEqual(params, test.params) {
+				t.Errorf("params = %v, want %v", params, test.params)
+			}
+		})
+	}
+}
+
+func TestRouteTreeRegexWithoutCatchAll(t *testing.T) {
+	config := &Config{Routes: map[string]ConfigRoute{
+		"json":  {Upstream: "http://upstream", Paths: []string{"~\\.json$"}},
+		"users": {Upstream: "http://upstream", Paths: []string{"/users/:id"}},
+	}}
+
+	routeTree, err := NewRouteTree().Load(config)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	for path, want := range map[string]string{
+		"/users/42.json": "users",
+		"/data/42.json":  "json",
+	} {
+		if route, _, ok := routeTree.Lookup("example.com", path); !ok || route.Name != want {
+			t.Errorf("%s: got %v, want %s", path, route, want)
+		}
+	}
+
+	if _, _, ok := routeTree.Lookup("example.com", "/data/42.xml"); ok {
+		t.Errorf("/data/42.xml: expected no route")
+	}
+}
+
+func TestRouteTreeDuplicatePattern(t *testing.T) {
+	config := &Config{Routes: map[string]ConfigRoute{
+		"one": {Upstream: "http://upstream", Paths: []string{"/foo*"}},
+		"two": {Upstream: "http://upstream", Paths: []string{"/foo*"}},
+	}}
+
+	if _, err := NewRouteTree().Load(config); err == nil {
+		t.Error("expected routes with the same path to conflict")
+	}
+
+	// written differently, equivalent patterns fall back to the source order
+	config.Routes["two"] = ConfigRoute{Upstream: "http://upstream", Paths: []string{"foo*"}}
+	routeTree, err := NewRouteTree().Load(config)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if route, _, ok := routeTree.Lookup("example.com", "/foobar"); !ok || route.Name != "one" {
+		t.Errorf("got %v, want one", route)
+	}
+}
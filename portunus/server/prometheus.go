@@ -0,0 +1,556 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPrometheusMaxUpstreams = 100
+
+	// label value used for upstreams past the max_upstreams limit
+	overflowLabel = "other"
+)
+
+// default histogram buckets, in seconds
+var prometheusBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	promRequests = newCounterVec("portunus_requests_total",
+		"Requests handled, by route, upstream, method and status class.",
+		"route", "upstream", "method", "status_class")
+	promRequestDuration = newHistogramVec("portunus_request_duration_seconds",
+		"Time taken to handle requests, by route, upstream, method and status class.",
+		"route", "upstream", "method", "status_class")
+	promGRPCRequests = newCounterVec("portunus_grpc_requests_total",
+		"gRPC requests handled, by route and the gRPC status sent to the client.",
+		"route", "grpc_status")
+	promUpstreamRequests = newCounterVec("portunus_upstream_requests_total",
+		"Upstream request attempts, by route, upstream and status class (error when no response was received).",
+		"route", "upstream", "status_class")
+	promUpstreamConnect = newHistogramVec("portunus_upstream_connect_duration_seconds",
+		"Time taken to dial new upstream connections.",
+		"route", "upstream")
+	promUpstreamTLSHandshake = newHistogramVec("portunus_upstream_tls_handshake_duration_seconds",
+		"Time taken by the TLS handshake of new upstream connections.",
+		"route", "upstream")
+	promUpstreamFirstByte = newHistogramVec("portunus_upstream_first_byte_duration_seconds",
+		"Time from sending an upstream request to receiving the first byte of its response.",
+		"route", "upstream")
+	promUpstreamConnections = newGaugeVec("portunus_upstream_connections_open",
+		"Open upstream connections, whether in use or idle in the pool.",
+		"upstream")
+	promUpstreamConnectionsInUse = newGaugeVec("portunus_upstream_connections_in_use",
+		"Upstream requests currently holding a pooled connection.",
+		"upstream")
+	promRateLimited = newCounterVec("portunus_rate_limited_total",
+		"Requests rejected by a rate limit, by route and limit.",
+		"route", "limit")
+	promConcurrencyLimit = newGaugeVec("portunus_concurrency_limit",
+		"Current concurrency limit, by route and upstream (empty for route wide limits).",
+		"route", "upstream")
+	promConcurrencyQueued = newGaugeVec("portunus_concurrency_queue_depth",
+		"Requests waiting for a concurrency slot, by route and upstream (empty for route wide limits).",
+		"route", "upstream")
+	promConcurrencyRejected = newCounterVec("portunus_concurrency_rejected_total",
+		"Requests turned away by a concurrency limit, by route, upstream and reason (queue_full or max_wait).",
+		"route", "upstream", "reason")
+	promTunnels = newGaugeVec("portunus_tunnels_open",
+		"Open upgraded (e.g., WebSocket) connections, by route.",
+		"route")
+	promTunnelsClosed = newCounterVec("portunus_tunnels_closed_total",
+		"Upgraded connections closed, by route and reason (closed, idle_timeout, max_lifetime or shutdown).",
+		"route", "reason")
+	promCertificateExpiry = newGaugeVec("portunus_tls_certificate_expiry_days",
+		"Days until each of the listener's TLS certificates expires.",
+		"name", "file")
+)
+
+// promMetric is anything that can write itself out in the Prometheus text
+// exposition format.
+type promMetric interface {
+	writeTo(w *bufio.Writer)
+}
+
+// promRegistry holds every Prometheus metric, in the order they're written.
+var promRegistry []promMetric
+
+// promSeries is the label values of a single series of a metric vector.
+type promSeries []string
+
+func (s promSeries) key() string {
+	return strings.Join(s, "\xff")
+}
+
+func formatLabels(names []string, values promSeries, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for idx, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabelValue(values[idx])+`"`)
+	}
+	for idx := 0; idx+1 < len(extra); idx += 2 {
+		pairs = append(pairs, extra[idx]+`="`+escapeLabelValue(extra[idx+1])+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// promVec is the shared bookkeeping of counter, gauge and histogram vectors.
+type promVec struct {
+	mutex  sync.Mutex
+	name   string
+	help   string
+	kind   string
+	labels []string
+	series map[string]promSeries
+}
+
+func (v *promVec) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+}
+
+// sortedKeys returns the vector's series keys in a stable order. Callers must
+// hold the mutex.
+func (v *promVec) sortedKeys() []string {
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec is a Prometheus counter, partitioned by label values.
+type CounterVec struct {
+	promVec
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *CounterVec {
+	counter := &CounterVec{
+		promVec: promVec{name: name, help: help, kind: "counter", labels: labels, series: make(map[string]promSeries)},
+		values:  make(map[string]float64),
+	}
+	promRegistry = append(promRegistry, counter)
+	return counter
+}
+
+// Add increments the counter for the given label values.
+func (c *CounterVec) Add(delta float64, labels ...string) {
+	series := promSeries(labels)
+	key := series.key()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.series[key] = series
+	c.values[key] += delta
+}
+
+func (c *CounterVec) writeTo(w *bufio.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.writeHeader(w)
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, c.series[key]), formatFloat(c.values[key]))
+	}
+}
+
+// GaugeVec is a Prometheus gauge, partitioned by label values.
+type GaugeVec struct {
+	promVec
+	values map[string]float64
+
+	// refreshes the gauge before it's written, if set
+	collect func()
+}
+
+func newGaugeVec(name, help string, labels ...string) *GaugeVec {
+	gauge := &GaugeVec{
+		promVec: promVec{name: name, help: help, kind: "gauge", labels: labels, series: make(map[string]promSeries)},
+		values:  make(map[string]float64),
+	}
+	promRegistry = append(promRegistry, gauge)
+	return gauge
+}
+
+// Add adds the (possibly negative) delta to the gauge for the label values.
+func (g *GaugeVec) Add(delta float64, labels ...string) {
+	series := promSeries(labels)
+	key := series.key()
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.series[key] = series
+	g.values[key] += delta
+}
+
+// Set sets the gauge for the given label values.
+func (g *GaugeVec) Set(value float64, labels ...string) {
+	series := promSeries(labels)
+	key := series.key()
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.series[key] = series
+	g.values[key] = value
+}
+
+// Reset removes every series from the gauge.
+func (g *GaugeVec) Reset() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.series = make(map[string]promSeries)
+	g.values = make(map[string]float64)
+}
+
+// SetCollector sets a function that's called to refresh the gauge each time
+// it's scraped, for values that are derived rather than tracked.
+func (g *GaugeVec) SetCollector(collect func()) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.collect = collect
+}
+
+// Value returns the gauge's current value for the given label values.
+func (g *GaugeVec) Value(labels ...string) float64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.values[promSeries(labels).key()]
+}
+
+func (g *GaugeVec) writeTo(w *bufio.Writer) {
+	g.mutex.Lock()
+	collect := g.collect
+	g.mutex.Unlock()
+
+	if collect != nil {
+		collect()
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.writeHeader(w)
+	for _, key := range g.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, g.series[key]), formatFloat(g.values[key]))
+	}
+}
+
+type histogramValue struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a Prometheus histogram, partitioned by label values.
+type HistogramVec struct {
+	promVec
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+func newHistogramVec(name, help string, labels ...string) *HistogramVec {
+	histogram := &HistogramVec{
+		promVec: promVec{name: name, help: help, kind: "histogram", labels: labels, series: make(map[string]promSeries)},
+		buckets: prometheusBuckets,
+		values:  make(map[string]*histogramValue),
+	}
+	promRegistry = append(promRegistry, histogram)
+	return histogram
+}
+
+// Observe records a value (in seconds, for durations) for the label values.
+func (h *HistogramVec) Observe(value float64, labels ...string) {
+	series := promSeries(labels)
+	key := series.key()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+		h.values[key] = hv
+	}
+
+	if idx := sort.SearchFloat64s(h.buckets, value); idx < len(h.buckets) {
+		hv.counts[idx]++
+	}
+	hv.count++
+	hv.sum += value
+}
+
+func (h *HistogramVec) writeTo(w *bufio.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.writeHeader(w)
+	for _, key := range h.sortedKeys() {
+		series, hv := h.series[key], h.values[key]
+
+		var cumulative uint64
+		for idx, bound := range h.buckets {
+			cumulative += hv.counts[idx]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, series, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, series, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, series), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, series), hv.count)
+	}
+}
+
+// labelLimiter bounds the number of distinct values a label can take. Values
+// are admitted on first use until the limit is reached, after which any new
+// value is reported as "other". Admitted values are kept for the life of the
+// process, so a series never switches between its own value and "other".
+type labelLimiter struct {
+	mutex sync.Mutex
+	seen  map[string]bool
+}
+
+func (l *labelLimiter) value(value string, max int) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.seen[value] {
+		return value
+	} else if len(l.seen) >= max {
+		return overflowLabel
+	}
+
+	if l.seen == nil {
+		l.seen = make(map[string]bool)
+	}
+	l.seen[value] = true
+
+	return value
+}
+
+var upstreamLabels labelLimiter
+
+// upstreamLabel returns the label value for an upstream address, bounded by
+// metrics.prometheus.max_upstreams so that templated upstreams can't create
+// an unbounded number of series. Default ports (80 and 443) are dropped, so
+// that the upstream's host and the address dialed for it share a label.
+func upstreamLabel(address string) string {
+	if address == "" {
+		return ""
+	}
+
+	if host, port, err := net.SplitHostPort(address); err == nil && (port == "80" || port == "443") {
+		address = host
+	}
+
+	max := Settings().Metrics.Prometheus.MaxUpstreams
+	if max <= 0 {
+		max = DefaultPrometheusMaxUpstreams
+	}
+
+	return upstreamLabels.value(address, max)
+}
+
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+// methodLabel returns the request method, or "OTHER" for non-standard ones.
+func methodLabel(method string) string {
+	if method = strings.ToUpper(method); knownMethods[method] {
+		return method
+	}
+	return "OTHER"
+}
+
+// statusClassLabel returns the status class (e.g., "2xx"), or "error" when no
+// response was received.
+func statusClassLabel(status int) string {
+	if status < 100 || status > 599 {
+		return "error"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+func writePrometheus(w io.Writer) error {
+	buffer := bufio.NewWriter(w)
+	for _, metric := range promRegistry {
+		metric.writeTo(buffer)
+	}
+	return buffer.Flush()
+}
+
+func prometheusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !Settings().Metrics.Prometheus.Enabled {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writePrometheus(w)
+	}
+}
+
+// upstreamTrace records the connection timings of a single upstream request,
+// and keeps the in-use connection gauge up to date.
+type upstreamTrace struct {
+	mutex        sync.Mutex
+	route        string
+	upstream     string
+	start        time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	gotConn      bool
+	done         bool
+}
+
+func newUpstreamTrace(route, upstream string) *upstreamTrace {
+	return &upstreamTrace{route: route, upstream: upstreamLabel(upstream)}
+}
+
+// WithContext returns a copy of the context that reports to the trace, and
+// marks the start of the request.
+func (t *upstreamTrace) WithContext(ctx context.Context) context.Context {
+	t.start = time.Now()
+
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			if err == nil && !t.connectStart.IsZero() {
+				promUpstreamConnect.Observe(time.Since(t.connectStart).Seconds(), t.route, t.upstream)
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			if err == nil && !t.tlsStart.IsZero() {
+				promUpstreamTLSHandshake.Observe(time.Since(t.tlsStart).Seconds(), t.route, t.upstream)
+			}
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			if !t.gotConn {
+				t.gotConn = true
+				promUpstreamConnectionsInUse.Add(1, t.upstream)
+			}
+		},
+		GotFirstResponseByte: func() {
+			promUpstreamFirstByte.Observe(time.Since(t.start).Seconds(), t.route, t.upstream)
+		},
+	})
+}
+
+// Done records the outcome of the request, and releases its connection from
+// the in-use gauge. It must be called once the response body is closed (or
+// the request failed); calls after the first are ignored.
+func (t *upstreamTrace) Done(status int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.done {
+		return
+	}
+	t.done = true
+
+	promUpstreamRequests.Add(1, t.route, t.upstream, statusClassLabel(status))
+
+	if t.gotConn {
+		t.gotConn = false
+		promUpstreamConnectionsInUse.Add(-1, t.upstream)
+	}
+}
+
+// countedConn keeps the open connection gauge up to date.
+type countedConn struct {
+	net.Conn
+	upstream  string
+	closeOnce sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() { promUpstreamConnections.Add(-1, c.upstream) })
+	return c.Conn.Close()
+}
+
+// countConnections wraps a dial function so that the connections it opens are
+// counted, per upstream, until they're closed.
+func countConnections(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		upstream := upstreamLabel(addr)
+		promUpstreamConnections.Add(1, upstream)
+
+		return &countedConn{Conn: conn, upstream: upstream}, nil
+	}
+}
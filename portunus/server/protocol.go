@@ -0,0 +1,123 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// upstream protocols
+const (
+	ProtocolHTTP1 = "http1"
+	ProtocolH2    = "h2"  // HTTP/2 over TLS
+	ProtocolH2C   = "h2c" // cleartext HTTP/2, with prior knowledge
+)
+
+// upstreamTransport is a transport to the upstreams of one or more routes.
+type upstreamTransport interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// parseUpstreamProtocol normalizes the route's upstream protocol, defaulting
+// to HTTP/1.1.
+func parseUpstreamProtocol(protocol string) (string, error) {
+	switch strings.ToLower(protocol) {
+	case "", ProtocolHTTP1, "http/1.1":
+		return ProtocolHTTP1, nil
+	case ProtocolH2, "http2":
+		return ProtocolH2, nil
+	case ProtocolH2C:
+		return ProtocolH2C, nil
+	}
+	return "", fmt.Errorf("unknown upstream protocol %q", protocol)
+}
+
+// checkUpstreamScheme returns an error if the target can't be reached with
+// the protocol: h2 needs an https upstream, and h2c an http one. Templated
+// targets can only be checked once rendered.
+func checkUpstreamScheme(target *Target, protocol string) error {
+	if target.IsTemplated() || protocol == ProtocolHTTP1 {
+		return nil
+	}
+
+	upstream, err := url.Parse(target.URL)
+	if err != nil || !strings.Contains(target.URL, "://") {
+		return nil
+	}
+
+	if protocol == ProtocolH2 && upstream.Scheme != "https" {
+		return fmt.Errorf("upstream %s: h2 requires an https upstream (use h2c for cleartext)", target.URL)
+	} else if protocol == ProtocolH2C && upstream.Scheme == "https" {
+		return fmt.Errorf("upstream %s: h2c requires an http upstream (use h2 over TLS)", target.URL)
+	}
+
+	return nil
+}
+
+// NewUpstreamTransport builds a transport speaking the given protocol, using
+// the TLS client config (nil for the defaults) for https upstreams, and the
+// route's connect and idle connection timeouts.
+func NewUpstreamTransport(config *Config, tlsConfig *tls.Config, protocol string, timeouts RouteTimeouts) upstreamTransport {
+	if protocol != ProtocolH2 && protocol != ProtocolH2C {
+		return NewTransport(config, tlsConfig, timeouts)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   timeouts.Connect,
+		KeepAlive: config.Network.Timeouts.Keepalive,
+	}
+
+	transport := &http2.Transport{
+		TLSClientConfig: tlsConfig,
+		IdleConnTimeout: timeouts.IdleConnection,
+	}
+
+	if protocol == ProtocolH2C {
+		// prior knowledge: speak HTTP/2 straight away over a plain connection
+		transport.AllowHTTP = true
+		dial := countConnections(dialer.DialContext)
+		transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		}
+	} else {
+		transport.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			tlsDialer := &tls.Dialer{NetDialer: dialer, Config: cfg}
+			return countConnections(tlsDialer.DialContext)(ctx, network, addr)
+		}
+	}
+
+	return transport
+}
+
+// listenerHandler wraps the listener's handler to accept cleartext HTTP/2
+// (h2c) alongside HTTP/1.1, if enabled. h2c only applies without TLS; over
+// TLS, HTTP/2 is negotiated with ALPN (see server.http2.enabled).
+func listenerHandler(config *Config, handler http.Handler) http.Handler {
+	if !config.Server.HTTP2.H2C || config.Server.TLS.Enabled {
+		return handler
+	}
+	return h2c.NewHandler(handler, &http2.Server{IdleTimeout: config.Network.Timeouts.IdleConnection})
+}
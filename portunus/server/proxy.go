@@ -17,19 +17,25 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	log "github.com/rabbitt/portunus/portunus/logging"
+	"github.com/rabbitt/portunus/portunus/tracing"
 )
 
 var (
 	ErrorNotResolvable = errors.New("Unable to resolve ip")
+
+	proxyLog = log.Named("proxy")
 )
 
 type ProxyTransport struct {
@@ -40,13 +46,28 @@ func NewProxyTransport(server *Server) *ProxyTransport {
 	return &ProxyTransport{server: server}
 }
 
+// NewNonChunkedRequest returns a copy of the request with its body read into
+// memory, so that it's sent upstream with a Content-Length rather than
+// chunked, and can be replayed (via GetBody) should the request be retried.
 func NewNonChunkedRequest(method, url string, r *http.Request) (newRequest *http.Request, err error) {
-	if r.Body == http.NoBody {
-		if newRequest, err = http.NewRequest(method, url, r.Body); err != nil {
-			return nil, err
-		}
-		copyHeaders(r.Header, newRequest.Header)
-		return
+	var target *http.Request
+	if target, err = http.NewRequest(method, url, nil); err != nil {
+		return nil, err
+	}
+
+	// start from a copy of the original, so that details like the remote
+	// address, TLS state and context carry over
+	newRequest = r.WithContext(r.Context())
+	newRequest.Method = target.Method
+	newRequest.URL = target.URL
+	newRequest.TransferEncoding = nil
+	newRequest.Header = make(http.Header)
+	copyHeaders(r.Header, newRequest.Header)
+
+	if r.Body == nil || r.Body == http.NoBody {
+		newRequest.Body = http.NoBody
+		newRequest.ContentLength = 0
+		return newRequest, nil
 	}
 
 	var buf bytes.Buffer
@@ -58,36 +79,41 @@ func NewNonChunkedRequest(method, url string, r *http.Request) (newRequest *http
 		return nil, err
 	}
 
-	newBody := ioutil.NopCloser(bytes.NewReader(buf.Bytes()))
-	if newRequest, err = http.NewRequest(method, url, newBody); err != nil {
-		return nil, err
+	body := buf.Bytes()
+	newRequest.Body = ioutil.NopCloser(bytes.NewReader(body))
+	newRequest.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
 	}
-
-	newRequest.ContentLength = int64(buf.Len())
-	copyHeaders(r.Header, newRequest.Header)
+	newRequest.ContentLength = int64(len(body))
 
 	return newRequest, nil
 }
 
 func notFoundResponse(req *http.Request) *http.Response {
-	code := Settings.Response.NotFound.Code
-	body := Settings.Response.NotFound.Body
-	return &http.Response{
-		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
-		StatusCode:    code,
-		Proto:         "HTTP/1.1",
-		ProtoMajor:    1,
-		ProtoMinor:    1,
-		Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
-		ContentLength: int64(len(body)),
-		Request:       req,
-		Header:        make(http.Header, 0),
-	}
+	return errorResponse(req, Settings().Response.NotFound)
 }
 
 func internalServerErrorResponse(req *http.Request) *http.Response {
-	code := Settings.Response.ServerError.Code
-	body := Settings.Response.ServerError.Body
+	return errorResponse(req, Settings().Response.ServerError)
+}
+
+func serviceUnavailableResponse(req *http.Request) *http.Response {
+	return errorResponse(req, Settings().Response.ServiceUnavailable)
+}
+
+func gatewayTimeoutResponse(req *http.Request) *http.Response {
+	return errorResponse(req, Settings().Response.GatewayTimeout)
+}
+
+// errorResponse returns the configured response, or for gRPC requests, the
+// equivalent gRPC status.
+func errorResponse(req *http.Request, entry ConfigResponseEntry) *http.Response {
+	if isGRPCRequest(req) {
+		return grpcErrorResponse(req, grpcStatusForHTTP(entry.Code), http.StatusText(entry.Code))
+	}
+
+	code := entry.Code
+	body := entry.Body
 	return &http.Response{
 		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
 		StatusCode:    code,
@@ -102,25 +128,286 @@ func internalServerErrorResponse(req *http.Request) *http.Response {
 }
 
 func (pt *ProxyTransport) RoundTrip(request *http.Request) (*http.Response, error) {
-	var route *Route
+	// Determine the route to proxy the request with
+	_, lookupSpan := pt.server.startSpan(request.Context(), "route lookup", tracing.SpanKindInternal)
+	route, params, ok := pt.server.router.RouteTree().Lookup(request.Host, request.URL.Path)
+	lookupSpan.SetAttribute("portunus.route.matched", ok)
+	if ok {
+		lookupSpan.SetAttribute("portunus.route", route.Name)
+	}
+	lookupSpan.End()
+
+	if !ok {
+		return notFoundResponse(request), nil
+	}
+
+	state := getRequestState(request)
+	state.Route = route
+	state.Params = params
+
+	if route.RequireClientCert && clientCertificate(request) == nil {
+		proxyLog.WarnWithFields("Rejecting request without a client certificate", log.Fields{
+			"route": route.Name, "remote.addr": request.RemoteAddr,
+		})
+		return clientCertRequiredResponse(request), nil
+	}
+
+	if limit, result := TakeRateLimits(pt.server.rateLimits, route.RateLimits, route, request); limit != nil {
+		proxyLog.DebugWithFields("Rate limited request", log.Fields{
+			"route": route.Name, "limit": limit.Name, "remote.addr": request.RemoteAddr,
+		})
+		promRateLimited.Add(1, route.Name, limit.Name)
+		return limit.Response(route, request, result), nil
+	}
+
+	upgrade := upgradeType(request)
+	if upgrade != "" && !route.Upgrade.Allows(upgrade) {
+		proxyLog.DebugWithFields("Ignoring protocol upgrade the route doesn't allow", log.Fields{
+			"route": route.Name, "upgrade": upgrade,
+		})
+		request = request.WithContext(request.Context())
+		request.Header = request.Header.Clone()
+		stripUpgrade(request)
+		upgrade = ""
+	}
+
+	// the total timeout and a route wide concurrency slot span every attempt
+	// and the response body, so they're only released here if there's no
+	// upstream response to stream. Tunnels have their own limits instead.
+	cancelTotal := func() {}
+	releaseSlot := func(time.Duration) {}
+	if upgrade == "" {
+		request, cancelTotal = route.Timeouts.withTotal(request)
+	}
+	if upgrade == "" && !route.Concurrency.PerUpstream() {
+		var err error
+		if releaseSlot, err = route.Concurrency.Get("").Acquire(request.Context()); err != nil {
+			cancelTotal()
+			return concurrencyLimitedResponse(route, request, err)
+		}
+	}
+
+	started := time.Now()
+	var latency time.Duration
+	done := func() {
+		cancelTotal()
+		releaseSlot(latency)
+	}
+	streaming := false
+	defer func() {
+		if !streaming {
+			done()
+		}
+	}()
+
+	// response transforms see the request as the client sent it, rather than
+	// as it was rewritten for the upstream
+	clientRequest := request
+	request = route.Rewrite.Apply(route, request)
+
+	// keep a copy so that each attempt starts out with the original headers
+	var reqHeaders = make(http.Header)
+	copyHeaders(request.Header, reqHeaders)
+
+	// aggregation must come after the rewrite, so the buffered request is
+	// built from the rewritten url. Upgrade requests are passed through as
+	// is, since their body is the tunnel.
+	if route.AggregateRequestChunks() && upgrade == "" {
+		switch strings.ToUpper(request.Method) {
+		case "POST", "PUT":
+			if req, err := NewNonChunkedRequest(request.Method, request.URL.String(), request); err == nil {
+				request = req
+			} else {
+				proxyLog.ErrorWithFields("Unable to create request; using original", log.Fields{"error": err})
+			}
+		}
+	}
+
+	var tried []*Target
+	maxAttempts := route.Retry.AttemptsFor(request)
+
+	for attempt := 1; ; attempt++ {
+		// prefer a target that hasn't been tried yet, but fall back to one that
+		// has if there's nothing else available
+		target := route.Balancer.Next(request, tried...)
+		if target == nil && len(tried) > 0 {
+			target = route.Balancer.Next(request)
+		}
+
+		if target == nil {
+			proxyLog.ErrorWithFields("No healthy upstream available", log.Fields{"route": route.Name})
+			return serviceUnavailableResponse(request), nil
+		}
+
+		tried = append(tried, target)
+		state.Attempts = attempt
+
+		response, err := pt.roundTripTarget(route, target, request, reqHeaders, attempt)
+		latency = time.Since(started)
+
+		if attempt < maxAttempts && route.Retry.ShouldRetry(response, err) {
+			backoff := route.Retry.BackoffFor(attempt)
+			proxyLog.WarnWithFields("Retrying upstream request", log.Fields{
+				"route":    route.Name,
+				"attempt":  attempt,
+				"backoff":  backoff,
+				"error":    err,
+				"status":   responseStatus(response),
+				"upstream": state.Upstream,
+			})
+
+			discardResponse(response)
+			if !sleepContext(request.Context(), backoff) {
+				if isTimeout(request.Context().Err()) {
+					return gatewayTimeoutResponse(request), nil
+				}
+				return nil, request.Context().Err()
+			}
+			continue
+		}
+
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrorCircuitOpen), errors.Is(err, ErrorConcurrencyLimited):
+			return serviceUnavailableResponse(request), nil
+		case isUpstreamSetupError(err):
+			return internalServerErrorResponse(request), nil
+		case isTimeout(err):
+			proxyLog.WarnWithFields("Upstream timed out", log.Fields{
+				"route": route.Name, "upstream": state.Upstream, "error": err,
+			})
+			return gatewayTimeoutResponse(request), nil
+		default:
+			return nil, err //Server is not reachable, or otherwise not working
+		}
+
+		// Reconfigure the response for forwarding to the client
+		response.Request = clientRequest
+		transformHeaders(route, response)
+
+		if upgrade == "" {
+			streaming = true
+			response.Body = &releaseOnClose{ReadCloser: response.Body, release: done}
+		}
+
+		return response, nil
+	}
+}
+
+// upstreamSetupError wraps failures that happen before the upstream is
+// contacted, such as an unparsable or unresolvable origin.
+type upstreamSetupError struct {
+	error
+}
+
+func (e upstreamSetupError) Unwrap() error { return e.error }
+
+func isUpstreamSetupError(err error) bool {
+	_, ok := err.(upstreamSetupError)
+	return ok
+}
+
+func responseStatus(response *http.Response) int {
+	if response == nil {
+		return 0
+	}
+	return response.StatusCode
+}
+
+// roundTripTarget makes a single attempt at proxying the request to the given
+// target. The original request is left untouched so that it can be retried.
+func (pt *ProxyTransport) roundTripTarget(route *Route, target *Target, request *http.Request, reqHeaders http.Header, attempt int) (*http.Response, error) {
 	var origin *url.URL
 	var err error
-	var ok bool
 
-	// Determine the origin to proxy the request to
-	if route, ok = pt.server.router.routeTree.Lookup(request.URL.Path); !ok {
-		return notFoundResponse(request), nil
+	// the per try timeout doesn't apply to upgrades, as their context lasts
+	// for as long as the tunnel does (see UpgradePolicy for their limits)
+	ctx, cancel := context.WithCancel(request.Context())
+	if route.Retry != nil && route.Retry.PerTryTimeout > 0 && upgradeType(request) == "" {
+		ctx, cancel = context.WithTimeout(request.Context(), route.Retry.PerTryTimeout)
+	}
+
+	ctx, span := pt.server.startSpan(ctx, "HTTP "+request.Method, tracing.SpanKindClient)
+	span.SetAttribute("portunus.route", route.Name)
+	span.SetAttribute("portunus.attempt", attempt)
+
+	// the span ends along with the attempt's context
+	cancelContext := cancel
+	cancel = func() {
+		span.End()
+		cancelContext()
+	}
+
+	outreq := request.WithContext(ctx)
+	outreq.Header = make(http.Header)
+	copyHeaders(reqHeaders, outreq.Header)
+	outURL := *request.URL
+	outreq.URL = &outURL
+
+	if attempt > 1 && request.GetBody != nil {
+		if outreq.Body, err = request.GetBody(); err != nil {
+			span.SetError(err)
+			cancel()
+			return nil, upstreamSetupError{err}
+		}
+	}
+
+	state := getRequestState(request)
+
+	if origin, err = getUpstream(route, target, outreq); err != nil {
+		span.SetError(err)
+		cancel()
+		proxyLog.Error(err)
+		return nil, upstreamSetupError{err}
+	}
+
+	state.Upstream = origin.Host
+	span.SetAttribute("net.peer.name", origin.Host)
+
+	// Wait for a slot if each upstream host has its own concurrency limit,
+	// holding it until the attempt is over
+	var upstreamLatency time.Duration
+	if route.Concurrency.PerUpstream() && upgradeType(request) == "" {
+		releaseSlot, err := route.Concurrency.Get(origin.Host).Acquire(ctx)
+		if err != nil {
+			span.SetError(err)
+			cancel()
+			proxyLog.WarnWithFields("Upstream concurrency limit reached", log.Fields{
+				"origin": origin, "route": route.Name, "error": err,
+			})
+			return nil, err
+		}
+		cancelAttempt := cancel
+		cancel = func() {
+			releaseSlot(upstreamLatency)
+			cancelAttempt()
+		}
 	}
 
-	if origin, err = getUpstream(route, request); err != nil {
-		log.Error(err)
-		return internalServerErrorResponse(request), nil
+	// Fail fast, without dialing, when the upstream's circuit is open
+	breaker := route.Breakers.Get(origin.Host)
+	if breaker != nil && !breaker.Allow() {
+		span.SetError(ErrorCircuitOpen)
+		cancel()
+		proxyLog.ErrorWithFields(ErrorCircuitOpen, log.Fields{"origin": origin, "route": route.Name})
+		return nil, ErrorCircuitOpen
+	}
+
+	recordOutcome := func(success bool) {
+		if breaker != nil {
+			breaker.Record(success)
+		}
 	}
 
 	var ips []string
 
 	// verify host is resolvable
+	_, dnsSpan := pt.server.startSpan(ctx, "dns lookup", tracing.SpanKindInternal)
+	dnsSpan.SetAttribute("dns.hostname", origin.Hostname())
 	ips, err = net.LookupHost(origin.Hostname())
+	dnsSpan.SetError(err)
+	dnsSpan.End()
+
 	if err != nil {
 		// When using custom DNS resolvers, DNSError doesn't return
 		// the actual custom DNS resolvers, but instead shows the system
@@ -129,69 +416,116 @@ func (pt *ProxyTransport) RoundTrip(request *http.Request) (*http.Response, erro
 		var e *net.DNSError
 		switch err.(type) {
 		case *net.DNSError:
-			if len(Settings.DNS.Resolvers) > 0 {
+			if resolvers := Settings().DNS.Resolvers; len(resolvers) > 0 {
 				e = err.(*net.DNSError)
-				e.Server = strings.Join(Settings.DNS.Resolvers, ", or ")
+				e.Server = strings.Join(resolvers, ", or ")
 				err = e
 			}
 		}
-		log.ErrorWithFields(err, log.Fields{"origin": origin, "route": route})
-		return internalServerErrorResponse(request), nil
+		proxyLog.ErrorWithFields(err, log.Fields{"origin": origin, "route": route.Name})
+		recordOutcome(false)
+		span.SetError(err)
+		cancel()
+		return nil, upstreamSetupError{err}
 	} else if len(ips) <= 0 {
-		log.ErrorWithFields(ErrorNotResolvable, log.Fields{"origin": origin, "route": route})
-		return internalServerErrorResponse(request), nil
+		proxyLog.ErrorWithFields(ErrorNotResolvable, log.Fields{"origin": origin, "route": route.Name})
+		recordOutcome(false)
+		span.SetError(ErrorNotResolvable)
+		cancel()
+		return nil, upstreamSetupError{ErrorNotResolvable}
 	}
 
-	// keep a copy so it's availble for response rewriting, in case any of the
-	// response headers need to include request header details
-	var reqHeaders = make(http.Header)
-	copyHeaders(request.Header, reqHeaders)
-
-	request.Header.Add("X-Origin-Host", origin.Host)
-	request.Header.Add("X-Forwarded-Host", request.Host)
-	if request.Header.Get("X-Forwarded-Proto") == "" {
-		if Settings.Server.TLS.Enabled {
-			request.Header.Add("X-Forwarded-Proto", "https")
+	serverTLS := Settings().Server.TLS
+	outreq.Header.Add("X-Origin-Host", origin.Host)
+	outreq.Header.Add("X-Forwarded-Host", outreq.Host)
+	if outreq.Header.Get("X-Forwarded-Proto") == "" {
+		if serverTLS.Enabled {
+			outreq.Header.Add("X-Forwarded-Proto", "https")
 		} else {
-			request.Header.Add("X-Forwarded-Proto", "http")
+			outreq.Header.Add("X-Forwarded-Proto", "http")
 		}
 	}
 
+	if serverTLS.ClientAuth.ForwardHeaders {
+		forwardClientCert(outreq)
+	}
+
 	// Allow overriding of the above headers by configuration
-	transformHeaders(route, request)
+	transformHeaders(route, outreq)
 
 	// Setup for proxying
-	request.Host = origin.Host
-	request.URL.Host = origin.Host
-	request.URL.Scheme = normalizeScheme(origin.Scheme)
+	outreq.Host = origin.Host
+	outreq.URL.Host = origin.Host
+	outreq.URL.Scheme = normalizeScheme(origin.Scheme)
 
-	if route.AggregateRequestChunks() {
-		switch strings.ToUpper(request.Method) {
-		case "POST", "PUT":
-			url, _ := url.Parse(fmt.Sprintf("%s%s", origin.String(), request.RequestURI))
-			if req, err := NewNonChunkedRequest(request.Method, url.String(), request); err == nil {
-				request = req
-			} else {
-				log.ErrorWithFields("Unable to create request; using original", log.Fields{"error": err})
+	// the upstream's spans are children of this attempt's
+	pt.server.Tracer().Inject(span, outreq.Header)
+	span.SetAttribute("http.url", outreq.URL.String())
+
+	// Proxy the request
+	proxyLog.DebugWithFields("Proxying request", log.Fields{"host": outreq.Host, "origin": origin, "attempt": attempt})
+	TraceEventData(outreq)
+
+	trace := newUpstreamTrace(route.Name, origin.Host)
+	outreq = outreq.WithContext(trace.WithContext(pt.server.withConnectSpans(outreq.Context())))
+
+	release := target.Acquire()
+	sent := time.Now()
+	headerTimedOut := route.Timeouts.awaitResponseHeader(cancelContext)
+	response, err := pt.server.Transports().For(route.UpstreamTLS, route.UpstreamProtocol, route.Timeouts).RoundTrip(outreq)
+	upstreamLatency = time.Since(sent)
+	if headerTimedOut() {
+		if err == nil {
+			response.Body.Close()
+		}
+		response, err = nil, ErrorResponseHeaderTimeout
+	}
+	if err != nil {
+		release()
+		span.SetError(err)
+		cancel()
+		trace.Done(0)
+		if errors.Is(err, context.Canceled) && request.Context().Err() != nil {
+			// the client went away, which says nothing about the upstream
+			if breaker != nil {
+				breaker.Cancel()
 			}
+		} else {
+			recordOutcome(false)
 		}
+		proxyLog.ErrorWithFields("Upstream responded with Error", log.Fields{"error": err})
+		return nil, err
+	}
+	recordOutcome(response.StatusCode < 500)
+	span.SetAttribute("http.status_code", response.StatusCode)
+	if response.StatusCode >= 500 {
+		span.SetError(fmt.Errorf("upstream responded with %s", response.Status))
 	}
 
-	// Proxy the request
-	log.DebugWithFields("Proxying request", log.Fields{"host": request.Host, "origin": origin})
-	TraceEventData(request)
+	// the per-try context must outlive RoundTrip, until the body is consumed
+	status := response.StatusCode
+	done := func() {
+		release()
+		cancel()
+		trace.Done(status)
+	}
 
-	response, err := pt.server.transport.RoundTrip(request)
-	if err != nil {
-		log.ErrorWithFields("Upstream responded with Error", log.Fields{"error": err})
-		return nil, err //Server is not reachable, or otherwise not working
+	if status == http.StatusSwitchingProtocols {
+		// the reverse proxy copies between the client and this connection for
+		// as long as the tunnel lasts, so it must stay writable
+		conn, ok := response.Body.(io.ReadWriteCloser)
+		if !ok || route.Upgrade == nil {
+			done()
+			response.Body.Close()
+			return nil, fmt.Errorf("unexpected protocol switch from upstream %s", origin.Host)
+		}
+		clearDeadlines(request)
+		response.Body = pt.server.tunnels.Open(route.Name, route.Upgrade, conn, done)
+	} else {
+		response.Body = &releaseOnClose{ReadCloser: response.Body, release: done}
 	}
 
 	TraceEventData(response)
 
-	// Reconfigure the response for forwarding to the client
-	response.Request.Header = reqHeaders
-	transformHeaders(route, response)
-
 	return response, nil
 }
@@ -0,0 +1,329 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRateLimitPeriod  = time.Second
+	DefaultRateLimitMaxKeys = 100000
+)
+
+// RateLimitResult is the state of a bucket after taking a token from it.
+type RateLimitResult struct {
+	// whether the bucket had a token to spare
+	Allowed   bool
+	Remaining int
+	// until a token is available, if none was
+	RetryAfter time.Duration
+	// until the bucket is full again
+	Reset time.Duration
+}
+
+// RateLimitBucket identifies a token bucket, which holds up to Burst tokens
+// and is refilled at Rate tokens per second.
+type RateLimitBucket struct {
+	Key   string
+	Rate  float64
+	Burst int
+}
+
+// RateLimitStore holds the token buckets of every rate limit, by key. The
+// in-memory store only limits a single instance; a shared store would let
+// several of them enforce the same limits.
+type RateLimitStore interface {
+	// Take takes a token from each of the buckets if every one of them has
+	// one to spare, and none at all otherwise, so that a request rejected by
+	// one limit isn't counted against the others. The results are in the
+	// order of the buckets.
+	Take(buckets ...RateLimitBucket) []RateLimitResult
+}
+
+// MemoryRateLimitStore is an in-memory RateLimitStore holding up to maxKeys
+// buckets. Once full, the least recently used bucket is evicted, which, as
+// it's likely to have refilled, is much the same as keeping it.
+type MemoryRateLimitStore struct {
+	mutex   sync.Mutex
+	maxKeys int
+	buckets map[string]*list.Element
+	lru     *list.List // of *tokenBucket, most recently used first
+}
+
+type tokenBucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+}
+
+func NewMemoryRateLimitStore(maxKeys int) *MemoryRateLimitStore {
+	if maxKeys <= 0 {
+		maxKeys = DefaultRateLimitMaxKeys
+	}
+
+	return &MemoryRateLimitStore{
+		maxKeys: maxKeys,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (store *MemoryRateLimitStore) Take(buckets ...RateLimitBucket) []RateLimitResult {
+	now := time.Now()
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// refill every bucket before taking anything, so that a token is only
+	// taken if all of them allow it
+	tokenBuckets := make([]*tokenBucket, len(buckets))
+	allowed := true
+	for idx, config := range buckets {
+		tokenBuckets[idx] = store.bucket(config, now)
+		allowed = allowed && tokenBuckets[idx].tokens >= 1
+	}
+
+	results := make([]RateLimitResult, len(buckets))
+	for idx, config := range buckets {
+		bucket, result := tokenBuckets[idx], &results[idx]
+
+		if bucket.tokens >= 1 {
+			if allowed {
+				bucket.tokens--
+			}
+			result.Allowed = true
+		} else {
+			result.RetryAfter = secondsDuration((1 - bucket.tokens) / config.Rate)
+		}
+
+		result.Remaining = int(bucket.tokens)
+		result.Reset = secondsDuration((float64(config.Burst) - bucket.tokens) / config.Rate)
+	}
+
+	return results
+}
+
+// bucket returns the key's bucket, refilled up to now, creating a full one if
+// there isn't any.
+func (store *MemoryRateLimitStore) bucket(config RateLimitBucket, now time.Time) *tokenBucket {
+	if elem, ok := store.buckets[config.Key]; ok {
+		store.lru.MoveToFront(elem)
+		bucket := elem.Value.(*tokenBucket)
+		bucket.tokens = math.Min(float64(config.Burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*config.Rate)
+		bucket.updated = now
+		return bucket
+	}
+
+	if store.lru.Len() >= store.maxKeys {
+		oldest := store.lru.Back()
+		store.lru.Remove(oldest)
+		delete(store.buckets, oldest.Value.(*tokenBucket).key)
+	}
+	bucket := &tokenBucket{key: config.Key, tokens: float64(config.Burst), updated: now}
+	store.buckets[config.Key] = store.lru.PushFront(bucket)
+	return bucket
+}
+
+// Len returns the number of buckets held.
+func (store *MemoryRateLimitStore) Len() int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.lru.Len()
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// RateLimit is a token bucket limit on the requests of a route, or of every
+// route, sharing a key.
+type RateLimit struct {
+	// "global.<name>" or "route:<route>.<name>", where name defaults to the
+	// limit's position in the list. Buckets are keyed by it, so route scopes
+	// are prefixed to keep them apart from the global one (e.g., for a route
+	// named global).
+	Name   string
+	Rate   float64 // tokens per second
+	Burst  int
+	Period time.Duration
+
+	key     func(route *Route, req *http.Request) string
+	body    string
+	headers map[string]*Template
+}
+
+// NewRateLimits compiles the global rate limits, followed by the route's own.
+// Names must be unique within each list, as limits sharing a name would share
+// their buckets.
+func NewRateLimits(global []ConfigRateLimit, route string, limits []ConfigRateLimit) ([]*RateLimit, error) {
+	var rateLimits []*RateLimit
+	names := make(map[string]bool)
+
+	for idx, config := range global {
+		limit, err := NewRateLimit(config, "global", idx)
+		if err == nil && names[limit.Name] {
+			err = fmt.Errorf("duplicate name %q", limit.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rate_limit.limits[%d]: %s", idx, err)
+		}
+		names[limit.Name] = true
+		rateLimits = append(rateLimits, limit)
+	}
+
+	for idx, config := range limits {
+		limit, err := NewRateLimit(config, "route:"+route, idx)
+		if err == nil && names[limit.Name] {
+			err = fmt.Errorf("duplicate name %q", limit.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rate_limits[%d]: %s", idx, err)
+		}
+		names[limit.Name] = true
+		rateLimits = append(rateLimits, limit)
+	}
+
+	return rateLimits, nil
+}
+
+// NewRateLimit compiles a single rate limit. Keys are client_ip (the
+// default), header:<name>, cookie:<name>, or a template.
+func NewRateLimit(config ConfigRateLimit, scope string, idx int) (*RateLimit, error) {
+	name := config.Name
+	if name == "" {
+		name = strconv.Itoa(idx)
+	}
+
+	period := config.Period
+	if period == 0 {
+		period = DefaultRateLimitPeriod
+	}
+
+	if config.Rate <= 0 {
+		return nil, fmt.Errorf("rate must be greater than 0")
+	} else if period < 0 {
+		return nil, fmt.Errorf("period can't be negative")
+	} else if config.Burst < 0 {
+		return nil, fmt.Errorf("burst can't be negative")
+	}
+
+	limit := &RateLimit{
+		Name:    scope + "." + name,
+		Rate:    config.Rate / period.Seconds(),
+		Burst:   config.Burst,
+		Period:  period,
+		body:    config.Body,
+		headers: make(map[string]*Template),
+	}
+
+	// by default, allow a period's worth of requests at once
+	if limit.Burst == 0 {
+		limit.Burst = int(math.Max(1, math.Ceil(config.Rate)))
+	}
+
+	switch key := config.Key; {
+	case key == "":
+		limit.key = func(_ *Route, req *http.Request) string { return clientIP(req) }
+	case strings.Contains(key, "{{"):
+		tmpl, err := CompileTemplate(key)
+		if err != nil {
+			return nil, fmt.Errorf("key: %s", err)
+		}
+		limit.key = func(route *Route, req *http.Request) string { return tmpl.Execute(route, req) }
+	default:
+		keyFunc, err := newHashKeyFunc(key)
+		if err != nil {
+			return nil, fmt.Errorf("key: %s", err)
+		}
+		limit.key = func(_ *Route, req *http.Request) string { return keyFunc(req) }
+	}
+
+	for header, value := range config.Headers {
+		tmpl, err := CompileTemplate(value)
+		if err != nil {
+			return nil, fmt.Errorf("headers.%s: %s", header, err)
+		}
+		limit.headers[header] = tmpl
+	}
+
+	return limit, nil
+}
+
+// TakeRateLimits takes a token for the request from the bucket of each limit,
+// returning the first limit that rejected it, if any. Requests without a key
+// (e.g., missing the header) share a bucket.
+func TakeRateLimits(store RateLimitStore, limits []*RateLimit, route *Route, req *http.Request) (*RateLimit, RateLimitResult) {
+	if len(limits) == 0 {
+		return nil, RateLimitResult{Allowed: true}
+	}
+
+	buckets := make([]RateLimitBucket, len(limits))
+	for idx, limit := range limits {
+		buckets[idx] = RateLimitBucket{
+			Key:   limit.Name + "\x00" + limit.key(route, req),
+			Rate:  limit.Rate,
+			Burst: limit.Burst,
+		}
+	}
+
+	for idx, result := range store.Take(buckets...) {
+		if !result.Allowed {
+			return limits[idx], result
+		}
+	}
+	return nil, RateLimitResult{Allowed: true}
+}
+
+// Response is sent to requests over the limit: the rate_limited response
+// (or RESOURCE_EXHAUSTED, for gRPC), with the limit's body and headers, and
+// Retry-After and RateLimit-* headers.
+func (limit *RateLimit) Response(route *Route, req *http.Request, result RateLimitResult) *http.Response {
+	var response *http.Response
+	if isGRPCRequest(req) {
+		response = grpcErrorResponse(req, GRPCStatusResourceExhausted, "rate limit exceeded")
+	} else {
+		entry := Settings().Response.RateLimited
+		if limit.body != "" {
+			entry.Body = limit.body
+		}
+		response = errorResponse(req, entry)
+	}
+
+	for header, tmpl := range limit.headers {
+		response.Header.Set(header, tmpl.Execute(route, req))
+	}
+
+	response.Header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+	response.Header.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	response.Header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	response.Header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	response.Header.Set("RateLimit-Policy", fmt.Sprintf("%g;w=%d;burst=%d",
+		limit.Rate*limit.Period.Seconds(), ceilSeconds(limit.Period), limit.Burst))
+
+	return response
+}
+
+func ceilSeconds(duration time.Duration) int {
+	return int(math.Ceil(duration.Seconds()))
+}
@@ -11,6 +11,8 @@ type DNSError net.DNSError
 
 var DefaultResolver *net.Resolver = net.DefaultResolver
 
+var dnsLog = log.Named("dns")
+
 func NewResolver(servers []string) *net.Resolver {
 	var nameservers dns.NameServers
 	for _, server := range servers {
@@ -34,9 +36,9 @@ func NewResolver(servers []string) *net.Resolver {
 func SetResolvers(nameservers []string) {
 	if len(nameservers) <= 0 {
 		net.DefaultResolver = DefaultResolver
-		log.InfoWithFields("DNS Resolvers", log.Fields{"resolvers": "<system>"})
+		dnsLog.InfoWithFields("DNS Resolvers", log.Fields{"resolvers": "<system>"})
 	} else {
 		net.DefaultResolver = NewResolver(nameservers)
-		log.InfoWithFields("DNS Resolvers", log.Fields{"resolvers": nameservers})
+		dnsLog.InfoWithFields("DNS Resolvers", log.Fields{"resolvers": nameservers})
 	}
 }
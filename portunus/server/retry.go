@@ -0,0 +1,237 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	RetryOnConnectFailure = "connect_failure"
+	RetryOnReset          = "reset"
+	RetryOnTimeout        = "timeout"
+
+	DefaultRetryBackoff    = 25 * time.Millisecond
+	DefaultRetryMaxBackoff = 250 * time.Millisecond
+)
+
+var (
+	DefaultRetryOn      = []string{RetryOnConnectFailure, RetryOnReset}
+	DefaultRetryMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+)
+
+// RetryPolicy decides whether, and how soon, a failed upstream request is
+// retried. A nil policy never retries.
+type RetryPolicy struct {
+	Attempts      int
+	PerTryTimeout time.Duration
+	Backoff       time.Duration
+	MaxBackoff    time.Duration
+
+	onConnectFailure bool
+	onReset          bool
+	onTimeout        bool
+	statuses         map[int]bool
+	methods          map[string]bool
+}
+
+// NewRetryPolicy compiles the route's retry config, returning nil when the
+// route makes at most one attempt.
+func NewRetryPolicy(config ConfigRetry) (*RetryPolicy, error) {
+	if config.Attempts <= 1 {
+		if config.PerTryTimeout > 0 {
+			return &RetryPolicy{Attempts: 1, PerTryTimeout: config.PerTryTimeout}, nil
+		}
+		return nil, nil
+	}
+
+	policy := &RetryPolicy{
+		Attempts:      config.Attempts,
+		PerTryTimeout: config.PerTryTimeout,
+		Backoff:       config.Backoff,
+		MaxBackoff:    config.MaxBackoff,
+		statuses:      make(map[int]bool),
+		methods:       make(map[string]bool),
+	}
+
+	if policy.Backoff <= 0 {
+		policy.Backoff = DefaultRetryBackoff
+	}
+	if policy.MaxBackoff < policy.Backoff {
+		policy.MaxBackoff = DefaultRetryMaxBackoff
+		if policy.MaxBackoff < policy.Backoff {
+			policy.MaxBackoff = policy.Backoff
+		}
+	}
+
+	retryOn := config.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = DefaultRetryOn
+	}
+
+	for _, condition := range retryOn {
+		switch condition = strings.ToLower(strings.TrimSpace(condition)); condition {
+		case RetryOnConnectFailure:
+			policy.onConnectFailure = true
+		case RetryOnReset:
+			policy.onReset = true
+		case RetryOnTimeout:
+			policy.onTimeout = true
+		case "5xx":
+			for status := 500; status < 600; status++ {
+				policy.statuses[status] = true
+			}
+		default:
+			status, err := strconv.Atoi(condition)
+			if err != nil || status < 100 || status > 599 {
+				return nil, fmt.Errorf("invalid retry condition %q", condition)
+			}
+			policy.statuses[status] = true
+		}
+	}
+
+	methods := config.Methods
+	if len(methods) == 0 {
+		methods = DefaultRetryMethods
+	}
+
+	for _, method := range methods {
+		policy.methods[strings.ToUpper(method)] = true
+	}
+
+	return policy, nil
+}
+
+// AttemptsFor returns the maximum number of attempts for the request. Only
+// requests using a retryable method, and whose body can be replayed, get more
+// than one.
+func (rp *RetryPolicy) AttemptsFor(req *http.Request) int {
+	if rp == nil || rp.Attempts <= 1 || !rp.methods[strings.ToUpper(req.Method)] {
+		return 1
+	}
+
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0 && req.GetBody == nil {
+		return 1
+	}
+
+	return rp.Attempts
+}
+
+// ShouldRetry reports whether the outcome of an attempt warrants a retry.
+func (rp *RetryPolicy) ShouldRetry(response *http.Response, err error) bool {
+	if rp == nil {
+		return false
+	}
+
+	if err == nil {
+		return response != nil && rp.statuses[response.StatusCode]
+	}
+
+	switch {
+	case isConnectFailure(err):
+		return rp.onConnectFailure
+	case isTimeout(err):
+		return rp.onTimeout
+	case isReset(err):
+		return rp.onReset
+	}
+
+	return false
+}
+
+// BackoffFor returns how long to wait before the given (1-based) retry, using
+// exponential backoff with full jitter.
+func (rp *RetryPolicy) BackoffFor(retry int) time.Duration {
+	backoff := rp.Backoff
+	for idx := 1; idx < retry && backoff < rp.MaxBackoff; idx++ {
+		backoff *= 2
+	}
+
+	if backoff > rp.MaxBackoff {
+		backoff = rp.MaxBackoff
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// isConnectFailure reports whether the request failed before it could be sent
+// to the upstream.
+func isConnectFailure(err error) bool {
+	if errors.Is(err, ErrorNotResolvable) || errors.Is(err, ErrorCircuitOpen) {
+		return true
+	}
+
+	var dnsError *net.DNSError
+	if errors.As(err, &dnsError) {
+		return true
+	}
+
+	var opError *net.OpError
+	return errors.As(err, &opError) && opError.Op == "dial"
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netError net.Error
+	return errors.As(err, &netError) && netError.Timeout()
+}
+
+// isReset reports whether the upstream connection was reset or closed
+// mid-request.
+func isReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		strings.Contains(err.Error(), "connection reset")
+}
+
+// sleepContext waits for the given duration, returning early (with false) if
+// the context is done first.
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// discardResponse drains and closes a response that won't be forwarded, so
+// that its connection can be reused.
+func discardResponse(response *http.Response) {
+	if response != nil && response.Body != nil {
+		io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+		response.Body.Close()
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/rabbitt/portunus/portunus/logging"
+)
+
+type pathRewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+type queryRule struct {
+	Param string
+	Value *Template
+}
+
+// URLRewrite is a route's compiled set of url rewrite rules. The path is
+// rewritten in the order: strip_prefix, regex rules (each in turn), then
+// add_prefix. Query parameters are then inserted, overridden and deleted, in
+// that order. Path rules operate on the path as it will be sent upstream,
+// i.e., still percent-encoded.
+type URLRewrite struct {
+	StripPrefix string
+	AddPrefix   string
+
+	rules         []pathRewriteRule
+	queryInsert   []queryRule
+	queryOverride []queryRule
+	queryDelete   []string
+}
+
+// NewURLRewrite compiles the route's rewrite config, returning nil if there's
+// nothing to rewrite.
+func NewURLRewrite(config ConfigRewrite) (*URLRewrite, error) {
+	if config.StripPrefix == "" && config.AddPrefix == "" && len(config.Regex) == 0 &&
+		len(config.Query.Insert) == 0 && len(config.Query.Override) == 0 && len(config.Query.Delete) == 0 {
+		return nil, nil
+	}
+
+	rewrite := &URLRewrite{queryDelete: config.Query.Delete}
+
+	if config.StripPrefix != "" {
+		rewrite.StripPrefix = normalizePath(config.StripPrefix)
+	}
+	if config.AddPrefix != "" {
+		rewrite.AddPrefix = strings.TrimRight(normalizePath(config.AddPrefix), "/")
+	}
+
+	for _, rule := range config.Regex {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite regex %q: %s", rule.Pattern, err)
+		}
+		rewrite.rules = append(rewrite.rules, pathRewriteRule{pattern: pattern, replacement: rule.Replacement})
+	}
+
+	var err error
+	if rewrite.queryInsert, err = compileQueryRules(config.Query.Insert); err != nil {
+		return nil, err
+	}
+	if rewrite.queryOverride, err = compileQueryRules(config.Query.Override); err != nil {
+		return nil, err
+	}
+
+	return rewrite, nil
+}
+
+func compileQueryRules(rules map[string]string) ([]queryRule, error) {
+	compiled := make([]queryRule, 0, len(rules))
+	for param, value := range rules {
+		tmpl, err := CompileTemplate(value)
+		if err != nil {
+			return nil, fmt.Errorf("query parameter %s: %s", param, err)
+		}
+		compiled = append(compiled, queryRule{Param: param, Value: tmpl})
+	}
+
+	sort.Slice(compiled, func(i, j int) bool { return compiled[i].Param < compiled[j].Param })
+
+	return compiled, nil
+}
+
+// Apply returns a copy of the request with its url rewritten, and the client's
+// original uri in the X-Original-URI header. A nil rewrite returns the request
+// unchanged.
+func (rw *URLRewrite) Apply(route *Route, req *http.Request) *http.Request {
+	if rw == nil {
+		return req
+	}
+
+	originalURI := req.RequestURI
+	if originalURI == "" {
+		originalURI = req.URL.RequestURI()
+	}
+
+	rewritten := req.WithContext(req.Context())
+	newURL := *req.URL
+	rewritten.URL = &newURL
+
+	// a rule whose replacement isn't valid percent-encoding (e.g., a lone "%")
+	// can't be applied, so the path is left as is
+	path := rw.rewritePath(req.URL.EscapedPath())
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		newURL.Path = unescaped
+		newURL.RawPath = path
+	} else {
+		proxyLog.WarnWithFields("Rewritten path is invalid; using original path", log.Fields{
+			"route.name":     route.Name,
+			"request.path":   req.URL.EscapedPath(),
+			"rewritten.path": path,
+			"error":          err,
+		})
+	}
+
+	if len(rw.queryInsert) > 0 || len(rw.queryOverride) > 0 || len(rw.queryDelete) > 0 {
+		query := req.URL.Query()
+		for _, rule := range rw.queryInsert {
+			query.Add(rule.Param, rule.Value.Execute(route, req))
+		}
+		for _, rule := range rw.queryOverride {
+			query.Set(rule.Param, rule.Value.Execute(route, req))
+		}
+		for _, param := range rw.queryDelete {
+			query.Del(param)
+		}
+		newURL.RawQuery = query.Encode()
+	}
+
+	rewritten.Header = make(http.Header)
+	copyHeaders(req.Header, rewritten.Header)
+	rewritten.Header.Set("X-Original-URI", originalURI)
+
+	return rewritten
+}
+
+func (rw *URLRewrite) rewritePath(path string) string {
+	// only strip whole path segments, so /billing doesn't mangle /billingfoo
+	if prefix := rw.StripPrefix; prefix != "" && strings.HasPrefix(path, prefix) {
+		if rest := path[len(prefix):]; rest == "" || rest[0] == '/' || strings.HasSuffix(prefix, "/") {
+			path = normalizePath(rest)
+		}
+	}
+
+	for _, rule := range rw.rules {
+		path = rule.pattern.ReplaceAllString(path, rule.replacement)
+	}
+
+	if rw.AddPrefix != "" {
+		path = rw.AddPrefix + normalizePath(path)
+	}
+
+	return normalizePath(path)
+}
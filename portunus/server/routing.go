@@ -20,13 +20,17 @@ import (
 	"expvar"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/codahale/metrics"
-	"github.com/fanyang01/radix"
 	newrelic "github.com/newrelic/go-agent"
 	log "github.com/rabbitt/portunus/portunus/logging"
 	"github.com/zenazn/goji/web/mutil"
@@ -38,31 +42,68 @@ var (
 
 	// a five-minute window tracking 1ms-3min
 	latency = metrics.NewHistogram("HTTP.Latency", 1, 1000*60*3, 3)
+
+	routerLog = log.Named("router")
 )
 
 type Router struct {
 	mux       *http.ServeMux
 	server    *Server
-	routeTree *RouteTree
+	routeTree atomic.Value // *RouteTree
 }
 
 func NewRouter(server *Server) *Router {
+	routeTree, err := NewRouteTree().Load(Settings())
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	router := &Router{
-		mux:       http.NewServeMux(),
-		server:    server,
-		routeTree: NewRouteTree().Load(),
+		mux:    http.NewServeMux(),
+		server: server,
 	}
+	router.SetRouteTree(routeTree)
 	router.setupRoutes()
 	return router
 }
 
+// RouteTree returns the currently active route tree. Callers should hold on
+// to the returned tree for the duration of a request, so that a concurrent
+// reload doesn't change routing halfway through.
+func (router *Router) RouteTree() *RouteTree {
+	return router.routeTree.Load().(*RouteTree)
+}
+
+// SetRouteTree atomically replaces the active route tree, starting its health
+// checks and stopping those of the tree it replaces. Targets the new tree
+// shares with the old one keep their health.
+func (router *Router) SetRouteTree(rt *RouteTree) {
+	old, _ := router.routeTree.Load().(*RouteTree)
+
+	if old != nil {
+		for _, healthChecker := range rt.healthCheckers {
+			healthChecker.inheritHealth(old)
+		}
+	}
+	rt.StartHealthChecks()
+	router.routeTree.Store(rt)
+
+	if old != nil {
+		old.StopHealthChecks()
+	}
+}
+
 func (router *Router) setupRoutes() {
 	// Metrics should be locked down by auth, or some other mechanism
-	router.mux.HandleFunc("/__portunus_metrics__", logRequest(expvarHandler()))
+	router.mux.HandleFunc("/__portunus_metrics__", router.server.logRequest(expvarHandler()))
+	router.mux.HandleFunc("/__portunus_prometheus__", prometheusHandler())
+	router.mux.HandleFunc("/__portunus_logging__", router.server.logRequest(loggingHandler()))
+	router.mux.HandleFunc("/__portunus_certificates__", certificatesHandler(router.server))
 	router.mux.HandleFunc("/__portunus_ping__", aliveHandler())
+	router.mux.HandleFunc("/__portunus_health__", healthHandler(router))
 
-	proxyHandlerFunc := logRequest(metricHandler(router.server.proxyHandler()))
-	if Settings.NewRelic.Enabled {
+	proxyHandlerFunc := router.server.logRequest(metricHandler(router.server.traceRequest(router.server.proxyHandler())))
+	if Settings().NewRelic.Enabled {
 		router.mux.HandleFunc(newrelic.WrapHandleFunc(nrApp, "/", proxyHandlerFunc))
 	} else {
 		router.mux.HandleFunc("/", proxyHandlerFunc)
@@ -71,7 +112,7 @@ func (router *Router) setupRoutes() {
 
 func (server *Server) proxyHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.DebugWithFields("Request Received", log.Fields{
+		routerLog.DebugWithFields("Request Received", log.Fields{
 			"remote.addr":  r.RemoteAddr,
 			"request.host": r.Host,
 			"request.uri":  r.RequestURI,
@@ -79,6 +120,11 @@ func (server *Server) proxyHandler() http.HandlerFunc {
 		})
 
 		server.proxy.ServeHTTP(w, r)
+
+		// by now, the gRPC status has been written as a header or trailer
+		if isGRPCRequest(r) {
+			getRequestState(r).GRPCStatus = grpcStatus(w.Header())
+		}
 	}
 }
 
@@ -95,12 +141,28 @@ func aliveHandler() http.HandlerFunc {
 	}
 }
 
-func logRequest(h http.HandlerFunc) http.HandlerFunc {
+func (server *Server) logRequest(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		wrappedWriter := mutil.WrapWriter(w)
+		r, state := withRequestState(r)
 		h(wrappedWriter, r)
-		log.InfoWithFields("Request Handled", log.Fields{
+
+		server.AccessLog().Log(&accessLogEntry{
+			start:    start,
+			request:  r,
+			status:   wrappedWriter.Status(),
+			bytes:    wrappedWriter.BytesWritten(),
+			duration: time.Since(start),
+			state:    state,
+		})
+
+		var routeName string
+		if state.Route != nil {
+			routeName = state.Route.Name
+		}
+
+		routerLog.InfoWithFields("Request Handled", log.Fields{
 			"remote.address":     r.RemoteAddr,
 			"request.host":       r.Host,
 			"request.method":     r.Method,
@@ -110,6 +172,10 @@ func logRequest(h http.HandlerFunc) http.HandlerFunc {
 			"response.bytes":     wrappedWriter.BytesWritten(),
 			"request.user-agent": r.Header.Get("User-Agent"),
 			"request.duration":   time.Since(start),
+			"route.name":         routeName,
+			"upstream.target":    state.Upstream,
+			"upstream.attempts":  state.Attempts,
+			"grpc.status":        state.GRPCStatus,
 		})
 	}
 }
@@ -134,32 +200,130 @@ func metricHandler(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		requests.Add()
 		defer responses.Add()
-		defer func(start time.Time) {
-			_ = latency.RecordValue(int64(time.Since(start).Seconds() * 1000.0))
-		}(time.Now())
 
-		h(w, r)
+		start := time.Now()
+		wrappedWriter := mutil.WrapWriter(w)
+		h(wrappedWriter, r)
+		duration := time.Since(start)
+
+		_ = latency.RecordValue(int64(duration.Seconds() * 1000.0))
+
+		state := getRequestState(r)
+		var routeName string
+		if state.Route != nil {
+			routeName = state.Route.Name
+		}
+
+		labels := []string{routeName, upstreamLabel(state.Upstream), methodLabel(r.Method), statusClassLabel(wrappedWriter.Status())}
+		promRequests.Add(1, labels...)
+		promRequestDuration.Observe(duration.Seconds(), labels...)
+
+		if state.GRPCStatus != "" {
+			promGRPCRequests.Add(1, routeName, grpcStatusName(state.GRPCStatus))
+		}
 	}
 }
 
 type Route struct {
 	Name         string
+	MatchedHost  string
 	MatchedPath  string
 	Upstream     string
+	Balancer     Balancer
+	Breakers     *CircuitBreakers
+	Retry        *RetryPolicy
+	Transforms   *Transforms
+	Rewrite      *URLRewrite
 	AggReqChunks bool
+
+	// requests without a verified client certificate are rejected
+	RequireClientCert bool
+
+	// nil for the default upstream TLS settings
+	UpstreamTLS *UpstreamTLS
+	// one of ProtocolHTTP1, ProtocolH2 or ProtocolH2C
+	UpstreamProtocol string
+	// nil if protocol upgrades (e.g., WebSocket) aren't allowed
+	Upgrade *UpgradePolicy
+	// the global network timeouts, with the route's overrides
+	Timeouts RouteTimeouts
+	// the global rate limits, followed by the route's
+	RateLimits []*RateLimit
+	// nil if in-flight requests aren't limited
+	Concurrency *ConcurrencyLimiters
+
+	pattern *PathPattern
 }
 
 func (r *Route) AggregateRequestChunks() bool {
 	return r.AggReqChunks
 }
 
+// routeTable holds the routes for a single host pattern, ordered from the most
+// to the least specific path pattern (see PathPattern.MoreSpecificThan).
+type routeTable struct {
+	routes []*Route
+}
+
+// add inserts the route, replacing (and returning) any existing route with the
+// same path pattern.
+func (table *routeTable) add(route *Route) (*Route, bool) {
+	for idx, existing := range table.routes {
+		if existing.pattern.Source == route.pattern.Source {
+			table.routes[idx] = route
+			return existing, true
+		}
+	}
+
+	idx := sort.Search(len(table.routes), func(i int) bool {
+		return route.pattern.MoreSpecificThan(table.routes[i].pattern)
+	})
+
+	table.routes = append(table.routes, nil)
+	copy(table.routes[idx+1:], table.routes[idx:])
+	table.routes[idx] = route
+
+	return nil, false
+}
+
+// lookup returns the most specific route matching the path, and its captures.
+func (table *routeTable) lookup(path string) (*Route, map[string]string, bool) {
+	for _, route := range table.routes {
+		if params, ok := route.pattern.Match(path); ok {
+			return route, params, true
+		}
+	}
+	return nil, nil, false
+}
+
+// wildcardHost holds the routes for a host pattern of the form
+// "*.example.com", which matches any subdomain (of any depth) of
+// example.com, but not example.com itself.
+type wildcardHost struct {
+	pattern string
+	suffix  string
+	table   *routeTable
+}
+
 type RouteTree struct {
-	mutex sync.Mutex
-	radix *radix.PatternTrie
+	mutex          sync.RWMutex
+	hosts          map[string]*routeTable
+	wildcards      []*wildcardHost
+	table          *routeTable
+	balancers      map[string]Balancer
+	healthCheckers []*HealthChecker
+
+	// kept so that a reloaded tree can carry them over, if unchanged
+	config      *Config
+	breakers    *CircuitBreakers
+	concurrency map[string]*ConcurrencyLimiters
 }
 
 func NewRouteTree() *RouteTree {
-	return &RouteTree{}
+	return &RouteTree{
+		hosts: make(map[string]*routeTable),
+		table: &routeTable{},
+	}
 }
 
 func normalizePath(path string) string {
@@ -168,57 +332,350 @@ func normalizePath(path string) string {
 	return buffer.String()
 }
 
-func (rt *RouteTree) Load() *RouteTree {
+// normalizeHost lowercases the host and strips any port and trailing dot
+// so that "Example.COM.:8080" and "example.com" are treated the same.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(strings.TrimSuffix(host, "]"), "[")
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// tableFor returns the route table for the given host pattern, creating it if
+// necessary. An empty host (or "*") returns the host-agnostic table.
+func (rt *RouteTree) tableFor(host string) *routeTable {
+	host = normalizeHost(host)
+
+	switch {
+	case host == "" || host == "*":
+		return rt.table
+	case strings.HasPrefix(host, "*."):
+		for _, wildcard := range rt.wildcards {
+			if wildcard.pattern == host {
+				return wildcard.table
+			}
+		}
+
+		wildcard := &wildcardHost{pattern: host, suffix: host[1:], table: &routeTable{}}
+		rt.wildcards = append(rt.wildcards, wildcard)
+
+		// keep the most specific (longest) suffix first
+		sort.SliceStable(rt.wildcards, func(i, j int) bool {
+			return len(rt.wildcards[i].suffix) > len(rt.wildcards[j].suffix)
+		})
+
+		return wildcard.table
+	default:
+		if _, ok := rt.hosts[host]; !ok {
+			rt.hosts[host] = &routeTable{}
+		}
+		return rt.hosts[host]
+	}
+}
+
+// Load builds the route tree from the routes in the given config, returning
+// an error if any route is invalid, or if two routes claim the same host and
+// path.
+func (rt *RouteTree) Load(config *Config) (*RouteTree, error) {
+	return rt.Reload(config, nil)
+}
+
+// Reload is like Load, but carries state over from the previous route tree
+// (nil if there's none) wherever its config hasn't changed: the circuit
+// breakers, so that open circuits stay open, and each route's concurrency
+// limiters, so that requests still in flight keep counting against the limit
+// and adaptive limits aren't reset.
+func (rt *RouteTree) Reload(config *Config, previous *RouteTree) (*RouteTree, error) {
 	start := time.Now()
 	defer func() {
-		log.DebugWithFields("routeTree Loaded", log.Fields{"duration": time.Since(start)})
+		routerLog.DebugWithFields("routeTree Loaded", log.Fields{"duration": time.Since(start)})
 	}()
 
 	rt.mutex.Lock()
 	defer rt.mutex.Unlock()
-	rt.radix = radix.NewPatternTrie()
+	rt.hosts = make(map[string]*routeTable)
+	rt.wildcards = nil
+	rt.table = &routeTable{}
+	rt.balancers = make(map[string]Balancer)
+	rt.healthCheckers = nil
+	rt.config = config
+	rt.concurrency = make(map[string]*ConcurrencyLimiters)
+
+	var err error
+	if previous != nil && reflect.DeepEqual(previous.config.CircuitBreaker, config.CircuitBreaker) {
+		rt.breakers = previous.breakers
+	} else if rt.breakers, err = NewCircuitBreakers(config.CircuitBreaker); err != nil {
+		return nil, err
+	}
+	breakers := rt.breakers
+
+	// load routes in a stable order, so that errors and logs are consistent
+	names := make([]string, 0, len(config.Routes))
+	for name := range config.Routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	for name, entry := range Settings.Routes {
+	for _, name := range names {
+		entry := config.Routes[name]
+
+		if entry.Upstream == "" && len(entry.Upstreams) == 0 {
+			return nil, fmt.Errorf("route %q: missing upstream", name)
+		} else if len(entry.Paths) == 0 {
+			return nil, fmt.Errorf("route %q: no paths defined", name)
+		}
+
+		patterns := make([]*PathPattern, 0, len(entry.Paths))
 		for _, path := range entry.Paths {
-			route := &Route{
-				Name:         name,
-				MatchedPath:  path,
-				Upstream:     entry.Upstream,
-				AggReqChunks: entry.AggregateChunkedRequests,
+			pattern, err := CompilePathPattern(path)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %s", name, err)
+			}
+			patterns = append(patterns, pattern)
+		}
+
+		targets, err := routeTargets(entry)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %s", name, err)
+		}
+
+		for _, target := range targets {
+			// templated targets can only be matched up with their breaker once
+			// the request's upstream host is known
+			if !target.IsTemplated() {
+				if upstream, err := url.Parse(target.URL); err == nil {
+					target.breaker = breakers.Pin(upstream.Host)
+				}
+			}
+		}
+
+		balancer, err := NewBalancer(entry.Balancer, targets)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %s", name, err)
+		}
+		rt.balancers[name] = balancer
+
+		retry, err := NewRetryPolicy(entry.Retry)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %s", name, err)
+		}
+
+		transforms, err := NewTransforms(config.Transform, entry.Transform)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %s", name, err)
+		}
+
+		rewrite, err := NewURLRewrite(entry.Rewrite)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %s", name, err)
+		}
+
+		upstreamTLS, err := NewUpstreamTLS(entry.UpstreamTLS)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %s", name, err)
+		} else if entry.UpstreamTLS.InsecureSkipVerify {
+			routerLog.WarnWithFields("Upstream TLS certificates aren't verified", log.Fields{"route.name": name})
+		}
+
+		protocol, err := parseUpstreamProtocol(entry.UpstreamProtocol)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %s", name, err)
+		}
+		for _, target := range targets {
+			if err := checkUpstreamScheme(target, protocol); err != nil {
+				return nil, fmt.Errorf("route %q: %s", name, err)
 			}
+		}
+
+		upgrade, err := NewUpgradePolicy(entry.Upgrade, protocol)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %s", name, err)
+		}
+
+		timeouts, err := NewRouteTimeouts(config.Network.Timeouts, entry.Timeouts)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %s", name, err)
+		}
+
+		rateLimits, err := NewRateLimits(config.RateLimit.Limits, name, entry.RateLimits)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %s", name, err)
+		}
+
+		var concurrency *ConcurrencyLimiters
+		if old, ok := previous.routeConfig(name); ok && reflect.DeepEqual(old.Concurrency, entry.Concurrency) {
+			concurrency = previous.concurrency[name]
+		} else if concurrency, err = NewConcurrencyLimiters(name, entry.Concurrency); err != nil {
+			return nil, fmt.Errorf("route %q: %s", name, err)
+		}
+		rt.concurrency[name] = concurrency
+
+		var healthCheckTransport http.RoundTripper
+		if upstreamTLS != nil || protocol != ProtocolHTTP1 {
+			healthCheckTransport = NewUpstreamTransport(config, upstreamTLS.Config(), protocol, timeouts)
+		}
+
+		healthChecker, err := NewHealthChecker(name, entry.HealthCheck, targets, healthCheckTransport)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %s", name, err)
+		} else if healthChecker != nil {
+			rt.healthCheckers = append(rt.healthCheckers, healthChecker)
+		}
+
+		if entry.RequireClientCert && !(config.Server.TLS.Enabled && clientAuthEnabled(config.Server.TLS.ClientAuth)) {
+			return nil, fmt.Errorf("route %q: require_client_cert needs TLS, with server.tls.client_auth.ca set", name)
+		}
+
+		hosts := entry.Hosts
+		if len(hosts) == 0 {
+			hosts = []string{""}
+		}
 
-			rt.radix.Add(normalizePath(path), route)
+		for _, host := range hosts {
+			if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+				return nil, fmt.Errorf("route %q: invalid host pattern %q", name, host)
+			}
 
-			log.DebugWithFields("Added Route", log.Fields{
-				"route.name":                       name,
-				"route.path":                       path,
-				"route.upstream":                   entry.Upstream,
-				"route.aggregate_chunked_requests": entry.AggregateChunkedRequests,
-			})
+			table := rt.tableFor(host)
+
+			for _, pattern := range patterns {
+				route := &Route{
+					Name:         name,
+					MatchedHost:  normalizeHost(host),
+					MatchedPath:  pattern.Source,
+					Upstream:     entry.Upstream,
+					Balancer:     balancer,
+					Breakers:     breakers,
+					Retry:        retry,
+					Transforms:   transforms,
+					Rewrite:      rewrite,
+					AggReqChunks: entry.AggregateChunkedRequests,
+					pattern:      pattern,
+
+					RequireClientCert: entry.RequireClientCert,
+					UpstreamTLS:       upstreamTLS,
+					UpstreamProtocol:  protocol,
+					Upgrade:           upgrade,
+					Timeouts:          timeouts,
+					RateLimits:        rateLimits,
+					Concurrency:       concurrency,
+				}
+
+				if existing, ok := table.add(route); ok && existing.Name != name {
+					return nil, fmt.Errorf("route %q: path %q on host %q is already used by route %q",
+						name, pattern.Source, route.MatchedHost, existing.Name)
+				}
+
+				routerLog.DebugWithFields("Added Route", log.Fields{
+					"route.name":                       name,
+					"route.host":                       route.MatchedHost,
+					"route.path":                       pattern.Source,
+					"route.upstreams":                  balancer.Targets(),
+					"route.balancer":                   entry.Balancer.Policy,
+					"route.aggregate_chunked_requests": entry.AggregateChunkedRequests,
+					"route.require_client_cert":        entry.RequireClientCert,
+					"route.upstream_protocol":          protocol,
+					"route.upgrade":                    entry.Upgrade.Enabled,
+					"route.timeouts.connect":           timeouts.Connect,
+					"route.timeouts.response_header":   timeouts.ResponseHeader,
+					"route.timeouts.total":             timeouts.Total,
+					"route.timeouts.idle_connection":   timeouts.IdleConnection,
+					"route.rate_limits":                len(rateLimits),
+					"route.max_concurrent":             entry.Concurrency.MaxConcurrent,
+				})
+			}
 		}
 	}
 
-	return rt
+	return rt, nil
 }
 
-func (rt *RouteTree) insert(s string, route *Route) (*Route, bool) {
-	rt.mutex.Lock()
-	defer rt.mutex.Unlock()
+// routeConfig returns the config the named route was loaded from, if the
+// tree has such a route.
+func (rt *RouteTree) routeConfig(name string) (ConfigRoute, bool) {
+	if rt == nil || rt.config == nil {
+		return ConfigRoute{}, false
+	}
+	entry, ok := rt.config.Routes[name]
+	return entry, ok
+}
 
-	if v, has := rt.radix.Add(normalizePath(s), route); has {
-		oldRoute := v.(*Route)
-		return oldRoute, true
+// StartHealthChecks begins actively health checking each route's targets.
+func (rt *RouteTree) StartHealthChecks() {
+	for _, healthChecker := range rt.healthCheckers {
+		healthChecker.Start()
 	}
-	return nil, false
 }
 
-func (rt *RouteTree) Lookup(s string) (*Route, bool) {
-	rt.mutex.Lock()
-	defer rt.mutex.Unlock()
+// StopHealthChecks stops all of the tree's health checks.
+func (rt *RouteTree) StopHealthChecks() {
+	for _, healthChecker := range rt.healthCheckers {
+		healthChecker.Stop()
+	}
+}
+
+// routeTargets returns the route's upstream targets, with their urls compiled,
+// treating a lone `upstream` as a single target. Each target must have a url
+// of its own, since that's what identifies it (e.g., in health checks).
+func routeTargets(entry ConfigRoute) ([]*Target, error) {
+	var targets []*Target
 
-	if v, ok := rt.radix.Lookup(s); ok {
-		return v.(*Route), true
+	if entry.Upstream != "" {
+		targets = append(targets, &Target{URL: entry.Upstream, Weight: 1})
 	}
 
-	return nil, false
+	for _, upstream := range entry.Upstreams {
+		targets = append(targets, &Target{URL: upstream.Target, Weight: upstream.Weight})
+	}
+
+	urls := make(map[string]bool)
+	for _, target := range targets {
+		if urls[target.URL] {
+			return nil, fmt.Errorf("duplicate upstream %q", target.URL)
+		}
+		urls[target.URL] = true
+
+		tmpl, err := CompileTemplate(target.URL)
+		if err != nil {
+			return nil, err
+		}
+		target.template = tmpl
+	}
+
+	return targets, nil
+}
+
+// Lookup finds the route for the given request host and path, along with the
+// path pattern's captures. Hosts are tried in order of precedence, falling
+// through to the next tier when no path matches:
+//
+//  1. routes listing the exact host (e.g., "api.example.com")
+//  2. routes listing a matching wildcard host, longest suffix first
+//     (e.g., "*.api.example.com" before "*.example.com")
+//  3. routes without any hosts
+//
+// Within a tier, the most specific matching path wins (see
+// PathPattern.MoreSpecificThan).
+func (rt *RouteTree) Lookup(host, path string) (*Route, map[string]string, bool) {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	host = normalizeHost(host)
+
+	if table, ok := rt.hosts[host]; ok {
+		if route, params, ok := table.lookup(path); ok {
+			return route, params, true
+		}
+	}
+
+	for _, wildcard := range rt.wildcards {
+		if strings.HasSuffix(host, wildcard.suffix) && len(host) > len(wildcard.suffix) {
+			if route, params, ok := wildcard.table.lookup(path); ok {
+				return route, params, true
+			}
+		}
+	}
+
+	return rt.table.lookup(path)
 }
@@ -25,8 +25,10 @@ import (
 	"net/http/httputil"
 	"os"
 	signals "os/signal"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -34,6 +36,7 @@ import (
 
 	"github.com/coreos/go-systemd/activation"
 	log "github.com/rabbitt/portunus/portunus/logging"
+	"github.com/rabbitt/portunus/portunus/tracing"
 )
 
 const (
@@ -43,80 +46,330 @@ const (
 	DefaultBindingPort = 8080
 )
 
+var tlsLog = log.Named("tls")
+
 type Server struct {
-	router    *Router
-	proxy     *httputil.ReverseProxy
-	transport *http.Transport
-	server    *http.Server
-	startup   time.Time
-	address   string
-	finished  chan struct{}
-	logger    *io.PipeWriter
+	router       *Router
+	proxy        *httputil.ReverseProxy
+	transports   atomic.Value // *Transports
+	tlsConfig    atomic.Value // *tls.Config
+	certs        atomic.Value // *CertStore
+	tracer       atomic.Value // *tracing.Tracer
+	accessLog    atomic.Value // *AccessLog
+	acme         *ACMEManager
+	tunnels      *Tunnels
+	rateLimits   RateLimitStore // kept across reloads, along with its buckets
+	server       *http.Server
+	startup      time.Time
+	address      string
+	finished     chan struct{}
+	logger       *io.PipeWriter
+	configSource func() (map[string]interface{}, error)
 }
 
 func NewServer() *Server {
+	current := Settings()
+
 	s := &Server{}
 	s.router = NewRouter(s)
 	s.startup = time.Now()
 	s.address = BindAddress()
 	s.finished = make(chan struct{})
 	s.logger = log.Writer()
+	s.tunnels = NewTunnels()
+	// the buckets outlive configuration reloads, so rate_limit.max_keys only
+	// takes effect on a restart
+	s.rateLimits = NewMemoryRateLimitStore(current.RateLimit.MaxKeys)
 
 	s.proxy = &httputil.ReverseProxy{
-		Director:  func(req *http.Request) {}, // header rewrites are handled in proxyTransport
-		Transport: NewProxyTransport(s),
-		ErrorLog:  golog.New(s.logger, "", 0),
+		Director:     func(req *http.Request) {}, // header rewrites are handled in proxyTransport
+		Transport:    NewProxyTransport(s),
+		ErrorHandler: proxyErrorHandler,
+		ErrorLog:     golog.New(s.logger, "", 0),
 	}
 
-	s.transport = &http.Transport{
-		Proxy: nil, // No proxying of upstream requests
-		DialContext: (&net.Dialer{
-			Timeout:   Settings.Network.Timeouts.Connect,
-			KeepAlive: Settings.Network.Timeouts.Keepalive,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          Settings.Network.MaxIdleConnections,
-		MaxIdleConnsPerHost:   Settings.Network.MaxIdlePerHost,
-		IdleConnTimeout:       Settings.Network.Timeouts.IdleConnection,
-		TLSHandshakeTimeout:   Settings.Network.Timeouts.TLSHandshake,
-		ExpectContinueTimeout: Settings.Network.Timeouts.Continue,
+	s.transports.Store(NewTransports(current))
+
+	tracer, err := NewTracer(current)
+	if err != nil {
+		log.Fatal(err)
 	}
+	s.tracer.Store(tracer)
+
+	accessLog, err := NewAccessLog(current.AccessLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.accessLog.Store(accessLog)
 
 	var tlsConfig *tls.Config
 	var tlsNextProto map[string]func(*http.Server, *tls.Conn, http.Handler)
 
-	if Settings.Server.TLS.Enabled {
+	if current.Server.TLS.Enabled {
+		if s.acme, err = NewACMEManager(current.Server.TLS.ACME); err != nil {
+			log.Fatal(err)
+		}
+
+		certs, err := NewCertStore(current.Server.TLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		config, err := NewTLSConfig(current, certs, s.acme)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.tlsConfig.Store(config)
+		s.certs.Store(certs)
+		certs.Watch(current.Server.TLS.WatchInterval)
+		promCertificateExpiry.SetCollector(s.collectCertificateExpiry)
+
+		// The listener's config defers to the currently active one, so that
+		// certificates and TLS settings can be swapped out on reload.
 		tlsConfig = &tls.Config{
-			MinVersion:               tls.VersionTLS12,
-			CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-			PreferServerCipherSuites: true,
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return s.TLSConfig(), nil
+			},
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return s.TLSConfig().GetCertificate(hello)
 			},
 		}
 
-		if !Settings.Server.HTTP2.Enabled {
+		if !current.Server.HTTP2.Enabled {
 			tlsNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0)
 		}
 	}
 
 	s.server = &http.Server{
-		Addr:         Settings.Server.BindAddress,
-		ReadTimeout:  Settings.Network.Timeouts.Read,
-		WriteTimeout: Settings.Network.Timeouts.Write,
-		Handler:      s.router.mux,
+		Addr:         current.Server.BindAddress,
+		ReadTimeout:  current.Network.Timeouts.Read,
+		WriteTimeout: current.Network.Timeouts.Write,
+		Handler:      listenerHandler(current, s.router.mux),
 		TLSNextProto: tlsNextProto,
 		TLSConfig:    tlsConfig,
+		ConnContext:  withConn,
 	}
 
 	return s
 }
 
+// NewTransport builds an upstream transport from the given config, using the
+// given TLS client config for https upstreams (nil for the defaults).
+func NewTransport(config *Config, tlsConfig *tls.Config, timeouts RouteTimeouts) *http.Transport {
+	return &http.Transport{
+		Proxy: nil, // No proxying of upstream requests
+		DialContext: countConnections((&net.Dialer{
+			Timeout:   timeouts.Connect,
+			KeepAlive: config.Network.Timeouts.Keepalive,
+			DualStack: true,
+		}).DialContext),
+		MaxIdleConns:          config.Network.MaxIdleConnections,
+		MaxIdleConnsPerHost:   config.Network.MaxIdlePerHost,
+		IdleConnTimeout:       timeouts.IdleConnection,
+		TLSHandshakeTimeout:   config.Network.Timeouts.TLSHandshake,
+		ExpectContinueTimeout: config.Network.Timeouts.Continue,
+		TLSClientConfig:       tlsConfig,
+	}
+}
+
+// NewTLSConfig builds the listener's TLS config from the given config.
+// Certificates for hosts managed by ACME are provided by the ACME manager, if
+// there is one, and all others come from the certificate store. Protocol
+// versions, cipher suites and curves come from the TLS policy, and client
+// certificates are verified against the client_auth CA bundle.
+func NewTLSConfig(config *Config, certs *CertStore, acme *ACMEManager) (*tls.Config, error) {
+	if certs.Len() == 0 && acme == nil {
+		return nil, fmt.Errorf("no TLS certificates configured")
+	}
+
+	nextProtos := []string{"http/1.1"}
+	if config.Server.HTTP2.Enabled {
+		nextProtos = []string{"h2", "http/1.1"}
+	}
+	nextProtos = append(nextProtos, acme.NextProtos()...)
+
+	getCertificate := func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if acme.Handles(hello.ServerName) {
+			return acme.GetCertificate(hello)
+		}
+		return certs.GetCertificate(hello)
+	}
+
+	policy, err := NewTLSPolicy(config.Server.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate:           getCertificate,
+		NextProtos:               nextProtos,
+		PreferServerCipherSuites: true,
+	}
+	policy.Apply(tlsConfig)
+
+	if err := applyClientAuth(config.Server.TLS.ClientAuth, tlsConfig); err != nil {
+		return nil, err
+	}
+
+	return tlsConfig, nil
+}
+
+// Transports returns the currently active upstream transports.
+func (s *Server) Transports() *Transports {
+	return s.transports.Load().(*Transports)
+}
+
+// AccessLog returns the currently active access log, or nil when it isn't
+// enabled.
+func (s *Server) AccessLog() *AccessLog {
+	accessLog, _ := s.accessLog.Load().(*AccessLog)
+	return accessLog
+}
+
+// Tracer returns the currently active tracer, or nil when tracing isn't
+// enabled.
+func (s *Server) Tracer() *tracing.Tracer {
+	tracer, _ := s.tracer.Load().(*tracing.Tracer)
+	return tracer
+}
+
+// TLSConfig returns the currently active listener TLS config, or nil when TLS
+// isn't enabled.
+func (s *Server) TLSConfig() *tls.Config {
+	if config, ok := s.tlsConfig.Load().(*tls.Config); ok {
+		return config
+	}
+	return nil
+}
+
+// Certificates returns the listener's currently active certificate store, or
+// nil when TLS isn't enabled.
+func (s *Server) Certificates() *CertStore {
+	certs, _ := s.certs.Load().(*CertStore)
+	return certs
+}
+
+// WithConfigSource sets the function used to fetch fresh settings when the
+// server is asked to reload (e.g., on SIGHUP). If it fails, the reload is
+// abandoned.
+func (s *Server) WithConfigSource(source func() (map[string]interface{}, error)) *Server {
+	s.configSource = source
+	return s
+}
+
+// Reload decodes the given settings and, if they're valid, atomically swaps
+// in a newly built route tree, transports and TLS config. Requests already in
+// flight finish using the components they started with. If anything fails to
+// build, the running configuration is left untouched.
+func (s *Server) Reload(input map[string]interface{}) error {
+	newConfig, err := DecodeConfigMap(input)
+	if err != nil {
+		return err
+	}
+
+	current := Settings()
+	if err := ValidateLogging(newConfig.Logging); err != nil {
+		return err
+	}
+
+	routeTree, err := NewRouteTree().Reload(newConfig, s.router.RouteTree())
+	if err != nil {
+		return err
+	}
+
+	// certificates are always reloaded, in case their files have been
+	// replaced without being changed in the config
+	var tlsConfig *tls.Config
+	var certs *CertStore
+	if current.Server.TLS.Enabled {
+		if certs, err = NewCertStore(newConfig.Server.TLS); err != nil {
+			return err
+		}
+		if tlsConfig, err = NewTLSConfig(newConfig, certs, s.acme); err != nil {
+			return err
+		}
+	}
+
+	if newConfig.Server.BindAddress != current.Server.BindAddress ||
+		newConfig.Server.TLS.Enabled != current.Server.TLS.Enabled ||
+		newConfig.Server.HTTP2 != current.Server.HTTP2 ||
+		newConfig.RateLimit.MaxKeys != current.RateLimit.MaxKeys ||
+		!reflect.DeepEqual(newConfig.Server.TLS.ACME, current.Server.TLS.ACME) {
+		log.Warnf("changes to server.bind_address, server.tls.enabled, server.tls.acme, server.http2 and rate_limit.max_keys require a restart")
+	}
+
+	transports := NewTransports(newConfig)
+
+	// only restart tracing when its config changes, so queued spans aren't
+	// needlessly flushed
+	tracingChanged := !reflect.DeepEqual(newConfig.Tracing, current.Tracing)
+	var tracer *tracing.Tracer
+	if tracingChanged {
+		if tracer, err = NewTracer(newConfig); err != nil {
+			return err
+		}
+	}
+
+	accessLogChanged := !reflect.DeepEqual(newConfig.AccessLog, current.AccessLog)
+	var accessLog *AccessLog
+	if accessLogChanged {
+		if accessLog, err = NewAccessLog(newConfig.AccessLog); err != nil {
+			tracer.Shutdown(context.Background())
+			return err
+		}
+	}
+
+	// opened last, so that it needn't be closed if anything before it fails
+	output, err := OpenLogOutput(newConfig.Logging)
+	if err != nil {
+		tracer.Shutdown(context.Background())
+		accessLog.Close()
+		return err
+	}
+
+	ApplyConfigAndLogDiff(newConfig, output)
+
+	s.router.SetRouteTree(routeTree)
+	if tlsConfig != nil {
+		oldCerts := s.Certificates()
+		s.certs.Store(certs)
+		s.tlsConfig.Store(tlsConfig)
+		oldCerts.Close()
+		certs.Watch(newConfig.Server.TLS.WatchInterval)
+	}
+
+	oldTransports := s.Transports()
+	s.transports.Store(transports)
+
+	// Connections still serving in-flight requests return to the old pool once
+	// they're done, so sweep it again after those requests have had a chance
+	// to finish.
+	oldTransports.CloseIdleConnections()
+	time.AfterFunc(newConfig.Server.ShutdownTimeout, oldTransports.CloseIdleConnections)
+
+	if tracingChanged {
+		oldTracer := s.Tracer()
+		s.tracer.Store(tracer)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), newConfig.Server.ShutdownTimeout)
+			defer cancel()
+			oldTracer.Shutdown(ctx)
+		}()
+	}
+
+	if accessLogChanged {
+		oldAccessLog := s.AccessLog()
+		s.accessLog.Store(accessLog)
+		oldAccessLog.Close()
+	}
+
+	log.Info("Server reloaded")
+
+	return nil
+}
+
 func BindAddress() (bindAddress string) {
-	bindAddress = Settings.Server.BindAddress
+	bindAddress = Settings().Server.BindAddress
 	if bindAddress == "" {
 		bindAddress = fmt.Sprintf("%s:%d", DefaultBindingAddress, DefaultBindingPort)
 	} else if strings.HasPrefix(bindAddress, ":") { // e.g., ":<port>"
@@ -156,9 +409,11 @@ func (s *Server) ListenAndServe() {
 		panic(err)
 	}
 
-	if Settings.Server.TLS.Enabled {
+	if Settings().Server.TLS.Enabled {
+		s.acme.Start()
 		log.InfoWithFields("Portunus running, listening for TLS connections", log.Fields{"bind_address": s.address})
-		log.Error(s.server.ServeTLS(*listener, Settings.Server.TLS.Cert, Settings.Server.TLS.Key))
+		// certificates are provided by s.server.TLSConfig
+		log.Error(s.server.ServeTLS(*listener, "", ""))
 	} else {
 		log.InfoWithFields("Portunus running, listening for non-TLS connections", log.Fields{"bind_address": s.address})
 		log.Error(s.server.Serve(*listener))
@@ -167,20 +422,50 @@ func (s *Server) ListenAndServe() {
 
 func (s *Server) HandleSignalShutdown() {
 	log.Info("Server is shutting down")
-	ctx, cancel := context.WithTimeout(context.Background(),
-		Settings.Server.ShutdownTimeout*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), Settings().Server.ShutdownTimeout)
 	defer cancel()
 
 	s.server.SetKeepAlivesEnabled(false)
 	if err := s.server.Shutdown(ctx); err != nil {
 		log.Panicf("cannot gracefully shut down the server: %s", err)
 	}
+	// Shutdown doesn't wait for upgraded connections
+	s.tunnels.Drain(ctx)
+	s.acme.Shutdown(ctx)
+	if err := s.Tracer().Shutdown(ctx); err != nil {
+		log.ErrorWithFields("Unable to flush traces", log.Fields{"error": err})
+	}
+	s.AccessLog().Close()
 	close(s.finished)
 	return
 }
 
 func (s *Server) HandleSignalReload() {
-	return
+	if s.configSource == nil || Settings().ConfigFile == "" {
+		log.Warnf("Received config reload request when no config provided")
+		return
+	}
+
+	log.Infof("Reloading configuration on SIGHUP")
+	settings, err := s.configSource()
+	if err == nil {
+		err = s.Reload(settings)
+	}
+	if err != nil {
+		log.ErrorWithFields("Configuration reload failed; keeping current configuration", log.Fields{"error": err})
+	}
+}
+
+// HandleSignalReopen reopens the access log and log files, so that they can
+// be rotated by an external tool like logrotate.
+func (s *Server) HandleSignalReopen() {
+	log.Info("Reopening log files on SIGUSR1")
+	if err := s.AccessLog().Reopen(); err != nil {
+		log.ErrorWithFields("Unable to reopen access log", log.Fields{"error": err})
+	}
+	if err := log.Reopen(); err != nil {
+		log.ErrorWithFields("Unable to reopen log file", log.Fields{"error": err})
+	}
 }
 
 func (s *Server) SetupSignalHandlers() error {
@@ -198,7 +483,9 @@ func (s *Server) SetupSignalHandlers() error {
 				s.HandleSignalShutdown()
 			case syscall.SIGHUP:
 				s.HandleSignalReload()
-			case syscall.SIGUSR1, syscall.SIGUSR2:
+			case syscall.SIGUSR1:
+				s.HandleSignalReopen()
+			case syscall.SIGUSR2:
 				// reserved
 			default:
 				log.Warnf("unhandled signal: %+v", signal)
@@ -211,7 +498,7 @@ func (s *Server) SetupSignalHandlers() error {
 
 func (s *Server) Run() int {
 	defer s.logger.Close()
-	runtime.GOMAXPROCS(Settings.Server.Threads)
+	runtime.GOMAXPROCS(Settings().Server.Threads)
 
 	s.SetupSignalHandlers()
 	s.ListenAndServe()
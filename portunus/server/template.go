@@ -0,0 +1,417 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Template is a precompiled interpolation template, such as an upstream url or
+// header value. Templates contain literal text and expressions wrapped in
+// double braces, e.g.:
+//
+//	http://{{route.name}}.{{req.header.x-domain | default "prod" | lower}}
+//
+// Each expression is a variable, optionally piped through one or more
+// functions. Variables:
+//
+//	route.name, route.match, route.host  matched route name, path and host
+//	route.param.<name>                   path pattern capture
+//	req.host, req.method, req.path       request host, method and path
+//	req.uri, req.scheme                  request uri and scheme (http/https)
+//	req.query.<name>                     query string parameter
+//	req.cookie.<name>                    cookie value
+//	req.header.<name>                    request header (values joined by ", ")
+//	req.remote_ip                        client ip address
+//	req.sni                              TLS server name sent by the client
+//	req.client_cert.<field>              verified client certificate's subject,
+//	                                     issuer, common_name, serial, sans or
+//	                                     fingerprint (SHA-256, hex)
+//	res.status                           response status code
+//	res.header.<name>                    response header
+//	env.<NAME>                           environment variable (read at load)
+//	log.<field>                          access log field (access log only)
+//
+// Functions:
+//
+//	default "<value>"                    use <value> when the input is empty
+//	lower, upper, trim                   change case / trim whitespace
+//	replace "<regex>" "<replacement>"    regex replace ($1 etc. expand groups)
+//	urlescape                            escape for use in a query string
+type Template struct {
+	source   string
+	segments []templateSegment
+}
+
+type templateSegment struct {
+	literal string
+	value   func(ctx *templateContext) string
+	filters []func(string) string
+}
+
+// templateContext is what a template is evaluated against. Only route is
+// guaranteed to be non-nil.
+type templateContext struct {
+	route *Route
+	req   *http.Request
+	resp  *http.Response
+	entry *accessLogEntry
+}
+
+var templateFunctions = map[string]func(args []string) (func(string) string, error){
+	"default": func(args []string) (func(string) string, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("default expects 1 argument, got %d", len(args))
+		}
+		fallback := args[0]
+		return func(value string) string {
+			if value == "" {
+				return fallback
+			}
+			return value
+		}, nil
+	},
+	"lower": noArgFunction("lower", strings.ToLower),
+	"upper": noArgFunction("upper", strings.ToUpper),
+	"trim":  noArgFunction("trim", strings.TrimSpace),
+	"replace": func(args []string) (func(string) string, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("replace expects 2 arguments, got %d", len(args))
+		}
+		pattern, err := regexp.Compile(args[0])
+		if err != nil {
+			return nil, fmt.Errorf("replace: %s", err)
+		}
+		replacement := args[1]
+		return func(value string) string {
+			return pattern.ReplaceAllString(value, replacement)
+		}, nil
+	},
+	"urlescape": noArgFunction("urlescape", url.QueryEscape),
+}
+
+func noArgFunction(name string, fn func(string) string) func(args []string) (func(string) string, error) {
+	return func(args []string) (func(string) string, error) {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("%s expects no arguments, got %d", name, len(args))
+		}
+		return fn, nil
+	}
+}
+
+// CompileTemplate parses the template source, returning an error for unknown
+// variables or functions, or malformed expressions.
+func CompileTemplate(source string) (*Template, error) {
+	tmpl := &Template{source: source}
+
+	for rest := source; rest != ""; {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			tmpl.segments = append(tmpl.segments, templateSegment{literal: rest})
+			break
+		}
+
+		if start > 0 {
+			tmpl.segments = append(tmpl.segments, templateSegment{literal: rest[:start]})
+		}
+
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("template %q: unterminated expression", source)
+		}
+
+		segment, err := compileExpression(rest[start+2 : start+end])
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %s", source, err)
+		}
+
+		tmpl.segments = append(tmpl.segments, segment)
+		rest = rest[start+end+2:]
+	}
+
+	return tmpl, nil
+}
+
+func (t *Template) String() string {
+	return t.source
+}
+
+// IsStatic reports whether the template contains no expressions.
+func (t *Template) IsStatic() bool {
+	for _, segment := range t.segments {
+		if segment.value != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Execute renders the template for the given route and request or response.
+func (t *Template) Execute(route *Route, httpObj interface{}) string {
+	ctx := &templateContext{route: route}
+
+	switch obj := httpObj.(type) {
+	case *http.Request:
+		ctx.req = obj
+	case *http.Response:
+		ctx.resp = obj
+		ctx.req = obj.Request
+	case *accessLogEntry:
+		ctx.entry = obj
+		ctx.req = obj.request
+	}
+
+	return t.execute(ctx)
+}
+
+func (t *Template) execute(ctx *templateContext) string {
+	if len(t.segments) == 1 && t.segments[0].value == nil {
+		return t.segments[0].literal
+	}
+
+	var buffer strings.Builder
+	for _, segment := range t.segments {
+		if segment.value == nil {
+			buffer.WriteString(segment.literal)
+			continue
+		}
+
+		value := segment.value(ctx)
+		for _, filter := range segment.filters {
+			value = filter(value)
+		}
+		buffer.WriteString(value)
+	}
+
+	return buffer.String()
+}
+
+func compileExpression(expression string) (templateSegment, error) {
+	var segment templateSegment
+
+	tokens, err := tokenizeExpression(expression)
+	if err != nil {
+		return segment, err
+	}
+
+	// split the tokens into the variable, and each piped function call
+	var stages [][]string
+	stage := []string{}
+	for _, token := range tokens {
+		if token == "|" {
+			stages = append(stages, stage)
+			stage = []string{}
+			continue
+		}
+		stage = append(stage, token)
+	}
+	stages = append(stages, stage)
+
+	if len(stages[0]) != 1 {
+		return segment, fmt.Errorf("expected a single variable in %q", expression)
+	}
+
+	if segment.value, err = compileVariable(unquote(stages[0][0])); err != nil {
+		return segment, err
+	}
+
+	for _, stage := range stages[1:] {
+		if len(stage) == 0 {
+			return segment, fmt.Errorf("empty function in %q", expression)
+		}
+
+		constructor, ok := templateFunctions[stage[0]]
+		if !ok {
+			return segment, fmt.Errorf("unknown function %q", stage[0])
+		}
+
+		args := make([]string, 0, len(stage)-1)
+		for _, arg := range stage[1:] {
+			args = append(args, unquote(arg))
+		}
+
+		filter, err := constructor(args)
+		if err != nil {
+			return segment, err
+		}
+		segment.filters = append(segment.filters, filter)
+	}
+
+	return segment, nil
+}
+
+// tokenizeExpression splits an expression into words, quoted strings (kept
+// with their quotes) and pipes.
+func tokenizeExpression(expression string) ([]string, error) {
+	var tokens []string
+
+	for idx := 0; idx < len(expression); {
+		switch char := expression[idx]; {
+		case char == ' ' || char == '\t':
+			idx++
+		case char == '|':
+			tokens = append(tokens, "|")
+			idx++
+		case char == '"' || char == '\'':
+			end := idx + 1
+			for ; end < len(expression) && expression[end] != char; end++ {
+				if expression[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(expression) {
+				return nil, fmt.Errorf("unterminated string in %q", expression)
+			}
+			tokens = append(tokens, expression[idx:end+1])
+			idx = end + 1
+		default:
+			end := idx
+			for ; end < len(expression) && !strings.ContainsRune(" \t|\"'", rune(expression[end])); end++ {
+			}
+			tokens = append(tokens, expression[idx:end])
+			idx = end
+		}
+	}
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	return tokens, nil
+}
+
+func unquote(token string) string {
+	if len(token) >= 2 && (token[0] == '"' || token[0] == '\'') {
+		if token[0] == '"' {
+			if value, err := strconv.Unquote(token); err == nil {
+				return value
+			}
+		}
+		return token[1 : len(token)-1]
+	}
+	return token
+}
+
+func compileVariable(name string) (func(ctx *templateContext) string, error) {
+	parts := strings.SplitN(name, ".", 3)
+
+	switch {
+	case name == "route.name":
+		return func(ctx *templateContext) string { return ctx.route.Name }, nil
+	case name == "route.match":
+		return func(ctx *templateContext) string { return ctx.route.MatchedPath }, nil
+	case name == "route.host":
+		return func(ctx *templateContext) string { return ctx.route.MatchedHost }, nil
+	case len(parts) == 3 && parts[0] == "route" && parts[1] == "param":
+		param := parts[2]
+		return withRequest(func(req *http.Request) string {
+			return getRequestState(req).Params[param]
+		}), nil
+
+	case name == "req.host":
+		return withRequest(func(req *http.Request) string { return req.Host }), nil
+	case name == "req.method":
+		return withRequest(func(req *http.Request) string { return req.Method }), nil
+	case name == "req.path":
+		return withRequest(func(req *http.Request) string { return req.URL.Path }), nil
+	case name == "req.uri":
+		return withRequest(func(req *http.Request) string { return req.URL.RequestURI() }), nil
+	case name == "req.scheme":
+		return withRequest(func(req *http.Request) string {
+			if req.TLS != nil {
+				return "https"
+			}
+			return "http"
+		}), nil
+	case name == "req.remote_ip":
+		return withRequest(clientIP), nil
+	case name == "req.sni":
+		return withRequest(func(req *http.Request) string {
+			if req.TLS != nil {
+				return req.TLS.ServerName
+			}
+			return ""
+		}), nil
+	case len(parts) == 3 && parts[0] == "req" && parts[1] == "client_cert" && isClientCertField(parts[2]):
+		field := parts[2]
+		return withRequest(func(req *http.Request) string { return clientCertField(req, field) }), nil
+	case len(parts) == 3 && parts[0] == "req" && parts[1] == "query":
+		param := parts[2]
+		return withRequest(func(req *http.Request) string { return req.URL.Query().Get(param) }), nil
+	case len(parts) == 3 && parts[0] == "req" && parts[1] == "cookie":
+		cookie := parts[2]
+		return withRequest(func(req *http.Request) string {
+			if c, err := req.Cookie(cookie); err == nil {
+				return c.Value
+			}
+			return ""
+		}), nil
+	case len(parts) == 3 && parts[0] == "req" && parts[1] == "header":
+		header := http.CanonicalHeaderKey(parts[2])
+		return withRequest(func(req *http.Request) string {
+			return strings.Join(req.Header[header], ", ")
+		}), nil
+
+	case name == "res.status":
+		return func(ctx *templateContext) string {
+			if ctx.resp == nil {
+				return ""
+			}
+			return strconv.Itoa(ctx.resp.StatusCode)
+		}, nil
+	case len(parts) == 3 && parts[0] == "res" && parts[1] == "header":
+		header := http.CanonicalHeaderKey(parts[2])
+		return func(ctx *templateContext) string {
+			if ctx.resp == nil {
+				return ""
+			}
+			return strings.Join(ctx.resp.Header[header], ", ")
+		}, nil
+
+	case len(parts) >= 2 && parts[0] == "log":
+		field, ok := accessLogFields[strings.TrimPrefix(name, "log.")]
+		if !ok {
+			break
+		}
+		return func(ctx *templateContext) string {
+			if ctx.entry == nil {
+				return ""
+			}
+			return fmt.Sprint(field(ctx.entry))
+		}, nil
+
+	case len(parts) >= 2 && parts[0] == "env":
+		value := os.Getenv(strings.TrimPrefix(name, "env."))
+		return func(*templateContext) string { return value }, nil
+	}
+
+	return nil, fmt.Errorf("unknown variable %q", name)
+}
+
+func withRequest(fn func(req *http.Request) string) func(ctx *templateContext) string {
+	return func(ctx *templateContext) string {
+		if ctx.req == nil {
+			return ""
+		}
+		return fn(ctx.req)
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// templateTestCert returns a client certificate, as it would appear in the
+// request's verified chains.
+func templateTestCert(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(4242),
+		Subject:      pkix.Name{CommonName: "client.example.com", Organization: []string{"Portunus"}},
+		DNSNames:     []string{"client.example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("10.1.2.3")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func templateTestRequest(t *testing.T) (*Route, *http.Request) {
+	route := &Route{Name: "api", MatchedPath: "/users/:id", MatchedHost: "*.example.com"}
+
+	req := httptest.NewRequest("POST", "https://api.example.com/users/42?page=2&q=a+b", nil)
+	req.RemoteAddr = "192.0.2.10:54321"
+	req.Header.Add("X-Domain", "Staging")
+	req.Header.Add("Accept", "text/html")
+	req.Header.Add("Accept", "application/json")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc123"})
+	req.TLS = &tls.ConnectionState{
+		ServerName:     "api.example.com",
+		VerifiedChains: [][]*x509.Certificate{{templateTestCert(t)}},
+	}
+
+	req, state := withRequestState(req)
+	state.Route = route
+	state.Params = map[string]string{"id": "42"}
+	state.Upstream = "users.internal:8080"
+
+	return route, req
+}
+
+func TestTemplateVariables(t *testing.T) {
+	t.Setenv("PORTUNUS_TEMPLATE_TEST", "from-env")
+
+	route, req := templateTestRequest(t)
+	cert := req.TLS.VerifiedChains[0][0]
+
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"{{route.name}}", "api"},
+		{"{{route.match}}", "/users/:id"},
+		{"{{route.host}}", "*.example.com"},
+		{"{{route.param.id}}", "42"},
+		{"{{route.param.missing}}", ""},
+		{"{{req.host}}", "api.example.com"},
+		{"{{req.method}}", "POST"},
+		{"{{req.path}}", "/users/42"},
+		{"{{req.uri}}", "/users/42?page=2&q=a+b"},
+		{"{{req.scheme}}", "https"},
+		{"{{req.query.page}}", "2"},
+		{"{{req.query.q}}", "a b"},
+		{"{{req.query.missing}}", ""},
+		{"{{req.cookie.session}}", "abc123"},
+		{"{{req.cookie.missing}}", ""},
+		{"{{req.header.x-domain}}", "Staging"},
+		{"{{req.header.accept}}", "text/html, application/json"},
+		{"{{req.header.missing}}", ""},
+		{"{{req.remote_ip}}", "192.0.2.10"},
+		{"{{req.sni}}", "api.example.com"},
+		{"{{req.client_cert.subject}}", cert.Subject.String()},
+		{"{{req.client_cert.issuer}}", cert.Issuer.String()},
+		{"{{req.client_cert.common_name}}", "client.example.com"},
+		{"{{req.client_cert.serial}}", "4242"},
+		{"{{req.client_cert.sans}}", "client.example.com,10.1.2.3"},
+		{"{{req.client_cert.fingerprint}}", clientCertFingerprint(cert)},
+		{"{{env.PORTUNUS_TEMPLATE_TEST}}", "from-env"},
+		{"{{env.PORTUNUS_TEMPLATE_TEST_UNSET}}", ""},
+
+		// response variables are empty when rendering a request
+		{"{{res.status}}", ""},
+		{"{{res.header.content-type}}", ""},
+		// as are access log fields
+		{"{{log.status}}", ""},
+
+		// literals, several expressions, and functions
+		{"plain text", "plain text"},
+		{"", ""},
+		{"http://{{route.name}}.{{req.header.x-domain | lower}}:8080{{req.path}}", "http://api.staging:8080/users/42"},
+		{"{{ req.method }}", "POST"},
+		{"{{req.header.x-missing | default \"prod\"}}", "prod"},
+		{"{{req.header.x-domain | default 'prod'}}", "Staging"},
+		{"{{req.header.x-domain | upper}}", "STAGING"},
+		{"{{req.header.x-missing | default \"  padded  \" | trim}}", "padded"},
+		{"{{req.path | replace \"^/users/([0-9]+)$\" \"/v2/user/$1\"}}", "/v2/user/42"},
+		{"{{req.query.q | urlescape}}", "a+b"},
+		{"{{req.header.x-missing | default \"a \\\"quoted\\\" value\"}}", `a "quoted" value`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.source, func(t *testing.T) {
+			tmpl, err := CompileTemplate(test.source)
+			if err != nil {
+				t.Fatalf("CompileTemplate: %v", err)
+			}
+			if got := tmpl.Execute(route, req); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if tmpl.String() != test.source {
+				t.Errorf("String() = %q, want %q", tmpl.String(), test.source)
+			}
+		})
+	}
+}
+
+func TestTemplateWithoutTLS(t *testing.T) {
+	route := &Route{Name: "api"}
+	req := httptest.NewRequest("GET", "http://api.example.com/", nil)
+
+	tests := map[string]string{
+		"{{req.scheme}}":                  "http",
+		"{{req.sni}}":                     "",
+		"{{req.client_cert.subject}}":     "",
+		"{{req.client_cert.fingerprint}}": "",
+	}
+
+	for source, want := range tests {
+		tmpl, err := CompileTemplate(source)
+		if err != nil {
+			t.Fatalf("%s: CompileTemplate: %v", source, err)
+		}
+		if got := tmpl.Execute(route, req); got != want {
+			t.Errorf("%s: got %q, want %q", source, got, want)
+		}
+	}
+}
+
+func TestTemplateResponseVariables(t *testing.T) {
+	route, req := templateTestRequest(t)
+	resp := &http.Response{
+		StatusCode: http.StatusCreated,
+		Header:     http.Header{"Content-Type": {"application/json"}, "Vary": {"Accept", "Origin"}},
+		Request:    req,
+	}
+
+	tests := map[string]string{
+		"{{res.status}}":              "201",
+		"{{res.header.content-type}}": "application/json",
+		"{{res.header.vary}}":         "Accept, Origin",
+		"{{res.header.missing}}":      "",
+		// the request is still available when rendering a response
+		"{{req.method}} {{req.path}}": "POST /users/42",
+	}
+
+	for source, want := range tests {
+		tmpl, err := CompileTemplate(source)
+		if err != nil {
+			t.Fatalf("%s: CompileTemplate: %v", source, err)
+		}
+		if got := tmpl.Execute(route, resp); got != want {
+			t.Errorf("%s: got %q, want %q", source, got, want)
+		}
+	}
+}
+
+func TestTemplateLogVariables(t *testing.T) {
+	route, req := templateTestRequest(t)
+	entry := &accessLogEntry{
+		start:    time.Now(),
+		request:  req,
+		status:   http.StatusNoContent,
+		bytes:    512,
+		duration: 1500 * time.Microsecond,
+		state:    getRequestState(req),
+	}
+
+	tests := map[string]string{
+		"{{log.status}}":              "204",
+		"{{log.bytes}}":               "512",
+		"{{log.duration_ms}}":         "1.5",
+		"{{log.route}}":               "api",
+		"{{log.upstream}}":            "users.internal:8080",
+		"{{log.remote_ip}}":           "192.0.2.10",
+		"{{log.method}} {{req.host}}": "POST api.example.com",
+	}
+
+	for source, want := range tests {
+		tmpl, err := CompileTemplate(source)
+		if err != nil {
+			t.Fatalf("%s: CompileTemplate: %v", source, err)
+		}
+		if got := tmpl.Execute(route, entry); got != want {
+			t.Errorf("%s: got %q, want %q", source, got, want)
+		}
+	}
+}
+
+func TestTemplateIsStatic(t *testing.T) {
+	tests := map[string]bool{
+		"":                            true,
+		"http://static.example.com":   true,
+		"http://{{req.host}}":         false,
+		"http://{{env.HOME}}:8080/":   false,
+		"{{route.name}}-{{req.path}}": false,
+	}
+
+	for source, want := range tests {
+		tmpl, err := CompileTemplate(source)
+		if err != nil {
+			t.Fatalf("%s: CompileTemplate: %v", source, err)
+		}
+		if got := tmpl.IsStatic(); got != want {
+			t.Errorf("%s: IsStatic() = %v, want %v", source, got, want)
+		}
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string
+	}{
+		// unknown variables
+		{"{{route.unknown}}", `unknown variable "route.unknown"`},
+		{"{{req}}", `unknown variable "req"`},
+		{"{{req.query}}", `unknown variable "req.query"`},
+		{"{{req.client_cert.email}}", `unknown variable "req.client_cert.email"`},
+		{"{{res.body}}", `unknown variable "res.body"`},
+		{"{{log.unknown}}", `unknown variable "log.unknown"`},
+		{"{{env}}", `unknown variable "env"`},
+		{"{{nope}}", `unknown variable "nope"`},
+
+		// malformed expressions
+		{"http://{{req.host", "unterminated expression"},
+		{"{{req.host}} and {{req.path", "unterminated expression"},
+		{`{{req.host | default "prod}}`, "unterminated string"},
+		{`{{req.host | default 'prod}}`, "unterminated string"},
+		{"{{}}", "empty expression"},
+		{"{{   }}", "empty expression"},
+		{"{{req.host req.path}}", "expected a single variable"},
+		{"{{| lower}}", "expected a single variable"},
+		{"{{req.host |}}", "empty function"},
+		{"{{req.host || lower}}", "empty function"},
+
+		// functions
+		{"{{req.host | shout}}", `unknown function "shout"`},
+		{"{{req.host | default}}", "default expects 1 argument, got 0"},
+		{`{{req.host | default "a" "b"}}`, "default expects 1 argument, got 2"},
+		{`{{req.host | lower "a"}}`, "lower expects no arguments, got 1"},
+		{`{{req.host | urlescape "a"}}`, "urlescape expects no arguments, got 1"},
+		{`{{req.host | replace "a"}}`, "replace expects 2 arguments, got 1"},
+		{`{{req.host | replace "(" "b"}}`, "replace: error parsing regexp"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.source, func(t *testing.T) {
+			tmpl, err := CompileTemplate(test.source)
+			if err == nil {
+				t.Fatalf("expected an error, got template %q", tmpl)
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error %q doesn't contain %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ErrorResponseHeaderTimeout is returned when an upstream doesn't send its
+// response headers within the route's response_header timeout.
+var ErrorResponseHeaderTimeout error = timeoutError("timed out waiting for upstream response headers")
+
+// timeoutError is a net.Error, so that it's treated like any other timeout
+// (see isTimeout).
+type timeoutError string
+
+func (e timeoutError) Error() string   { return string(e) }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+// RouteTimeouts are a route's effective upstream timeouts: its own where
+// set, and the global network timeouts otherwise. Zero means no limit.
+type RouteTimeouts struct {
+	// establishing the upstream connection
+	Connect time.Duration
+	// from sending the request until the upstream's response headers arrive
+	ResponseHeader time.Duration
+	// the whole request, across retries, including the response body
+	Total time.Duration
+	// how long idle upstream connections are kept in the pool
+	IdleConnection time.Duration
+}
+
+// globalTimeouts are the timeouts of routes that don't override any.
+func globalTimeouts(global ConfigNetworkTimeouts) RouteTimeouts {
+	return RouteTimeouts{
+		Connect:        global.Connect,
+		ResponseHeader: global.ResponseHeader,
+		Total:          global.Total,
+		IdleConnection: global.IdleConnection,
+	}
+}
+
+// NewRouteTimeouts overrides the global timeouts with the route's.
+func NewRouteTimeouts(global ConfigNetworkTimeouts, route ConfigRouteTimeouts) (RouteTimeouts, error) {
+	timeouts := globalTimeouts(global)
+
+	overrides := []struct {
+		name  string
+		value time.Duration
+		field *time.Duration
+	}{
+		{"connect", route.Connect, &timeouts.Connect},
+		{"response_header", route.ResponseHeader, &timeouts.ResponseHeader},
+		{"total", route.Total, &timeouts.Total},
+		{"idle_connection", route.IdleConnection, &timeouts.IdleConnection},
+	}
+
+	for _, override := range overrides {
+		if override.value < 0 {
+			return timeouts, fmt.Errorf("timeouts.%s can't be negative", override.name)
+		} else if override.value > 0 {
+			*override.field = override.value
+		}
+	}
+
+	return timeouts, nil
+}
+
+// withTotal bounds the request by the total timeout, if there is one. The
+// returned cancel func must be called once the response has been consumed.
+func (timeouts RouteTimeouts) withTotal(request *http.Request) (*http.Request, context.CancelFunc) {
+	if timeouts.Total <= 0 {
+		return request, func() {}
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), timeouts.Total)
+	return request.WithContext(ctx), cancel
+}
+
+// awaitResponseHeader calls expire if the response headers haven't arrived
+// within the response header timeout. The returned func must be called once
+// they have, and reports whether the timeout had already expired.
+func (timeouts RouteTimeouts) awaitResponseHeader(expire func()) (stop func() (expired bool)) {
+	if timeouts.ResponseHeader <= 0 {
+		return func() bool { return false }
+	}
+
+	timer := time.AfterFunc(timeouts.ResponseHeader, expire)
+	return func() bool { return !timer.Stop() }
+}
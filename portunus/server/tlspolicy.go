@@ -0,0 +1,232 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+const (
+	TLSProfileModern       = "modern"
+	TLSProfileIntermediate = "intermediate"
+	TLSProfileLegacy       = "legacy"
+
+	DefaultTLSProfile = TLSProfileIntermediate
+)
+
+// TLSPolicy is the protocol versions, cipher suites and curves the listener
+// accepts.
+type TLSPolicy struct {
+	MinVersion   uint16
+	MaxVersion   uint16
+	CipherSuites []uint16
+	Curves       []tls.CurveID
+}
+
+// intermediateCipherSuites are forward secret AEAD suites, for both ECDSA and
+// RSA certificates.
+var intermediateCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// tlsProfiles roughly follow Mozilla's server side TLS recommendations. TLS
+// 1.3 cipher suites aren't configurable, and profiles leave the curves to
+// Go's defaults, which prefer X25519.
+var tlsProfiles = map[string]TLSPolicy{
+	TLSProfileModern: {
+		MinVersion: tls.VersionTLS13,
+		MaxVersion: tls.VersionTLS13,
+	},
+	TLSProfileIntermediate: {
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS13,
+		CipherSuites: intermediateCipherSuites,
+	},
+	// for very old clients; still excludes RC4 and 3DES
+	TLSProfileLegacy: {
+		MinVersion: tls.VersionTLS10,
+		MaxVersion: tls.VersionTLS13,
+		CipherSuites: append(append([]uint16{}, intermediateCipherSuites...),
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		),
+	},
+}
+
+var tlsVersions = map[string]uint16{
+	"1":   tls.VersionTLS10, // an unquoted 1.0 in YAML
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p256":   tls.CurveP256,
+	"p384":   tls.CurveP384,
+	"p521":   tls.CurveP521,
+}
+
+// parseTLSVersion parses a version like "1.2" (or "TLS1.2").
+func parseTLSVersion(version string) (uint16, error) {
+	name := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(version)), "tls")
+	if value, ok := tlsVersions[strings.TrimSpace(name)]; ok {
+		return value, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", version)
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// cipherSuitesByName indexes every cipher suite Go implements, including the
+// insecure ones, by its IANA name (e.g., TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256).
+func cipherSuitesByName() map[string]*tls.CipherSuite {
+	suites := make(map[string]*tls.CipherSuite)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite
+	}
+	return suites
+}
+
+// NewTLSPolicy builds the policy from the TLS config's profile, overriding
+// it with any versions, cipher suites or curves that are set explicitly.
+func NewTLSPolicy(config ConfigTLS) (*TLSPolicy, error) {
+	profile := strings.ToLower(config.Profile)
+	if profile == "" {
+		profile = DefaultTLSProfile
+	}
+
+	base, ok := tlsProfiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("server.tls.profile: unknown profile %q", config.Profile)
+	}
+	policy := base
+
+	var err error
+	if config.MinVersion != "" {
+		if policy.MinVersion, err = parseTLSVersion(config.MinVersion); err != nil {
+			return nil, fmt.Errorf("server.tls.min_version: %s", err)
+		}
+	}
+	if config.MaxVersion != "" {
+		if policy.MaxVersion, err = parseTLSVersion(config.MaxVersion); err != nil {
+			return nil, fmt.Errorf("server.tls.max_version: %s", err)
+		}
+	}
+	if policy.MinVersion > policy.MaxVersion {
+		return nil, fmt.Errorf("server.tls: min_version %s is greater than max_version %s",
+			tlsVersionName(policy.MinVersion), tlsVersionName(policy.MaxVersion))
+	}
+
+	if len(config.CipherSuites) > 0 {
+		suites := cipherSuitesByName()
+		policy.CipherSuites = nil
+		for _, name := range config.CipherSuites {
+			suite, ok := suites[strings.ToUpper(strings.TrimSpace(name))]
+			if !ok {
+				return nil, fmt.Errorf("server.tls.cipher_suites: unknown cipher suite %q", name)
+			}
+
+			// TLS 1.3 suites are always enabled, and can't be configured
+			if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+				return nil, fmt.Errorf("server.tls.cipher_suites: %s is a TLS 1.3 suite, which can't be configured", suite.Name)
+			}
+
+			policy.CipherSuites = append(policy.CipherSuites, suite.ID)
+		}
+	}
+
+	if len(config.Curves) > 0 {
+		policy.Curves = nil
+		for _, name := range config.Curves {
+			key := strings.ToLower(strings.Replace(strings.TrimSpace(name), "-", "", -1))
+			curve, ok := tlsCurves[key]
+			if !ok {
+				return nil, fmt.Errorf("server.tls.curves: unknown curve %q", name)
+			}
+			policy.Curves = append(policy.Curves, curve)
+		}
+	}
+
+	if policy.MinVersion < tls.VersionTLS13 && len(policy.CipherSuites) == 0 {
+		return nil, fmt.Errorf("server.tls.cipher_suites: at least one suite is needed for TLS %s", tlsVersionName(policy.MinVersion))
+	}
+
+	return &policy, nil
+}
+
+// Apply sets the policy on the TLS config.
+func (policy *TLSPolicy) Apply(config *tls.Config) {
+	config.MinVersion = policy.MinVersion
+	config.MaxVersion = policy.MaxVersion
+	config.CipherSuites = policy.CipherSuites
+	config.CurvePreferences = policy.Curves
+}
+
+// CheckCertificate returns an error if a TLS 1.2 (or older) handshake with
+// the certificate couldn't succeed, because none of the policy's cipher
+// suites support its key type. TLS 1.3 suites work with any key type.
+func (policy *TLSPolicy) CheckCertificate(leaf *x509.Certificate) error {
+	if policy.MinVersion >= tls.VersionTLS13 {
+		return nil
+	}
+
+	var keyType, suiteKind string
+	switch leaf.PublicKeyAlgorithm {
+	case x509.RSA:
+		keyType, suiteKind = "RSA", "_RSA_"
+	case x509.ECDSA, x509.Ed25519:
+		keyType, suiteKind = leaf.PublicKeyAlgorithm.String(), "_ECDSA_"
+	default:
+		return fmt.Errorf("unsupported %s key", leaf.PublicKeyAlgorithm)
+	}
+
+	for _, id := range policy.CipherSuites {
+		if strings.Contains(tls.CipherSuiteName(id), suiteKind) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("certificate has an %s key, but none of the cipher suites support it for TLS %s",
+		keyType, tlsVersionName(policy.MinVersion))
+}
@@ -0,0 +1,169 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+
+	"github.com/rabbitt/portunus/portunus"
+	"github.com/rabbitt/portunus/portunus/tracing"
+	"github.com/zenazn/goji/web/mutil"
+)
+
+const (
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+	TracingExporterFile   = "file"
+)
+
+// NewTracer builds the tracer described by the config, returning nil if
+// tracing is disabled.
+func NewTracer(config *Config) (*tracing.Tracer, error) {
+	if !config.Tracing.Enabled {
+		return nil, nil
+	}
+
+	var exporter tracing.Exporter
+	var err error
+
+	switch exporterConfig := config.Tracing.Exporter; strings.ToLower(exporterConfig.Type) {
+	case "", TracingExporterOTLP:
+		exporter, err = tracing.NewOTLPExporter(exporterConfig.Endpoint, exporterConfig.Headers,
+			exporterConfig.Timeout, config.Tracing.ServiceName, portunus.VersionStr)
+	case TracingExporterStdout:
+		exporter, err = tracing.NewWriterExporter("")
+	case TracingExporterFile:
+		if exporterConfig.Path == "" {
+			return nil, fmt.Errorf("tracing.exporter.path is required for the file exporter")
+		}
+		exporter, err = tracing.NewWriterExporter(exporterConfig.Path)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", exporterConfig.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tracing.NewTracer(tracing.Options{
+		ServiceName: config.Tracing.ServiceName,
+		SampleRatio: config.Tracing.SampleRatio,
+		Propagation: config.Tracing.Propagation,
+		Exporter:    exporter,
+	})
+}
+
+// traceRequest wraps the handler in a server span, joining the client's trace
+// if the request carries one.
+func (server *Server) traceRequest(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tracer := server.Tracer()
+		if tracer == nil {
+			h(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		if remote, ok := tracer.Extract(r.Header); ok {
+			ctx = tracing.ContextWithRemote(ctx, remote)
+		}
+
+		ctx, span := tracer.Start(ctx, "HTTP "+r.Method, tracing.SpanKindServer)
+		defer span.End()
+
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.host", r.Host)
+		span.SetAttribute("http.target", r.RequestURI)
+		span.SetAttribute("http.user_agent", r.UserAgent())
+		span.SetAttribute("net.peer.ip", clientIP(r))
+
+		state := getRequestState(r)
+		state.TraceID = span.Context().TraceID.String()
+
+		wrappedWriter := mutil.WrapWriter(w)
+		h(wrappedWriter, r.WithContext(ctx))
+
+		if state.Route != nil {
+			span.SetAttribute("portunus.route", state.Route.Name)
+			span.SetAttribute("http.route", state.Route.MatchedPath)
+		}
+
+		status := wrappedWriter.Status()
+		span.SetAttribute("http.status_code", status)
+		if status >= 500 {
+			span.SetError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+		}
+	}
+}
+
+// startSpan starts a child of the request's current span, if the request is
+// being traced.
+func (server *Server) startSpan(ctx context.Context, name string, kind tracing.SpanKind) (context.Context, *tracing.Span) {
+	if tracing.SpanFromContext(ctx) == nil {
+		return ctx, nil
+	}
+	return server.Tracer().Start(ctx, name, kind)
+}
+
+// withConnectSpans returns a copy of the context that records a span for
+// each new upstream connection (and TLS handshake) made for the request.
+func (server *Server) withConnectSpans(ctx context.Context) context.Context {
+	if tracing.SpanFromContext(ctx) == nil {
+		return ctx
+	}
+
+	// dual stack dials may attempt several addresses at once
+	var mutex sync.Mutex
+	connectSpans := make(map[string]*tracing.Span)
+	var tlsSpan *tracing.Span
+
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			_, span := server.startSpan(ctx, "upstream connect", tracing.SpanKindInternal)
+			span.SetAttribute("net.peer.name", addr)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			connectSpans[addr] = span
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if span, ok := connectSpans[addr]; ok {
+				span.SetError(err)
+				span.End()
+				delete(connectSpans, addr)
+			}
+		},
+		TLSHandshakeStart: func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			_, tlsSpan = server.startSpan(ctx, "upstream tls handshake", tracing.SpanKindInternal)
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			tlsSpan.SetError(err)
+			tlsSpan.End()
+		},
+	})
+}
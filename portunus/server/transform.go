@@ -0,0 +1,122 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	TransformModeMerge   = "merge"
+	TransformModeReplace = "replace"
+)
+
+type headerRule struct {
+	Header string
+	Value  *Template
+}
+
+// HeaderTransform is a compiled set of header rules, applied in the order:
+// insert, override, delete. Rules within each step are sorted by header name
+// so they're applied in a predictable order.
+type HeaderTransform struct {
+	Insert   []headerRule
+	Override []headerRule
+	Delete   []string
+}
+
+// Transforms holds the layers of header transforms applied to a route's
+// requests and responses. Layers are applied in order, each one seeing the
+// result of the one before it.
+type Transforms struct {
+	Request  []*HeaderTransform
+	Response []*HeaderTransform
+}
+
+func compileHeaderRules(rules map[string]string) ([]headerRule, error) {
+	compiled := make([]headerRule, 0, len(rules))
+	for header, value := range rules {
+		tmpl, err := CompileTemplate(value)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %s", header, err)
+		}
+		compiled = append(compiled, headerRule{Header: http.CanonicalHeaderKey(header), Value: tmpl})
+	}
+
+	sort.Slice(compiled, func(i, j int) bool { return compiled[i].Header < compiled[j].Header })
+
+	return compiled, nil
+}
+
+// NewHeaderTransform compiles a transform entry, returning nil if it's empty.
+func NewHeaderTransform(entry ConfigTransformEntry) (transform *HeaderTransform, err error) {
+	if len(entry.Insert) == 0 && len(entry.Override) == 0 && len(entry.Delete) == 0 {
+		return nil, nil
+	}
+
+	transform = &HeaderTransform{}
+
+	if transform.Insert, err = compileHeaderRules(entry.Insert); err != nil {
+		return nil, err
+	}
+
+	if transform.Override, err = compileHeaderRules(entry.Override); err != nil {
+		return nil, err
+	}
+
+	for _, header := range entry.Delete {
+		transform.Delete = append(transform.Delete, http.CanonicalHeaderKey(header))
+	}
+
+	return transform, nil
+}
+
+// NewTransforms compiles the global transforms together with a route's own.
+// In "merge" mode (the default), the global transforms are applied first and
+// the route's second, so a route can override or delete headers set globally.
+// In "replace" mode only the route's transforms are applied.
+func NewTransforms(global ConfigTransform, route ConfigRouteTransform) (*Transforms, error) {
+	var layers []ConfigTransform
+
+	switch strings.ToLower(route.Mode) {
+	case "", TransformModeMerge:
+		layers = []ConfigTransform{global, {Request: route.Request, Response: route.Response}}
+	case TransformModeReplace:
+		layers = []ConfigTransform{{Request: route.Request, Response: route.Response}}
+	default:
+		return nil, fmt.Errorf("unknown transform mode %q", route.Mode)
+	}
+
+	transforms := &Transforms{}
+	for _, layer := range layers {
+		if transform, err := NewHeaderTransform(layer.Request); err != nil {
+			return nil, fmt.Errorf("request transform: %s", err)
+		} else if transform != nil {
+			transforms.Request = append(transforms.Request, transform)
+		}
+
+		if transform, err := NewHeaderTransform(layer.Response); err != nil {
+			return nil, fmt.Errorf("response transform: %s", err)
+		} else if transform != nil {
+			transforms.Response = append(transforms.Response, transform)
+		}
+	}
+
+	return transforms, nil
+}
@@ -0,0 +1,305 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/rabbitt/portunus/portunus/logging"
+)
+
+const DefaultTunnelIdleTimeout = 5 * time.Minute
+
+// reasons a tunnel was closed, for metrics
+const (
+	tunnelClosed      = "closed"
+	tunnelIdleTimeout = "idle_timeout"
+	tunnelMaxLifetime = "max_lifetime"
+	tunnelShutdown    = "shutdown"
+)
+
+type contextKeyConn struct{}
+
+// UpgradePolicy decides which protocol upgrades (e.g., WebSocket) a route
+// allows, and how long the resulting tunnels may live.
+type UpgradePolicy struct {
+	protocols   map[string]bool // empty allows any protocol
+	IdleTimeout time.Duration   // 0 if tunnels may stay idle indefinitely
+	MaxLifetime time.Duration   // 0 if tunnels may stay open indefinitely
+}
+
+// NewUpgradePolicy validates the route's upgrade config, returning nil if
+// upgrades aren't enabled.
+func NewUpgradePolicy(config ConfigUpgrade, protocol string) (*UpgradePolicy, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	if protocol != ProtocolHTTP1 {
+		return nil, fmt.Errorf("upgrade: protocol upgrades need an http1 upstream, not %s", protocol)
+	} else if config.MaxLifetime < 0 {
+		return nil, fmt.Errorf("upgrade: max_lifetime can't be negative")
+	}
+
+	policy := &UpgradePolicy{
+		protocols:   make(map[string]bool),
+		IdleTimeout: config.IdleTimeout,
+		MaxLifetime: config.MaxLifetime,
+	}
+	// an idle_timeout of 0 means the default, and a negative one disables it
+	if policy.IdleTimeout == 0 {
+		policy.IdleTimeout = DefaultTunnelIdleTimeout
+	} else if policy.IdleTimeout < 0 {
+		policy.IdleTimeout = 0
+	}
+
+	for _, name := range config.Protocols {
+		policy.protocols[strings.ToLower(name)] = true
+	}
+
+	return policy, nil
+}
+
+// Allows reports whether the route accepts an upgrade to the given protocol.
+func (policy *UpgradePolicy) Allows(protocol string) bool {
+	if policy == nil {
+		return false
+	}
+	return len(policy.protocols) == 0 || policy.protocols[strings.ToLower(protocol)]
+}
+
+// upgradeType returns the protocol the request asks to upgrade to, or "".
+func upgradeType(req *http.Request) string {
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return req.Header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// stripUpgrade turns an upgrade request into a plain one, which, as far as
+// the upstream is concerned, is a client that never asked.
+func stripUpgrade(req *http.Request) {
+	req.Header.Del("Upgrade")
+	req.Header.Del("Connection")
+}
+
+// withConn makes the client's connection available to the request, so that
+// its deadlines can be lifted once it's upgraded (see http.Server.ConnContext).
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, contextKeyConn{}, conn)
+}
+
+// clearDeadlines removes the server's read and write timeouts from the
+// client's connection, which would otherwise cut off the tunnel.
+func clearDeadlines(req *http.Request) {
+	if conn, ok := req.Context().Value(contextKeyConn{}).(net.Conn); ok {
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// Tunnels tracks the server's upgraded connections, so that they can be
+// counted and drained on shutdown.
+type Tunnels struct {
+	mutex   sync.Mutex
+	tunnels map[*tunnel]struct{}
+	drained chan struct{} // closed when the last tunnel is, while draining
+}
+
+func NewTunnels() *Tunnels {
+	return &Tunnels{tunnels: make(map[*tunnel]struct{})}
+}
+
+// tunnel wraps the upstream side of an upgraded connection. The reverse proxy
+// copies both directions through it, so it sees all of the tunnel's traffic.
+type tunnel struct {
+	io.ReadWriteCloser
+
+	tunnels  *Tunnels
+	route    string
+	opened   time.Time
+	lastUsed int64 // UnixNano
+	idle     time.Duration
+
+	closeOnce sync.Once
+	idleTimer *time.Timer
+	lifeTimer *time.Timer
+	onClose   func()
+}
+
+// Open starts tracking the upstream connection of an upgraded request.
+// onClose is called once the tunnel closes, for whatever reason.
+func (tunnels *Tunnels) Open(route string, policy *UpgradePolicy, conn io.ReadWriteCloser, onClose func()) io.ReadWriteCloser {
+	t := &tunnel{
+		ReadWriteCloser: conn,
+		tunnels:         tunnels,
+		route:           route,
+		opened:          time.Now(),
+		lastUsed:        time.Now().UnixNano(),
+		idle:            policy.IdleTimeout,
+		onClose:         onClose,
+	}
+
+	if t.idle > 0 {
+		t.idleTimer = time.AfterFunc(t.idle, t.checkIdle)
+	}
+	if policy.MaxLifetime > 0 {
+		t.lifeTimer = time.AfterFunc(policy.MaxLifetime, func() { t.closeWithReason(tunnelMaxLifetime) })
+	}
+
+	if tunnels != nil {
+		tunnels.mutex.Lock()
+		tunnels.tunnels[t] = struct{}{}
+		tunnels.mutex.Unlock()
+	}
+
+	promTunnels.Add(1, route)
+	proxyLog.DebugWithFields("Tunnel opened", log.Fields{"route": route})
+
+	return t
+}
+
+func (t *tunnel) Read(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&t.lastUsed, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (t *tunnel) Write(p []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Write(p)
+	if n > 0 {
+		atomic.StoreInt64(&t.lastUsed, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// checkIdle closes the tunnel if nothing has passed through it for the idle
+// timeout, or checks again once it could have been.
+func (t *tunnel) checkIdle() {
+	idleFor := time.Since(time.Unix(0, atomic.LoadInt64(&t.lastUsed)))
+	if idleFor >= t.idle {
+		t.closeWithReason(tunnelIdleTimeout)
+		return
+	}
+	t.idleTimer.Reset(t.idle - idleFor)
+}
+
+func (t *tunnel) Close() error {
+	return t.closeWithReason(tunnelClosed)
+}
+
+func (t *tunnel) closeWithReason(reason string) error {
+	var err error
+	t.closeOnce.Do(func() {
+		if t.idleTimer != nil {
+			t.idleTimer.Stop()
+		}
+		if t.lifeTimer != nil {
+			t.lifeTimer.Stop()
+		}
+
+		err = t.ReadWriteCloser.Close()
+		t.tunnels.remove(t)
+
+		promTunnels.Add(-1, t.route)
+		promTunnelsClosed.Add(1, t.route, reason)
+		proxyLog.DebugWithFields("Tunnel closed", log.Fields{
+			"route": t.route, "reason": reason, "duration": time.Since(t.opened),
+		})
+
+		if t.onClose != nil {
+			t.onClose()
+		}
+	})
+	return err
+}
+
+func (tunnels *Tunnels) remove(t *tunnel) {
+	if tunnels == nil {
+		return
+	}
+
+	tunnels.mutex.Lock()
+	defer tunnels.mutex.Unlock()
+
+	delete(tunnels.tunnels, t)
+	if len(tunnels.tunnels) == 0 && tunnels.drained != nil {
+		close(tunnels.drained)
+		tunnels.drained = nil
+	}
+}
+
+// Len returns the number of open tunnels.
+func (tunnels *Tunnels) Len() int {
+	if tunnels == nil {
+		return 0
+	}
+
+	tunnels.mutex.Lock()
+	defer tunnels.mutex.Unlock()
+	return len(tunnels.tunnels)
+}
+
+// Drain waits for open tunnels to close on their own until the context is
+// done, and then closes whatever is left.
+func (tunnels *Tunnels) Drain(ctx context.Context) {
+	if tunnels == nil {
+		return
+	}
+
+	tunnels.mutex.Lock()
+	if len(tunnels.tunnels) == 0 {
+		tunnels.mutex.Unlock()
+		return
+	}
+	if tunnels.drained == nil {
+		tunnels.drained = make(chan struct{})
+	}
+	drained := tunnels.drained
+	log.InfoWithFields("Waiting for tunnels to close", log.Fields{"tunnels": len(tunnels.tunnels)})
+	tunnels.mutex.Unlock()
+
+	select {
+	case <-drained:
+		return
+	case <-ctx.Done():
+	}
+
+	tunnels.mutex.Lock()
+	remaining := make([]*tunnel, 0, len(tunnels.tunnels))
+	for t := range tunnels.tunnels {
+		remaining = append(remaining, t)
+	}
+	tunnels.mutex.Unlock()
+
+	log.WarnWithFields("Closing tunnels still open at shutdown", log.Fields{"tunnels": len(remaining)})
+	for _, t := range remaining {
+		t.closeWithReason(tunnelShutdown)
+	}
+}
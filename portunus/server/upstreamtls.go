@@ -0,0 +1,168 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/rabbitt/portunus/portunus/logging"
+)
+
+// UpstreamTLS is a route's TLS settings for connecting to https upstreams. A
+// nil UpstreamTLS uses the system trust store and no client certificate.
+type UpstreamTLS struct {
+	key    ConfigUpstreamTLS
+	config *tls.Config
+}
+
+// NewUpstreamTLS loads the CA bundle and client certificate, returning nil if
+// nothing is configured.
+func NewUpstreamTLS(config ConfigUpstreamTLS) (*UpstreamTLS, error) {
+	if config == (ConfigUpstreamTLS{}) {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.MinVersion != "" {
+		version, err := parseTLSVersion(config.MinVersion)
+		if err != nil {
+			return nil, fmt.Errorf("upstream_tls.min_version: %s", err)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if config.CA != "" {
+		pool, err := loadCertPool(config.CA)
+		if err != nil {
+			return nil, fmt.Errorf("upstream_tls.ca: %s", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (config.Cert == "") != (config.Key == "") {
+		return nil, fmt.Errorf("upstream_tls: cert and key must be given together")
+	} else if config.Cert != "" {
+		certificate, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+		if err != nil {
+			return nil, fmt.Errorf("upstream_tls: unable to load client certificate %s: %s", config.Cert, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return &UpstreamTLS{key: config, config: tlsConfig}, nil
+}
+
+// Config returns the TLS client config, or nil for the defaults.
+func (upstreamTLS *UpstreamTLS) Config() *tls.Config {
+	if upstreamTLS == nil {
+		return nil
+	}
+	return upstreamTLS.config
+}
+
+// Transports holds an upstream transport for each distinct combination of
+// upstream TLS configuration, protocol and connection timeouts, so that routes
+// with the same settings share a connection pool. Each is created the first
+// time it's needed.
+type Transports struct {
+	config *Config
+
+	mutex      sync.Mutex
+	transports map[transportKey]upstreamTransport
+}
+
+type transportKey struct {
+	tls            ConfigUpstreamTLS
+	protocol       string
+	connect        time.Duration
+	idleConnection time.Duration
+}
+
+// NewTransports creates the transports for the given config, starting with
+// the HTTP/1.1 one used by routes without any upstream TLS settings or
+// timeout overrides.
+func NewTransports(config *Config) *Transports {
+	timeouts := globalTimeouts(config.Network.Timeouts)
+	key := transportKey{
+		protocol:       ProtocolHTTP1,
+		connect:        timeouts.Connect,
+		idleConnection: timeouts.IdleConnection,
+	}
+
+	return &Transports{
+		config: config,
+		transports: map[transportKey]upstreamTransport{
+			key: NewTransport(config, nil, timeouts),
+		},
+	}
+}
+
+// For returns the transport for the given upstream TLS settings, protocol and
+// timeouts.
+func (transports *Transports) For(upstreamTLS *UpstreamTLS, protocol string, timeouts RouteTimeouts) http.RoundTripper {
+	if protocol == "" {
+		protocol = ProtocolHTTP1
+	}
+
+	key := transportKey{
+		protocol:       protocol,
+		connect:        timeouts.Connect,
+		idleConnection: timeouts.IdleConnection,
+	}
+	if upstreamTLS != nil {
+		key.tls = upstreamTLS.key
+	}
+
+	transports.mutex.Lock()
+	defer transports.mutex.Unlock()
+
+	transport, ok := transports.transports[key]
+	if !ok {
+		transport = NewUpstreamTransport(transports.config, upstreamTLS.Config(), protocol, timeouts)
+		transports.transports[key] = transport
+
+		proxyLog.DebugWithFields("Created upstream transport", log.Fields{
+			"transports":               len(transports.transports),
+			"protocol":                 protocol,
+			"tls.ca":                   key.tls.CA,
+			"tls.cert":                 key.tls.Cert,
+			"tls.server_name":          key.tls.ServerName,
+			"tls.insecure_skip_verify": key.tls.InsecureSkipVerify,
+			"timeouts.connect":         key.connect,
+			"timeouts.idle_connection": key.idleConnection,
+		})
+	}
+
+	return transport
+}
+
+// CloseIdleConnections closes the idle connections of every transport.
+func (transports *Transports) CloseIdleConnections() {
+	transports.mutex.Lock()
+	defer transports.mutex.Unlock()
+
+	for _, transport := range transports.transports {
+		transport.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tracing
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	PropagationW3C = "w3c"
+	PropagationB3  = "b3"
+
+	// tracestate longer than this may be dropped, per the W3C spec
+	maxTraceStateLength = 512
+)
+
+// Propagator reads and writes span contexts in request headers.
+type Propagator interface {
+	Extract(header http.Header) (SpanContext, bool)
+	Inject(sc SpanContext, header http.Header)
+}
+
+// NewPropagators returns the propagators for the given formats, in order. With
+// no formats given, only W3C trace context is used.
+func NewPropagators(formats []string) ([]Propagator, error) {
+	if len(formats) == 0 {
+		formats = []string{PropagationW3C}
+	}
+
+	propagators := make([]Propagator, 0, len(formats))
+	for _, format := range formats {
+		switch strings.ToLower(strings.TrimSpace(format)) {
+		case PropagationW3C:
+			propagators = append(propagators, W3CPropagator{})
+		case PropagationB3:
+			propagators = append(propagators, B3Propagator{})
+		default:
+			return nil, fmt.Errorf("tracing: unknown propagation format %q", format)
+		}
+	}
+
+	return propagators, nil
+}
+
+// Extract returns the span context of the first propagation format found in
+// the headers.
+func (t *Tracer) Extract(header http.Header) (SpanContext, bool) {
+	if t == nil {
+		return SpanContext{}, false
+	}
+
+	for _, propagator := range t.propagators {
+		if sc, ok := propagator.Extract(header); ok {
+			return sc, true
+		}
+	}
+
+	return SpanContext{}, false
+}
+
+// Inject writes the span's context into the headers, in every configured
+// format, replacing whatever was there.
+func (t *Tracer) Inject(span *Span, header http.Header) {
+	if t == nil || span == nil {
+		return
+	}
+
+	for _, propagator := range t.propagators {
+		propagator.Inject(span.Context(), header)
+	}
+}
+
+// W3CPropagator implements https://www.w3.org/TR/trace-context/
+type W3CPropagator struct{}
+
+func (W3CPropagator) Extract(header http.Header) (SpanContext, bool) {
+	value := strings.TrimSpace(header.Get("Traceparent"))
+
+	// version-traceid-parentid-flags; future versions may append fields
+	if len(value) < 55 || (len(value) > 55 && (value[:2] == "00" || value[55] != '-')) {
+		return SpanContext{}, false
+	}
+
+	parts := strings.Split(value[:55], "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+
+	var sc SpanContext
+	var flags [1]byte
+	if !decodeHex(parts[0], make([]byte, 1)) ||
+		!decodeHex(parts[1], sc.TraceID[:]) ||
+		!decodeHex(parts[2], sc.SpanID[:]) ||
+		!decodeHex(parts[3], flags[:]) ||
+		!sc.IsValid() {
+		return SpanContext{}, false
+	}
+	sc.Flags = flags[0] & FlagSampled
+
+	if state := strings.Join(header["Tracestate"], ","); len(state) <= maxTraceStateLength {
+		sc.TraceState = state
+	}
+
+	return sc, true
+}
+
+func (W3CPropagator) Inject(sc SpanContext, header http.Header) {
+	header.Set("Traceparent", fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags))
+
+	if sc.TraceState != "" {
+		header.Set("Tracestate", sc.TraceState)
+	} else {
+		header.Del("Tracestate")
+	}
+}
+
+// B3Propagator implements https://github.com/openzipkin/b3-propagation,
+// reading both the single and multiple header forms, and writing the
+// multiple header form.
+type B3Propagator struct{}
+
+func (B3Propagator) Extract(header http.Header) (SpanContext, bool) {
+	if single := header.Get("B3"); single != "" {
+		parts := strings.Split(single, "-")
+		if len(parts) < 2 {
+			return SpanContext{}, false
+		}
+
+		sampled := ""
+		if len(parts) > 2 {
+			sampled = parts[2]
+		}
+
+		return b3SpanContext(parts[0], parts[1], sampled)
+	}
+
+	sampled := header.Get("X-B3-Sampled")
+	if header.Get("X-B3-Flags") == "1" {
+		sampled = "d"
+	}
+
+	return b3SpanContext(header.Get("X-B3-TraceId"), header.Get("X-B3-SpanId"), sampled)
+}
+
+func b3SpanContext(traceID, spanID, sampled string) (SpanContext, bool) {
+	var sc SpanContext
+
+	// 64 bit trace ids are left padded to 128 bits
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+
+	if !decodeHex(traceID, sc.TraceID[:]) || !decodeHex(spanID, sc.SpanID[:]) || !sc.IsValid() {
+		return SpanContext{}, false
+	}
+
+	switch strings.ToLower(sampled) {
+	case "1", "d", "true":
+		sc.Flags = FlagSampled
+	case "0", "false":
+	default:
+		// no (or an unknown) decision, so it's up to the local sampler
+		sc.SamplingDeferred = true
+	}
+
+	return sc, true
+}
+
+func (B3Propagator) Inject(sc SpanContext, header http.Header) {
+	header.Del("B3")
+	header.Set("X-B3-TraceId", sc.TraceID.String())
+	header.Set("X-B3-SpanId", sc.SpanID.String())
+	header.Del("X-B3-ParentSpanId")
+	header.Del("X-B3-Flags")
+
+	if sc.IsSampled() {
+		header.Set("X-B3-Sampled", "1")
+	} else {
+		header.Set("X-B3-Sampled", "0")
+	}
+}
+
+// decodeHex decodes lowercase hex of exactly the destination's length.
+func decodeHex(value string, dst []byte) bool {
+	if len(value) != hex.EncodedLen(len(dst)) || strings.ToLower(value) != value {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(value))
+	return err == nil
+}
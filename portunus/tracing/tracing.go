@@ -0,0 +1,416 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package tracing implements just enough of OpenTelemetry style distributed
+// tracing for Portunus: spans, W3C trace context (and B3) propagation, and
+// exporting over OTLP/HTTP or to a file.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/rabbitt/portunus/portunus/logging"
+)
+
+const (
+	DefaultServiceName   = "portunus"
+	DefaultBatchSize     = 512
+	DefaultQueueSize     = 2048
+	DefaultFlushInterval = 5 * time.Second
+
+	// FlagSampled is the trace flag marking a trace as sampled.
+	FlagSampled byte = 0x01
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id TraceID) IsValid() bool  { return id != TraceID{} }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+func (id SpanID) IsValid() bool   { return id != SpanID{} }
+
+// SpanContext is the part of a span that's propagated across processes.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+	Remote     bool
+	// the remote span left the sampling decision to us (e.g., B3 headers
+	// without a sampled flag)
+	SamplingDeferred bool
+}
+
+func (sc SpanContext) IsValid() bool   { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+func (sc SpanContext) IsSampled() bool { return sc.Flags&FlagSampled != 0 }
+
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = iota + 1
+	SpanKindServer
+	SpanKindClient
+)
+
+// Span is a single timed operation within a trace. All methods are safe to
+// call on a nil span, which is what's returned when tracing is disabled.
+type Span struct {
+	mutex      sync.Mutex
+	tracer     *Tracer
+	name       string
+	kind       SpanKind
+	context    SpanContext
+	parent     SpanID
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        string
+	ended      bool
+}
+
+// SpanData is a finished span, as handed to exporters.
+type SpanData struct {
+	Name       string                 `json:"name"`
+	Kind       SpanKind               `json:"kind"`
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_span_id,omitempty"`
+	TraceState string                 `json:"trace_state,omitempty"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// Context returns the span's context, for propagation.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute records a string, bool, integer or float attribute.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.err = err.Error()
+}
+
+// End finishes the span, queueing it for export if it's sampled. Calls after
+// the first are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mutex.Unlock()
+
+	if s.context.IsSampled() {
+		s.tracer.enqueue(s)
+	}
+}
+
+func (s *Span) data() SpanData {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data := SpanData{
+		Name:       s.name,
+		Kind:       s.kind,
+		TraceID:    s.context.TraceID.String(),
+		SpanID:     s.context.SpanID.String(),
+		TraceState: s.context.TraceState,
+		Start:      s.start,
+		End:        s.end,
+		Attributes: s.attributes,
+		Error:      s.err,
+	}
+
+	if s.parent.IsValid() {
+		data.ParentID = s.parent.String()
+	}
+
+	return data
+}
+
+// Exporter sends finished spans somewhere.
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+	Shutdown(ctx context.Context) error
+}
+
+// Options configures a Tracer.
+type Options struct {
+	ServiceName string
+	SampleRatio float64
+	Propagation []string
+	Exporter    Exporter
+}
+
+// Tracer creates spans and exports them, in batches, in the background. A nil
+// tracer is valid and creates nil (no-op) spans.
+type Tracer struct {
+	serviceName string
+	sampleRatio float64
+	propagators []Propagator
+	exporter    Exporter
+	queue       chan *Span
+	flush       chan chan struct{}
+	done        chan struct{}
+	stopOnce    sync.Once
+}
+
+// NewTracer starts a tracer exporting to the given exporter.
+func NewTracer(options Options) (*Tracer, error) {
+	if options.Exporter == nil {
+		return nil, fmt.Errorf("tracing: no exporter")
+	}
+
+	if options.ServiceName == "" {
+		options.ServiceName = DefaultServiceName
+	}
+
+	if options.SampleRatio < 0 || options.SampleRatio > 1 {
+		return nil, fmt.Errorf("tracing: sample_ratio must be between 0 and 1")
+	}
+
+	propagators, err := NewPropagators(options.Propagation)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer := &Tracer{
+		serviceName: options.ServiceName,
+		sampleRatio: options.SampleRatio,
+		propagators: propagators,
+		exporter:    options.Exporter,
+		queue:       make(chan *Span, DefaultQueueSize),
+		flush:       make(chan chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	go tracer.run()
+
+	return tracer, nil
+}
+
+// ServiceName returns the name spans are reported under.
+func (t *Tracer) ServiceName() string {
+	if t == nil {
+		return ""
+	}
+	return t.serviceName
+}
+
+// Start begins a new span, as a child of the span (or remote span context) in
+// ctx if there is one, and returns a context carrying it.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+
+	parent, ok := spanContextFromContext(ctx)
+	if ok && parent.IsValid() {
+		span.context = SpanContext{TraceID: parent.TraceID, Flags: parent.Flags, TraceState: parent.TraceState}
+		span.parent = parent.SpanID
+		if parent.SamplingDeferred && t.sample(parent.TraceID) {
+			span.context.Flags |= FlagSampled
+		}
+	} else {
+		span.context.TraceID = newTraceID()
+		if t.sample(span.context.TraceID) {
+			span.context.Flags = FlagSampled
+		}
+	}
+
+	span.context.SpanID = newSpanID()
+
+	return ContextWithSpan(ctx, span), span
+}
+
+// sample makes a deterministic sampling decision for a new trace, based on
+// its id, so that every span of a trace gets the same decision.
+func (t *Tracer) sample(id TraceID) bool {
+	switch {
+	case t.sampleRatio >= 1:
+		return true
+	case t.sampleRatio <= 0:
+		return false
+	}
+
+	bound := uint64(t.sampleRatio * (1 << 63))
+	return binary.BigEndian.Uint64(id[8:])>>1 < bound
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+		log.Debug("tracing: export queue full, dropping span")
+	}
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(DefaultFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, DefaultBatchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultFlushInterval)
+		if err := t.exporter.Export(ctx, batch); err != nil {
+			log.WarnWithFields("Unable to export spans", log.Fields{"error": err, "spans": len(batch)})
+		}
+		cancel()
+
+		batch = make([]SpanData, 0, DefaultBatchSize)
+	}
+
+	for {
+		select {
+		case span := <-t.queue:
+			if batch = append(batch, span.data()); len(batch) >= DefaultBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case flushed := <-t.flush:
+			for drained := false; !drained; {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span.data())
+				default:
+					drained = true
+				}
+			}
+			export()
+			close(flushed)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// Shutdown exports any queued spans and stops the tracer.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	var err error
+	t.stopOnce.Do(func() {
+		flushed := make(chan struct{})
+		select {
+		case t.flush <- flushed:
+			select {
+			case <-flushed:
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+
+		close(t.done)
+		err = t.exporter.Shutdown(ctx)
+	})
+
+	return err
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteKey
+)
+
+// ContextWithSpan returns a copy of the context carrying the span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey, span)
+}
+
+// ContextWithRemote returns a copy of the context carrying a span context
+// extracted from an incoming request, to be used as the parent of new spans.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	sc.Remote = true
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+// SpanFromContext returns the current span, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+func spanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.context, true
+	}
+	sc, ok := ctx.Value(remoteKey).(SpanContext)
+	return sc, ok
+}
+
+func newTraceID() (id TraceID) {
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return
+}
+
+func newSpanID() (id SpanID) {
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return
+}
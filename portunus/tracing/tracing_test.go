@@ -0,0 +1,488 @@
+// Copyright © 2018 Carl P. Corliss <carl@corliss.name>
+//
+// This program is free software; you can redistribute it and/or
+// modify it under the terms of the GNU General Public License
+// as published by the Free Software Foundation; either version 2
+// of the License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+// newFileTracer returns a tracer exporting to a file, and a func that shuts
+// it down and returns the spans written.
+func newFileTracer(t *testing.T, ratio float64, propagation ...string) (*Tracer, func() []SpanData) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+
+	exporter, err := NewWriterExporter(path)
+	if err != nil {
+		t.Fatalf("NewWriterExporter: %v", err)
+	}
+
+	tracer, err := NewTracer(Options{SampleRatio: ratio, Propagation: propagation, Exporter: exporter})
+	if err != nil {
+		t.Fatalf("NewTracer: %v", err)
+	}
+
+	return tracer, func() []SpanData {
+		if err := tracer.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+		return readSpans(t, path)
+	}
+}
+
+func readSpans(t *testing.T, path string) []SpanData {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var spans []SpanData
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var span SpanData
+		if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+			t.Fatalf("invalid span %q: %v", scanner.Text(), err)
+		}
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+func spansByName(spans []SpanData) map[string]SpanData {
+	byName := make(map[string]SpanData, len(spans))
+	for _, span := range spans {
+		byName[span.Name] = span
+	}
+	return byName
+}
+
+func TestW3CExtract(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		ok          bool
+		sampled     bool
+	}{
+		{"sampled", "00-" + testTraceID + "-" + testSpanID + "-01", true, true},
+		{"not sampled", "00-" + testTraceID + "-" + testSpanID + "-00", true, false},
+		{"other flags ignored", "00-" + testTraceID + "-" + testSpanID + "-03", true, true},
+		{"future version with more fields", "01-" + testTraceID + "-" + testSpanID + "-01-extra", true, true},
+		{"version 00 with more fields", "00-" + testTraceID + "-" + testSpanID + "-01-extra", false, false},
+		{"invalid version", "ff-" + testTraceID + "-" + testSpanID + "-01", false, false},
+		{"zero trace id", "00-" + strings.Repeat("0", 32) + "-" + testSpanID + "-01", false, false},
+		{"zero span id", "00-" + testTraceID + "-" + strings.Repeat("0", 16) + "-01", false, false},
+		{"uppercase", "00-" + strings.ToUpper(testTraceID) + "-" + testSpanID + "-01", false, false},
+		{"too short", "00-" + testTraceID + "-" + testSpanID[:15] + "-01", false, false},
+		{"missing", "", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set("Traceparent", test.traceparent)
+
+			sc, ok := W3CPropagator{}.Extract(header)
+			if ok != test.ok {
+				t.Fatalf("ok = %v, want %v", ok, test.ok)
+			}
+			if !ok {
+				return
+			}
+			if sc.TraceID.String() != testTraceID || sc.SpanID.String() != testSpanID {
+				t.Errorf("got %s-%s", sc.TraceID, sc.SpanID)
+			}
+			if sc.IsSampled() != test.sampled {
+				t.Errorf("sampled = %v, want %v", sc.IsSampled(), test.sampled)
+			}
+			if sc.SamplingDeferred {
+				t.Errorf("W3C trace context always carries a sampling decision")
+			}
+		})
+	}
+}
+
+func TestW3CRoundTrip(t *testing.T) {
+	header := http.Header{}
+	header.Set("Traceparent", "00-"+testTraceID+"-"+testSpanID+"-01")
+	header.Add("Tracestate", "vendor1=a")
+	header.Add("Tracestate", "vendor2=b")
+
+	sc, ok := W3CPropagator{}.Extract(header)
+	if !ok {
+		t.Fatal("unable to extract")
+	}
+	if sc.TraceState != "vendor1=a,vendor2=b" {
+		t.Errorf("tracestate = %q", sc.TraceState)
+	}
+
+	out := http.Header{}
+	W3CPropagator{}.Inject(sc, out)
+	if got := out.Get("Traceparent"); got != header.Get("Traceparent") {
+		t.Errorf("traceparent = %q, want %q", got, header.Get("Traceparent"))
+	}
+	if got := out.Get("Tracestate"); got != "vendor1=a,vendor2=b" {
+		t.Errorf("tracestate = %q", got)
+	}
+
+	again, ok := W3CPropagator{}.Extract(out)
+	if !ok || again != sc {
+		t.Errorf("round trip: got %+v, want %+v", again, sc)
+	}
+
+	// an oversized tracestate is dropped, and a stale one isn't passed on
+	header.Set("Tracestate", strings.Repeat("x", maxTraceStateLength+1))
+	if sc, _ = (W3CPropagator{}).Extract(header); sc.TraceState != "" {
+		t.Errorf("expected oversized tracestate to be dropped")
+	}
+	W3CPropagator{}.Inject(sc, out)
+	if _, ok := out["Tracestate"]; ok {
+		t.Errorf("expected tracestate to be removed")
+	}
+}
+
+func TestB3Extract(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   map[string]string
+		ok       bool
+		traceID  string
+		sampled  bool
+		deferred bool
+	}{
+		{"multi sampled", map[string]string{"X-B3-TraceId": testTraceID, "X-B3-SpanId": testSpanID, "X-B3-Sampled": "1"}, true, testTraceID, true, false},
+		{"multi not sampled", map[string]string{"X-B3-TraceId": testTraceID, "X-B3-SpanId": testSpanID, "X-B3-Sampled": "0"}, true, testTraceID, false, false},
+		{"multi legacy true", map[string]string{"X-B3-TraceId": testTraceID, "X-B3-SpanId": testSpanID, "X-B3-Sampled": "true"}, true, testTraceID, true, false},
+		{"multi legacy false", map[string]string{"X-B3-TraceId": testTraceID, "X-B3-SpanId": testSpanID, "X-B3-Sampled": "false"}, true, testTraceID, false, false},
+		{"multi debug", map[string]string{"X-B3-TraceId": testTraceID, "X-B3-SpanId": testSpanID, "X-B3-Flags": "1"}, true, testTraceID, true, false},
+		{"multi deferred", map[string]string{"X-B3-TraceId": testTraceID, "X-B3-SpanId": testSpanID}, true, testTraceID, false, true},
+		{"multi 64 bit trace id", map[string]string{"X-B3-TraceId": testTraceID[16:], "X-B3-SpanId": testSpanID, "X-B3-Sampled": "1"}, true, strings.Repeat("0", 16) + testTraceID[16:], true, false},
+		{"multi missing span id", map[string]string{"X-B3-TraceId": testTraceID, "X-B3-Sampled": "1"}, false, "", false, false},
+		{"single sampled", map[string]string{"B3": testTraceID + "-" + testSpanID + "-1"}, true, testTraceID, true, false},
+		{"single not sampled", map[string]string{"B3": testTraceID + "-" + testSpanID + "-0"}, true, testTraceID, false, false},
+		{"single debug with parent", map[string]string{"B3": testTraceID + "-" + testSpanID + "-d-" + testSpanID}, true, testTraceID, true, false},
+		{"single deferred", map[string]string{"B3": testTraceID + "-" + testSpanID}, true, testTraceID, false, true},
+		{"single deny only", map[string]string{"B3": "0"}, false, "", false, false},
+		{"single takes precedence", map[string]string{"B3": testTraceID + "-" + testSpanID + "-0", "X-B3-TraceId": testTraceID, "X-B3-SpanId": testSpanID, "X-B3-Sampled": "1"}, true, testTraceID, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			for name, value := range test.header {
+				header.Set(name, value)
+			}
+
+			sc, ok := B3Propagator{}.Extract(header)
+			if ok != test.ok {
+				t.Fatalf("ok = %v, want %v", ok, test.ok)
+			}
+			if !ok {
+				return
+			}
+			if sc.TraceID.String() != test.traceID || sc.SpanID.String() != testSpanID {
+				t.Errorf("got %s-%s", sc.TraceID, sc.SpanID)
+			}
+			if sc.IsSampled() != test.sampled {
+				t.Errorf("sampled = %v, want %v", sc.IsSampled(), test.sampled)
+			}
+			if sc.SamplingDeferred != test.deferred {
+				t.Errorf("deferred = %v, want %v", sc.SamplingDeferred, test.deferred)
+			}
+		})
+	}
+}
+
+func TestB3RoundTrip(t *testing.T) {
+	for _, sampled := range []string{"0", "1"} {
+		header := http.Header{}
+		header.Set("B3", "stale")
+		header.Set("X-B3-ParentSpanId", testSpanID)
+		header.Set("X-B3-Flags", "1")
+
+		sc := SpanContext{Flags: 0}
+		copy(sc.TraceID[:], mustHex(t, testTraceID))
+		copy(sc.SpanID[:], mustHex(t, testSpanID))
+		if sampled == "1" {
+			sc.Flags = FlagSampled
+		}
+
+		B3Propagator{}.Inject(sc, header)
+		for name, want := range map[string]string{
+			"X-B3-TraceId": testTraceID, "X-B3-SpanId": testSpanID, "X-B3-Sampled": sampled,
+			"B3": "", "X-B3-ParentSpanId": "", "X-B3-Flags": "",
+		} {
+			if got := header.Get(name); got != want {
+				t.Errorf("%s = %q, want %q", name, got, want)
+			}
+		}
+
+		again, ok := B3Propagator{}.Extract(header)
+		if !ok || again != sc {
+			t.Errorf("round trip: got %+v, want %+v", again, sc)
+		}
+	}
+}
+
+func mustHex(t *testing.T, value string) []byte {
+	dst := make([]byte, len(value)/2)
+	if !decodeHex(value, dst) {
+		t.Fatalf("invalid hex %q", value)
+	}
+	return dst
+}
+
+func TestPropagators(t *testing.T) {
+	if _, err := NewPropagators([]string{"w3c", "zipkin"}); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+
+	tracer, finish := newFileTracer(t, 1, "b3", "w3c")
+	defer finish()
+
+	// the first format found wins
+	header := http.Header{}
+	header.Set("Traceparent", "00-"+testTraceID+"-"+testSpanID+"-01")
+	header.Set("X-B3-TraceId", strings.Repeat("1", 32))
+	header.Set("X-B3-SpanId", testSpanID)
+	if sc, ok := tracer.Extract(header); !ok || sc.TraceID.String() != strings.Repeat("1", 32) {
+		t.Errorf("expected the b3 context, got %+v", sc)
+	}
+
+	// and spans are injected in every format
+	_, span := tracer.Start(context.Background(), "test", SpanKindClient)
+	out := http.Header{}
+	tracer.Inject(span, out)
+	if out.Get("Traceparent") == "" || out.Get("X-B3-TraceId") != span.Context().TraceID.String() {
+		t.Errorf("expected both formats, got %v", out)
+	}
+	span.End()
+}
+
+func TestSpanLinkage(t *testing.T) {
+	for _, format := range []string{PropagationW3C, PropagationB3} {
+		t.Run(format, func(t *testing.T) {
+			tracer, finish := newFileTracer(t, 1, format)
+
+			incoming := http.Header{}
+			if format == PropagationW3C {
+				incoming.Set("Traceparent", "00-"+testTraceID+"-"+testSpanID+"-01")
+				incoming.Set("Tracestate", "vendor=a")
+			} else {
+				incoming.Set("B3", testTraceID+"-"+testSpanID+"-1")
+			}
+
+			remote, ok := tracer.Extract(incoming)
+			if !ok {
+				t.Fatal("unable to extract")
+			}
+
+			ctx := ContextWithRemote(context.Background(), remote)
+			ctx, server := tracer.Start(ctx, "server", SpanKindServer)
+			_, client := tracer.Start(ctx, "client", SpanKindClient)
+
+			outgoing := http.Header{}
+			tracer.Inject(client, outgoing)
+			propagated, ok := tracer.Extract(outgoing)
+			if !ok || propagated.TraceID.String() != testTraceID || propagated.SpanID != client.Context().SpanID {
+				t.Errorf("outgoing headers carry %+v, want the client span", propagated)
+			}
+
+			client.SetAttribute("http.status_code", 502)
+			client.End()
+			server.End()
+
+			spans := spansByName(finish())
+			if len(spans) != 2 {
+				t.Fatalf("expected 2 spans, got %v", spans)
+			}
+
+			if spans["server"].TraceID != testTraceID || spans["client"].TraceID != testTraceID {
+				t.Errorf("spans aren't part of the remote trace: %+v", spans)
+			}
+			if spans["server"].ParentID != testSpanID {
+				t.Errorf("server span parent = %s, want the remote span %s", spans["server"].ParentID, testSpanID)
+			}
+			if spans["client"].ParentID != server.Context().SpanID.String() {
+				t.Errorf("client span parent = %s, want the server span %s", spans["client"].ParentID, server.Context().SpanID)
+			}
+			if spans["client"].Attributes["http.status_code"] != float64(502) {
+				t.Errorf("attributes = %v", spans["client"].Attributes)
+			}
+			if format == PropagationW3C && spans["client"].TraceState != "vendor=a" {
+				t.Errorf("tracestate = %q, want it passed on", spans["client"].TraceState)
+			}
+		})
+	}
+}
+
+func TestSampling(t *testing.T) {
+	tests := []struct {
+		name    string
+		ratio   float64
+		header  map[string]string
+		sampled bool
+	}{
+		{"root, always", 1, nil, true},
+		{"root, never", 0, nil, false},
+		// a remote decision is always respected
+		{"w3c sampled, never", 0, map[string]string{"Traceparent": "00-" + testTraceID + "-" + testSpanID + "-01"}, true},
+		{"w3c not sampled, always", 1, map[string]string{"Traceparent": "00-" + testTraceID + "-" + testSpanID + "-00"}, false},
+		{"b3 sampled, never", 0, map[string]string{"X-B3-TraceId": testTraceID, "X-B3-SpanId": testSpanID, "X-B3-Sampled": "1"}, true},
+		{"b3 not sampled, always", 1, map[string]string{"X-B3-TraceId": testTraceID, "X-B3-SpanId": testSpanID, "X-B3-Sampled": "0"}, false},
+		// unless there isn't one, in which case the local sampler decides
+		{"b3 deferred, always", 1, map[string]string{"X-B3-TraceId": testTraceID, "X-B3-SpanId": testSpanID}, true},
+		{"b3 deferred, never", 0, map[string]string{"X-B3-TraceId": testTraceID, "X-B3-SpanId": testSpanID}, false},
+		{"b3 single deferred, always", 1, map[string]string{"B3": testTraceID + "-" + testSpanID}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracer, finish := newFileTracer(t, test.ratio, "w3c", "b3")
+
+			ctx := context.Background()
+			header := http.Header{}
+			for name, value := range test.header {
+				header.Set(name, value)
+			}
+			if remote, ok := tracer.Extract(header); ok {
+				ctx = ContextWithRemote(ctx, remote)
+			}
+
+			ctx, server := tracer.Start(ctx, "server", SpanKindServer)
+			_, client := tracer.Start(ctx, "client", SpanKindClient)
+
+			// children inherit the decision
+			if server.Context().IsSampled() != test.sampled || client.Context().IsSampled() != test.sampled {
+				t.Errorf("sampled = %v/%v, want %v", server.Context().IsSampled(), client.Context().IsSampled(), test.sampled)
+			}
+
+			outgoing := http.Header{}
+			tracer.Inject(client, outgoing)
+			if want := map[bool]string{true: "1", false: "0"}[test.sampled]; outgoing.Get("X-B3-Sampled") != want {
+				t.Errorf("X-B3-Sampled = %q, want %q", outgoing.Get("X-B3-Sampled"), want)
+			}
+
+			client.End()
+			server.End()
+
+			// only sampled spans are exported
+			if spans := finish(); (len(spans) == 2) != test.sampled || (len(spans) != 0) != test.sampled {
+				t.Errorf("exported %d spans, sampled: %v", len(spans), test.sampled)
+			}
+		})
+	}
+}
+
+func TestSampleRatio(t *testing.T) {
+	tracer, finish := newFileTracer(t, 0.25)
+	defer finish()
+
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		id := newTraceID()
+		decision := tracer.sample(id)
+		if decision != tracer.sample(id) {
+			t.Fatalf("sampling decision for %s isn't deterministic", id)
+		}
+		if decision {
+			sampled++
+		}
+	}
+
+	if sampled < 2200 || sampled > 2800 {
+		t.Errorf("sampled %d of 10000 traces, expected about 2500", sampled)
+	}
+
+	if _, err := NewTracer(Options{SampleRatio: 1.5, Exporter: &WriterExporter{}}); err == nil {
+		t.Error("expected an error for a sample ratio over 1")
+	}
+}
+
+func TestStdoutExporter(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = writer
+	exporter, err := NewWriterExporter("-")
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatalf("NewWriterExporter: %v", err)
+	}
+
+	tracer, err := NewTracer(Options{SampleRatio: 1, Exporter: exporter})
+	if err != nil {
+		t.Fatalf("NewTracer: %v", err)
+	}
+
+	_, span := tracer.Start(context.Background(), "stdout", SpanKindInternal)
+	span.SetAttribute("answer", 42)
+	span.End()
+
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	writer.Close()
+
+	output, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var data SpanData
+	if err := json.Unmarshal(output, &data); err != nil {
+		t.Fatalf("invalid span %q: %v", output, err)
+	}
+	if data.Name != "stdout" || data.SpanID != span.Context().SpanID.String() || data.Attributes["answer"] != float64(42) {
+		t.Errorf("unexpected span %+v", data)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+
+	ctx, span := tracer.Start(context.Background(), "noop", SpanKindServer)
+	if span != nil || SpanFromContext(ctx) != nil {
+		t.Errorf("expected no span")
+	}
+
+	span.SetAttribute("key", "value")
+	span.End()
+
+	header := http.Header{}
+	tracer.Inject(span, header)
+	if len(header) != 0 {
+		t.Errorf("expected no headers, got %v", header)
+	}
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}